@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+a period of the day, optionally only on some days of the week, with its own bandwidth limit. If End is before
+Start then the window runs over midnight, and the part after midnight counts as the day that it started on. If they
+are the same then the window is the whole day.
+*/
+type bandwidthWindow struct {
+	StartMinute int
+	EndMinute   int
+	//the days that the window starts on. Empty means every day
+	Days map[time.Weekday]bool
+	//bytes per second, 0 for no limit
+	Limit float64
+}
+
+func (w bandwidthWindow) startsOn(day time.Weekday) bool {
+	return len(w.Days) == 0 || w.Days[day]
+}
+
+func (w bandwidthWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.StartMinute == w.EndMinute {
+		return w.startsOn(t.Weekday())
+	}
+	if w.StartMinute < w.EndMinute {
+		return minute >= w.StartMinute && minute < w.EndMinute && w.startsOn(t.Weekday())
+	}
+	if minute >= w.StartMinute {
+		return w.startsOn(t.Weekday())
+	}
+	return minute < w.EndMinute && w.startsOn((t.Weekday()+6)%7)
+}
+
+/**
+the bandwidth limit to apply at any given time: the first window that contains the time, or Default otherwise
+*/
+type bandwidthSchedule struct {
+	Default float64
+	Windows []bandwidthWindow
+}
+
+func (s *bandwidthSchedule) LimitAt(t time.Time) float64 {
+	for _, window := range s.Windows {
+		if window.Contains(t) {
+			return window.Limit
+		}
+	}
+	return s.Default
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+/**
+parses a schedule of comma-separated windows, each "[days ]HH:MM-HH:MM=MB/s" where days is a day like "sat" or a
+range like "mon-fri", e.g. "mon-fri 08:00-18:00=2,sat-sun 00:00-00:00=0". Times are local. A limit of 0 means no limit.
+*/
+func parseBandwidthSchedule(from string, defaultLimit float64) (*bandwidthSchedule, error) {
+	schedule := &bandwidthSchedule{Default: defaultLimit}
+	for _, entry := range strings.Split(from, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		window, parseErr := parseBandwidthWindow(entry)
+		if parseErr != nil {
+			return nil, fmt.Errorf("could not read schedule entry '%s': %s", entry, parseErr)
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+	return schedule, nil
+}
+
+func parseBandwidthWindow(entry string) (bandwidthWindow, error) {
+	var window bandwidthWindow
+	equalsAt := strings.LastIndex(entry, "=")
+	if equalsAt < 0 {
+		return window, fmt.Errorf("expected =MB/s at the end")
+	}
+	limit, limitErr := strconv.ParseFloat(strings.TrimSpace(entry[equalsAt+1:]), 64)
+	if limitErr != nil || limit < 0 {
+		return window, fmt.Errorf("'%s' is not a valid limit", entry[equalsAt+1:])
+	}
+	window.Limit = limit * 1024 * 1024
+
+	fields := strings.Fields(entry[:equalsAt])
+	if len(fields) == 2 {
+		days, daysErr := parseWeekdayRange(fields[0])
+		if daysErr != nil {
+			return window, daysErr
+		}
+		window.Days = days
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return window, fmt.Errorf("expected a time range like 08:00-18:00")
+	}
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return window, fmt.Errorf("expected a time range like 08:00-18:00")
+	}
+	var timeErr error
+	window.StartMinute, timeErr = parseTimeOfDay(times[0])
+	if timeErr != nil {
+		return window, timeErr
+	}
+	window.EndMinute, timeErr = parseTimeOfDay(times[1])
+	return window, timeErr
+}
+
+func parseTimeOfDay(from string) (int, error) {
+	parsed, parseErr := time.Parse("15:04", from)
+	if parseErr != nil {
+		return 0, fmt.Errorf("'%s' is not a time like 08:00", from)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func parseWeekdayRange(from string) (map[time.Weekday]bool, error) {
+	ends := strings.Split(strings.ToLower(from), "-")
+	first, firstOk := weekdayNames[ends[0]]
+	last, lastOk := weekdayNames[ends[len(ends)-1]]
+	if len(ends) > 2 || !firstOk || !lastOk {
+		return nil, fmt.Errorf("'%s' is not a day like mon or a range like mon-fri", from)
+	}
+	days := make(map[time.Weekday]bool)
+	for day := first; ; day = (day + 1) % 7 {
+		days[day] = true
+		if day == last {
+			break
+		}
+	}
+	return days, nil
+}
+
+/**
+a limit on the total download speed, shared between all of the fetcher workers and the ranges that they download.
+Each read takes its size from a budget that fills up at the current limit, and waits if the budget is overdrawn.
+Up to a second's worth of unused budget is kept, so that the limit is an average rather than a hard cap on every
+read. It also counts the bytes that go through it, so that the throughput can be reported whether or not there
+is a limit.
+*/
+type bandwidthLimiter struct {
+	schedule *bandwidthSchedule
+	now      func() time.Time
+
+	mutex       sync.Mutex
+	budget      float64
+	lastUpdate  time.Time
+	transferred int64
+}
+
+func newBandwidthLimiter(schedule *bandwidthSchedule) *bandwidthLimiter {
+	return &bandwidthLimiter{schedule: schedule, now: time.Now, lastUpdate: time.Now()}
+}
+
+/**
+takes n bytes from the budget and returns how long the caller needs to wait before carrying on
+*/
+func (l *bandwidthLimiter) take(n int) time.Duration {
+	atomic.AddInt64(&l.transferred, int64(n))
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	limit := l.schedule.LimitAt(now)
+	elapsed := now.Sub(l.lastUpdate).Seconds()
+	l.lastUpdate = now
+	if limit <= 0 {
+		l.budget = 0
+		return 0
+	}
+	l.budget += elapsed * limit
+	if l.budget > limit {
+		l.budget = limit
+	}
+	l.budget -= float64(n)
+	if l.budget >= 0 {
+		return 0
+	}
+	return time.Duration(-l.budget / limit * float64(time.Second))
+}
+
+func (l *bandwidthLimiter) Wait(n int) {
+	if delay := l.take(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (l *bandwidthLimiter) Transferred() int64 {
+	return atomic.LoadInt64(&l.transferred)
+}
+
+/**
+logs the throughput achieved over each interval until stopCh is closed
+*/
+func (l *bandwidthLimiter) ReportThroughput(interval time.Duration, stopCh chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastTransferred := l.Transferred()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			transferred := l.Transferred()
+			rate := float64(transferred-lastTransferred) / interval.Seconds() / (1024 * 1024)
+			lastTransferred = transferred
+			limit := "none"
+			if current := l.schedule.LimitAt(l.now()); current > 0 {
+				limit = fmt.Sprintf("%.1fMb/s", current/(1024*1024))
+			}
+			log.Printf("INFO throughput %.1fMb/s over the last %s, limit %s, %.1fMb downloaded in total", rate, interval, limit, float64(transferred)/(1024*1024))
+		}
+	}
+}
+
+/**
+reads from an io.Reader no faster than the limiter allows
+*/
+type throttledReader struct {
+	from    io.Reader
+	limiter *bandwidthLimiter
+}
+
+/**
+reads are kept small so that a slow limit does not mean long gaps followed by bursts
+*/
+const throttledReadSize = 64 * 1024
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttledReadSize {
+		p = p[:throttledReadSize]
+	}
+	n, err := r.from.Read(p)
+	if n > 0 {
+		r.limiter.Wait(n)
+	}
+	return n, err
+}
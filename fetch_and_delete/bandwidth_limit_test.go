@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBandwidthScheduleLimitAt(t *testing.T) {
+	schedule, err := parseBandwidthSchedule("mon-fri 08:00-18:00=2, fri 18:00-08:00=0, sat-sun 00:00-00:00=10, 22:00-06:00=5", 1024*1024)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	mb := float64(1024 * 1024)
+
+	tests := []struct {
+		when     string
+		expected float64
+	}{
+		{"2021-03-01 09:30", 2 * mb},  //monday working hours
+		{"2021-03-01 18:00", 1 * mb},  //monday evening, default
+		{"2021-03-01 23:00", 5 * mb},  //monday night
+		{"2021-03-02 05:59", 5 * mb},  //tuesday early morning, still monday night
+		{"2021-03-05 23:00", 0},       //friday night
+		{"2021-03-06 07:00", 0},       //saturday early morning counts as friday night
+		{"2021-03-06 12:00", 10 * mb}, //saturday
+		{"2021-03-07 23:59", 10 * mb}, //sunday
+		{"2021-03-08 05:59", 5 * mb},  //monday early morning, sunday night
+	}
+	for _, test := range tests {
+		when, _ := time.ParseInLocation("2006-01-02 15:04", test.when, time.Local)
+		limit := schedule.LimitAt(when)
+		if limit != test.expected {
+			t.Errorf("%s (%s) gave %.0f, expected %.0f", test.when, when.Weekday(), limit, test.expected)
+		}
+	}
+}
+
+func TestParseBandwidthScheduleInvalid(t *testing.T) {
+	for _, schedule := range []string{"08:00-18:00", "08:00-18:00=fast", "weekdays 08:00-18:00=2", "8am-6pm=2", "mon-fri-sat 08:00-18:00=2", "08:00-18:00=-1"} {
+		_, err := parseBandwidthSchedule(schedule, 0)
+		if err == nil {
+			t.Errorf("expected '%s' to be rejected", schedule)
+		}
+	}
+}
+
+func TestBandwidthLimiterTake(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.Local)
+	limiter := newBandwidthLimiter(&bandwidthSchedule{Default: 1000})
+	limiter.now = func() time.Time { return now }
+	limiter.lastUpdate = now
+
+	if delay := limiter.take(500); delay != 500*time.Millisecond {
+		t.Errorf("expected to wait half a second for half a second's worth, got %s", delay)
+	}
+	now = now.Add(10 * time.Second)
+	//unused budget is only kept for a second
+	if delay := limiter.take(1000); delay != 0 {
+		t.Errorf("expected no wait after being idle, got %s", delay)
+	}
+	if delay := limiter.take(2000); delay != 2*time.Second {
+		t.Errorf("expected to wait two seconds, got %s", delay)
+	}
+	if limiter.Transferred() != 3500 {
+		t.Errorf("expected 3500 bytes transferred, got %d", limiter.Transferred())
+	}
+
+	unlimited := newBandwidthLimiter(&bandwidthSchedule{})
+	if delay := unlimited.take(1 << 30); delay != 0 {
+		t.Errorf("expected no wait without a limit, got %s", delay)
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 200*1024)
+	limiter := newBandwidthLimiter(&bandwidthSchedule{Default: 1024 * 1024})
+	startedAt := time.Now()
+	result, err := ioutil.ReadAll(&throttledReader{from: bytes.NewReader(content), limiter: limiter})
+	if err != nil || !bytes.Equal(result, content) {
+		t.Fatal("throttledReader did not pass the content through: ", err)
+	}
+	//the first second's worth is allowed straight away once the budget has filled, so this only checks it is not skipped
+	if limiter.Transferred() != int64(len(content)) {
+		t.Errorf("expected %d bytes to be counted, got %d", len(content), limiter.Transferred())
+	}
+	if time.Since(startedAt) > 2*time.Second {
+		t.Errorf("reading 200k at 1Mb/s took %s", time.Since(startedAt))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"log"
+	"path"
+	"strings"
+)
+
+/**
+what to do when there is already a file at the local path that is not a copy of the object being downloaded
+*/
+type ConflictPolicy string
+
+const (
+	//leave the existing file alone and don't fetch or delete the object
+	ConflictSkip ConflictPolicy = "skip"
+	//replace the existing file with the object
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	//download the object alongside the existing file, as "name-1.ext", "name-2.ext" and so on
+	ConflictRename ConflictPolicy = "rename"
+	//the same as rename, which also only takes an existing file to be a copy if its content matches the ETag
+	ConflictCompare ConflictPolicy = "compare"
+	//as rename, but an existing file of the right size that can't be checked against the ETag, e.g. because the
+	//object is KMS-encrypted, is taken to be a copy of the object
+	ConflictTrustSize ConflictPolicy = "trust-size"
+)
+
+func ParseConflictPolicy(from string) (ConflictPolicy, error) {
+	for _, policy := range []ConflictPolicy{ConflictSkip, ConflictOverwrite, ConflictRename, ConflictCompare, ConflictTrustSize} {
+		if strings.EqualFold(from, string(policy)) {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' is not a conflict policy, expected skip, overwrite, rename, compare or trust-size", from)
+}
+
+/**
+returned by performDownload if there is a conflicting file at the local path and the policy is ConflictSkip
+*/
+var LocalConflictSkipped = errors.New("a different file already exists at the local path")
+
+/**
+stops a rename from going on forever if something keeps creating files
+*/
+const maxConflictRenames = 1000
+
+func openConflictLog(filename string) (*csvLog, error) {
+	return openCsvLog(filename, []string{"Local path", "Bucket", "Key", "Reason", "Resolution", "Downloaded to"})
+}
+
+/**
+what is at a local path, as far as a particular object is concerned
+*/
+type existingFile struct {
+	Exists bool
+	//true if the file is a copy of the object, in which case Verification says how sure we are
+	IsCopy       bool
+	Verification string
+	//why the file is not a copy of the object
+	Reason string
+}
+
+/**
+works out whether the file at localPath, if there is one, is a copy of the object. A file of a different size, or
+one that does not match the ETag, is not. One that is the right size but can't be checked against the ETag is only
+taken to be a copy if the policy is ConflictTrustSize, since it could be anything that happens to be the same size,
+such as a file that was renamed to "name-1.ext" for a different object.
+*/
+func checkExistingFile(localPath string, size int64, etag string, canVerify bool, options DownloadOptions) (existingFile, error) {
+	localLength, doesExist, statErr := localFileSize(localPath)
+	if statErr != nil || !doesExist {
+		return existingFile{}, statErr
+	}
+	if localLength != size {
+		return existingFile{Exists: true, Reason: fmt.Sprintf("local file is %d bytes but the object is %d", localLength, size)}, nil
+	}
+
+	log.Printf("INFO performDownload local file %s already exists with the right file size, checking it", localPath)
+	verification := models.VerificationUnverifiable
+	if canVerify {
+		var verifyErr error
+		verification, verifyErr = verifyLocalFile(localPath, etag, size, options.EtagPartSizes)
+		if verifyErr != nil {
+			return existingFile{}, verifyErr
+		}
+	}
+	switch {
+	case verification == models.VerificationFailed:
+		return existingFile{Exists: true, Reason: "local file does not match the object's ETag"}, nil
+	case verification == models.VerificationUnverifiable && options.OnConflict != ConflictTrustSize:
+		return existingFile{Exists: true, Reason: "local file is the same size but can't be checked against the object's ETag"}, nil
+	default:
+		return existingFile{Exists: true, IsCopy: true, Verification: verification}, nil
+	}
+}
+
+/**
+returns toFile with a counter added before the extension, e.g. "clip-2.mxf"
+*/
+func numberedFilename(toFile string, counter int) string {
+	ext := path.Ext(toFile)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(toFile, ext), counter, ext)
+}
+
+/**
+decides where to download an object that should go to toFile. Returns the path to use, and if there is already a
+copy of the object there then its verification status, or models.VerificationNone if it needs to be downloaded.
+Every conflict is logged and recorded in options.Conflicts along with how it was resolved.
+*/
+func resolveLocalPath(bucket string, key string, toFile string, size int64, etag string, canVerify bool, options DownloadOptions) (string, string, error) {
+	existing, checkErr := checkExistingFile(toFile, size, etag, canVerify, options)
+	if checkErr != nil {
+		return "", models.VerificationNone, checkErr
+	}
+	if !existing.Exists {
+		return toFile, models.VerificationNone, nil
+	}
+	if existing.IsCopy {
+		return toFile, existing.Verification, nil
+	}
+
+	reason := existing.Reason
+	recordConflict := func(resolution string, downloadedTo string) {
+		log.Printf("WARNING performDownload conflict at %s for %s:%s, %s: %s", toFile, bucket, key, reason, resolution)
+		options.Conflicts.Record(toFile, bucket, key, reason, resolution, downloadedTo)
+	}
+
+	switch options.OnConflict {
+	case ConflictSkip:
+		recordConflict("skipped, the object will not be fetched or deleted", "")
+		return "", models.VerificationNone, LocalConflictSkipped
+	case ConflictOverwrite:
+		recordConflict("overwritten", toFile)
+		return toFile, models.VerificationNone, nil
+	}
+
+	for counter := 1; counter <= maxConflictRenames; counter++ {
+		candidate := numberedFilename(toFile, counter)
+		existing, checkErr = checkExistingFile(candidate, size, etag, canVerify, options)
+		if checkErr != nil {
+			return "", models.VerificationNone, checkErr
+		}
+		if !existing.Exists {
+			recordConflict("renamed", candidate)
+			return candidate, models.VerificationNone, nil
+		}
+		if existing.IsCopy {
+			recordConflict("already downloaded under another name", candidate)
+			return candidate, existing.Verification, nil
+		}
+	}
+	recordConflict("skipped, there are too many files with the same name", "")
+	return "", models.VerificationNone, LocalConflictSkipped
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestNumberedFilename(t *testing.T) {
+	tests := map[string]string{
+		"media/clip.mxf":       "media/clip-2.mxf",
+		"media/noextension":    "media/noextension-2",
+		"media/archive.tar.gz": "media/archive.tar-2.gz",
+	}
+	for from, expected := range tests {
+		if result := numberedFilename(from, 2); result != expected {
+			t.Errorf("%s gave %s, expected %s", from, result, expected)
+		}
+	}
+}
+
+func TestResolveLocalPath(t *testing.T) {
+	content := []byte("the object's content")
+	digest := md5.Sum(content)
+	etag := `"` + hex.EncodeToString(digest[:]) + `"`
+	size := int64(len(content))
+
+	tests := []struct {
+		name                 string
+		policy               ConflictPolicy
+		canVerify            bool
+		existing             map[string]string
+		expectedPath         string
+		expectedVerification string
+		expectedErr          error
+		expectedResolution   string
+	}{
+		{"no existing file", ConflictRename, true, map[string]string{}, "clip.mxf", models.VerificationNone, nil, ""},
+		{"existing copy", ConflictSkip, true, map[string]string{"clip.mxf": string(content)}, "clip.mxf", models.VerifiedEtag, nil, ""},
+		{"different size, skip", ConflictSkip, true, map[string]string{"clip.mxf": "other"}, "", models.VerificationNone, LocalConflictSkipped, "skipped"},
+		{"different size, overwrite", ConflictOverwrite, true, map[string]string{"clip.mxf": "other"}, "clip.mxf", models.VerificationNone, nil, "overwritten"},
+		{"different size, rename", ConflictRename, true, map[string]string{"clip.mxf": "other", "clip-1.mxf": "another"}, "clip-2.mxf", models.VerificationNone, nil, "renamed"},
+		{"different size, renamed copy", ConflictRename, true, map[string]string{"clip.mxf": "other", "clip-1.mxf": string(content)}, "clip-1.mxf", models.VerifiedEtag, nil, "already downloaded under another name"},
+		{"same size, wrong content", ConflictRename, true, map[string]string{"clip.mxf": strings.Repeat("x", len(content))}, "clip-1.mxf", models.VerificationNone, nil, "renamed"},
+		{"same size, unverifiable, rename", ConflictRename, false, map[string]string{"clip.mxf": strings.Repeat("x", len(content))}, "clip-1.mxf", models.VerificationNone, nil, "renamed"},
+		{"same size, unverifiable, skip", ConflictSkip, false, map[string]string{"clip.mxf": strings.Repeat("x", len(content))}, "", models.VerificationNone, LocalConflictSkipped, "skipped"},
+		{"same size, unverifiable, trust-size", ConflictTrustSize, false, map[string]string{"clip.mxf": strings.Repeat("x", len(content))}, "clip.mxf", models.VerificationUnverifiable, nil, ""},
+		{"same size, unverifiable, renamed lookalike", ConflictRename, false, map[string]string{"clip.mxf": "other", "clip-1.mxf": strings.Repeat("x", len(content))}, "clip-2.mxf", models.VerificationNone, nil, "renamed"},
+		{"same size, unverifiable, compare", ConflictCompare, false, map[string]string{"clip.mxf": strings.Repeat("x", len(content))}, "clip-1.mxf", models.VerificationNone, nil, "renamed"},
+	}
+
+	for _, test := range tests {
+		tempDir, _ := ioutil.TempDir("", "conflict-policy-test")
+		for name, fileContent := range test.existing {
+			ioutil.WriteFile(path.Join(tempDir, name), []byte(fileContent), 0644)
+		}
+		conflicts, _ := openConflictLog(path.Join(tempDir, "conflicts.csv"))
+		options := DownloadOptions{OnConflict: test.policy, Conflicts: conflicts}
+
+		resultPath, verification, err := resolveLocalPath("bucket", "clip.mxf", path.Join(tempDir, "clip.mxf"), size, etag, test.canVerify, options)
+		conflicts.Close()
+		expectedPath := ""
+		if test.expectedPath != "" {
+			expectedPath = path.Join(tempDir, test.expectedPath)
+		}
+		if resultPath != expectedPath || verification != test.expectedVerification || err != test.expectedErr {
+			t.Errorf("%s: got %s %s %v, expected %s %s %v", test.name, resultPath, verification, err, expectedPath, test.expectedVerification, test.expectedErr)
+		}
+
+		logged, _ := ioutil.ReadFile(path.Join(tempDir, "conflicts.csv"))
+		lines := strings.Split(strings.TrimSpace(string(logged)), "\n")
+		if test.expectedResolution == "" && len(lines) != 1 {
+			t.Errorf("%s: expected no conflict to be recorded, got %q", test.name, logged)
+		} else if test.expectedResolution != "" && (len(lines) != 2 || !strings.Contains(lines[1], test.expectedResolution)) {
+			t.Errorf("%s: expected a conflict resolved as '%s' to be recorded, got %q", test.name, test.expectedResolution, logged)
+		}
+		os.RemoveAll(tempDir)
+	}
+}
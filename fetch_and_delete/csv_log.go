@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"os"
+	"path"
+	"sync"
+)
+
+/**
+a CSV file that the fetcher workers add rows to as they go. It is appended to on every run, and each row is flushed
+as it is written so that it survives the run being stopped. Recording to a nil csvLog does nothing.
+*/
+type csvLog struct {
+	mutex    sync.Mutex
+	filename string
+	file     *os.File
+	writer   *csv.Writer
+}
+
+func openCsvLog(filename string, header []string) (*csvLog, error) {
+	dirErr := os.MkdirAll(path.Dir(filename), 0755)
+	if dirErr != nil {
+		return nil, dirErr
+	}
+	file, openErr := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if openErr != nil {
+		return nil, openErr
+	}
+	opened := &csvLog{filename: filename, file: file, writer: csv.NewWriter(file)}
+
+	info, statErr := file.Stat()
+	if statErr == nil && info.Size() == 0 {
+		opened.writer.Write(header)
+		opened.writer.Flush()
+	}
+	return opened, nil
+}
+
+func (l *csvLog) Record(row ...string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.writer.Write(row)
+	l.writer.Flush()
+	if flushErr := l.writer.Error(); flushErr != nil {
+		log.Printf("ERROR csvLog could not write %v to %s: %s", row, l.filename, flushErr)
+	}
+}
+
+func (l *csvLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.writer.Flush()
+	return l.file.Close()
+}
@@ -6,8 +6,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/guardian/multimedia-holding-pen-utils/models"
 	"log"
-	"net/url"
-	"strings"
 	"sync"
 	"time"
 )
@@ -24,7 +22,7 @@ func requestDelete(s3Client *s3.Client, bucket string, key string, timeout time.
 }
 
 func deleterThread(s3Client *s3.Client, inputCh chan *models.FoundEntry,
-	errCh chan error, reallyDelete bool, waitGroup *sync.WaitGroup) {
+	errCh chan error, reallyDelete bool, requireVerified bool, waitGroup *sync.WaitGroup) {
 
 	defer waitGroup.Done()
 
@@ -38,34 +36,70 @@ func deleterThread(s3Client *s3.Client, inputCh chan *models.FoundEntry,
 		if entry.Bucket == "" || entry.Path == "" {
 			continue
 		}
-		keyToUse := entry.Path
-		if strings.HasPrefix(keyToUse, "/") {
-			keyToUse = keyToUse[1:]
+		deleted, deleteErr := deleteEntry(s3Client, entry, reallyDelete, requireVerified)
+		if deleteErr != nil {
+			errCh <- deleteErr
+			return
 		}
-
-		if strings.Contains(keyToUse, "%2F") {
-			decodedPath, decodeErr := url.QueryUnescape(entry.Path)
-			if decodeErr != nil {
-				log.Printf("WARNING deleterThread could not unescape incoming path '%s': %s", entry.Path, decodeErr)
-				continue
+		if !deleted {
+			if len(entry.Dependents) > 0 {
+				log.Printf("WARNING deleterThread not deleting the %d proxies of %s on %s either", len(entry.Dependents), entry.Path, entry.Bucket)
 			}
-			keyToUse = decodedPath
+			continue
 		}
-		log.Printf("INFO deleterThread request to delete %s on %s", keyToUse, entry.Bucket)
-		if reallyDelete {
-			_, deleteErr := requestDelete(s3Client, entry.Bucket, keyToUse, 3*time.Second)
+		for _, dependent := range entry.Dependents {
+			_, deleteErr = deleteEntry(s3Client, dependent, reallyDelete, requireVerified)
 			if deleteErr != nil {
-				log.Printf("ERROR deleteThread could not delete %s:%s - %s", entry.Bucket, keyToUse, deleteErr)
 				errCh <- deleteErr
 				return
 			}
-		} else {
-			log.Print("INFO deleterThread not performing deletions unless --really-delete option is set")
 		}
 	}
 }
 
-func AsyncEntryDeleter(s3Client *s3.Client, inputCh chan *models.FoundEntry, threads int, reallyDelete bool) chan error {
+/**
+deletes a single entry, unless its local copy failed verification or requireVerified is set and it has not been
+verified. Returns true if the entry was deleted, or would have been if reallyDelete was set
+*/
+func deleteEntry(s3Client *s3.Client, entry *models.FoundEntry, reallyDelete bool, requireVerified bool) (bool, error) {
+	keyToUse := entry.Path
+	if entry.Verification == models.VerificationFailed {
+		log.Printf("ERROR deleterThread refusing to delete %s on %s, the local copy does not match it", keyToUse, entry.Bucket)
+		return false, nil
+	}
+	if requireVerified && !entry.IsVerified() {
+		log.Printf("WARNING deleterThread refusing to delete %s on %s, the local copy has not been verified (%s)", keyToUse, entry.Bucket, verificationDescription(entry.Verification))
+		return false, nil
+	}
+	log.Printf("INFO deleterThread request to delete %s on %s (%d bytes)", keyToUse, entry.Bucket, entry.Size)
+	if reallyDelete {
+		_, deleteErr := requestDelete(s3Client, entry.Bucket, keyToUse, 3*time.Second)
+		if deleteErr != nil {
+			log.Printf("ERROR deleteThread could not delete %s:%s - %s", entry.Bucket, keyToUse, deleteErr)
+			return false, deleteErr
+		}
+	} else {
+		log.Print("INFO deleterThread not performing deletions unless --really-delete option is set")
+	}
+	return true, nil
+}
+
+/**
+describes a verification status for the logs
+*/
+func verificationDescription(verification string) string {
+	if verification == models.VerificationNone {
+		return "not checked"
+	}
+	return verification
+}
+
+/**
+deletes each entry that comes in. If requireVerified is set then only entries whose local copy has been checked
+against S3 are deleted; entries whose local copy failed the check are never deleted. The dependents of an entry
+are only deleted if the entry itself is
+*/
+func AsyncEntryDeleter(s3Client *s3.Client, inputCh chan *models.FoundEntry, threads int, reallyDelete bool, requireVerified bool) chan error {
 	modifiedInputCh := make(chan *models.FoundEntry, 100)
 	errCh := make(chan error, 1)
 	waitGroup := &sync.WaitGroup{}
@@ -91,7 +125,7 @@ func AsyncEntryDeleter(s3Client *s3.Client, inputCh chan *models.FoundEntry, thr
 	}()
 
 	for i := 0; i < threads; i++ {
-		go deleterThread(s3Client, modifiedInputCh, errCh, reallyDelete, waitGroup)
+		go deleterThread(s3Client, modifiedInputCh, errCh, reallyDelete, requireVerified, waitGroup)
 		waitGroup.Add(1)
 	}
 	return errCh
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeleterRefusesFailedVerification(t *testing.T) {
+	object := &fakeObject{}
+	server := httptest.NewServer(object)
+	defer server.Close()
+
+	inputCh := make(chan *models.FoundEntry, 10)
+	inputCh <- &models.FoundEntry{Bucket: "bucket", Path: "failed.mxf", Verification: models.VerificationFailed}
+	inputCh <- &models.FoundEntry{Bucket: "bucket", Path: "unverifiable.mxf", Verification: models.VerificationUnverifiable}
+	inputCh <- &models.FoundEntry{Bucket: "bucket", Path: "unchecked.mxf"}
+	inputCh <- nil
+
+	select {
+	case err := <-AsyncEntryDeleter(newFakeS3Client(server), inputCh, 1, true, false):
+		if err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the deleter")
+	}
+	if object.Deletes() != 2 {
+		t.Errorf("expected only the unverifiable and unchecked entries to be deleted, got %d deletions", object.Deletes())
+	}
+}
+
+func TestDeleterOnlyDeletesProxiesWithTheirOriginal(t *testing.T) {
+	object := &fakeObject{}
+	server := httptest.NewServer(object)
+	defer server.Close()
+
+	makeOriginal := func(name string, verification string) *models.FoundEntry {
+		return &models.FoundEntry{Bucket: "holding-pen", Path: name + ".mxf", Verification: verification, Dependents: []*models.FoundEntry{
+			{Bucket: "proxies", Path: name + ".mp4", IsProxy: true, Verification: models.VerifiedEtag},
+		}}
+	}
+	inputCh := make(chan *models.FoundEntry, 10)
+	inputCh <- makeOriginal("verified", models.VerifiedEtag)
+	inputCh <- makeOriginal("unverifiable", models.VerificationUnverifiable)
+	inputCh <- nil
+
+	select {
+	case err := <-AsyncEntryDeleter(newFakeS3Client(server), inputCh, 1, true, true):
+		if err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the deleter")
+	}
+	if object.Deletes() != 2 {
+		t.Errorf("expected only verified.mxf and its proxy to be deleted, got %d deletions", object.Deletes())
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+/**
+returned by the fetcher when it has waited as long as it is allowed to for disk space and there is still not enough
+to carry on
+*/
+var InsufficientDiskSpace = errors.New("not enough free disk space to continue downloading")
+
+/**
+stops the fetcher from filling up the download volume. Once a download knows from S3 how big the object is, it
+claims whatever is not already in its ".part" file from the space that is free beyond the reserve; if there is not
+enough then it pauses until there is. While other downloads are in progress a worker waits for them, since they may
+free up space when they finish and get moved off by whatever is picking them up. Once nothing is downloading, it
+only waits up to maxWait for space to appear before giving up with InsufficientDiskSpace.
+Space claimed by downloads that are in progress is counted as used even though some of it is already on disk, so
+the guard errs on the side of caution.
+*/
+type diskSpaceGuard struct {
+	dir          string
+	reserve      int64
+	maxWait      time.Duration
+	pollInterval time.Duration
+	freeSpace    func(dir string) (int64, error)
+
+	mutex    sync.Mutex
+	inFlight int64
+}
+
+func newDiskSpaceGuard(dir string, reserve int64, maxWait time.Duration) *diskSpaceGuard {
+	return &diskSpaceGuard{
+		dir:          dir,
+		reserve:      reserve,
+		maxWait:      maxWait,
+		pollInterval: 10 * time.Second,
+		freeSpace:    freeDiskSpace,
+	}
+}
+
+/**
+blocks until there is room for a download of the given size and claims it. The claim must be given back with
+Release once the download is finished, whether it worked or not.
+*/
+func (g *diskSpaceGuard) Acquire(size int64, description string) error {
+	var stalledSince time.Time
+	paused := false
+	for {
+		g.mutex.Lock()
+		free, freeErr := g.freeSpace(g.dir)
+		if freeErr != nil {
+			g.mutex.Unlock()
+			return freeErr
+		}
+		available := free - g.inFlight - g.reserve
+		if size <= available {
+			g.inFlight += size
+			g.mutex.Unlock()
+			if paused {
+				log.Printf("INFO diskSpaceGuard enough space has been freed, resuming with %s", description)
+			}
+			return nil
+		}
+		othersInFlight := g.inFlight > 0
+		g.mutex.Unlock()
+
+		if !paused {
+			log.Printf("WARNING diskSpaceGuard %s needs %d bytes but only %d are free beyond the reserve of %d in %s, pausing until space is freed", description, size, available, g.reserve, g.dir)
+			paused = true
+		}
+		if othersInFlight {
+			stalledSince = time.Time{}
+		} else if stalledSince.IsZero() {
+			stalledSince = time.Now()
+		} else if time.Since(stalledSince) >= g.maxWait {
+			log.Printf("ERROR diskSpaceGuard waited %s for space for %s with nothing else downloading, giving up. %s needs %d bytes free beyond the reserve of %d", g.maxWait, description, g.dir, size, g.reserve)
+			return InsufficientDiskSpace
+		}
+		time.Sleep(g.pollInterval)
+	}
+}
+
+func (g *diskSpaceGuard) Release(size int64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.inFlight -= size
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeVolume struct {
+	mutex sync.Mutex
+	free  int64
+}
+
+func (v *fakeVolume) freeSpace(dir string) (int64, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.free, nil
+}
+
+func (v *fakeVolume) setFree(free int64) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.free = free
+}
+
+func newTestGuard(volume *fakeVolume, reserve int64, maxWait time.Duration) *diskSpaceGuard {
+	guard := newDiskSpaceGuard("/data", reserve, maxWait)
+	guard.freeSpace = volume.freeSpace
+	guard.pollInterval = time.Millisecond
+	return guard
+}
+
+func TestDiskSpaceGuardCountsDownloadsInProgress(t *testing.T) {
+	volume := &fakeVolume{free: 1000}
+	guard := newTestGuard(volume, 100, time.Hour)
+
+	if err := guard.Acquire(500, "first"); err != nil {
+		t.Fatal("first download should have had room: ", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- guard.Acquire(500, "second")
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second download should have waited, only 400 bytes are left beyond the reserve")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	guard.Release(500)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Error("second download failed after space was released: ", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("second download did not resume after space was released")
+	}
+}
+
+func TestDiskSpaceGuardResumesWhenSpaceIsFreed(t *testing.T) {
+	volume := &fakeVolume{free: 200}
+	guard := newTestGuard(volume, 100, time.Hour)
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- guard.Acquire(500, "big file")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	volume.setFree(700)
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Error("download failed after space was freed: ", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("download did not resume after space was freed")
+	}
+}
+
+func TestDiskSpaceGuardGivesUp(t *testing.T) {
+	volume := &fakeVolume{free: 200}
+	guard := newTestGuard(volume, 100, 20*time.Millisecond)
+
+	err := guard.Acquire(500, "big file")
+	if err != InsufficientDiskSpace {
+		t.Errorf("expected InsufficientDiskSpace, got %v", err)
+	}
+}
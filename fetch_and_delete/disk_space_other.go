@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "errors"
+
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, errors.New("checking free disk space is not supported on this platform, use -min-free-space -1 to download without checking")
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import "syscall"
+
+/**
+returns the number of bytes available to us on the filesystem that holds dir
+*/
+func freeDiskSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	statErr := syscall.Statfs(dir, &stat)
+	if statErr != nil {
+		return 0, statErr
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
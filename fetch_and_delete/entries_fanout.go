@@ -3,13 +3,16 @@ package main
 import (
 	"github.com/guardian/multimedia-holding-pen-utils/models"
 	"log"
-	"net/url"
 )
 
 /**
-for each record coming in, emits a models.FoundEntry for the original file and each identified proxy
+for each record coming in, emits a models.FoundEntry for the original file with one for each identified proxy in its
+Dependents, so that the proxies are only fetched and deleted if the original is.
+proxies that were flagged as invalid in the report are skipped unless includeInvalidProxies is set.
+records with no archive copy are skipped altogether; the readers should never pass them on, but if one did then
+the original would be deleted without being archived anywhere
 */
-func AsyncEntryFanout(inputCh chan *models.LookupResult, rootBucket string) (chan *models.FoundEntry, chan error) {
+func AsyncEntryFanout(inputCh chan *models.LookupResult, rootBucket string, includeInvalidProxies bool) (chan *models.FoundEntry, chan error) {
 	outputCh := make(chan *models.FoundEntry, 100)
 	errCh := make(chan error, 1)
 
@@ -22,19 +25,30 @@ func AsyncEntryFanout(inputCh chan *models.LookupResult, rootBucket string) (cha
 				return
 			}
 
+			if rec.Count == 0 {
+				log.Printf("WARNING AsyncEntryFanout %s has no archive copies, not fetching or deleting it or its proxies", rec.RequestedFile)
+				continue
+			}
+
 			rootEntry := models.FoundEntry{
-				Bucket: rootBucket,
-				Path:   url.QueryEscape(rec.RequestedFile),
-				Size:   rec.RequestedFileSize,
+				Bucket:       rootBucket,
+				Path:         rec.RequestedFile,
+				Size:         rec.RequestedFileSize,
+				StorageClass: rec.RequestedFileStorageClass,
+				LastModified: rec.RequestedFileLastModified,
 			}
-			outputCh <- &rootEntry
 			if len(rec.Proxies) > 3 {
 				log.Printf("WARNING AsyncEntryFanout %s has %d proxies which is suspiciously large, ignoring them", rec.RequestedFile, len(rec.Proxies))
 			}
 			for _, prox := range rec.Proxies {
+				if prox.Invalid && !includeInvalidProxies {
+					log.Printf("WARNING AsyncEntryFanout %s was flagged as an invalid proxy, not deleting it", prox.MustUri())
+					continue
+				}
 				copiedEntry := prox
-				outputCh <- &copiedEntry //never directly take the address of an iterator!
+				rootEntry.Dependents = append(rootEntry.Dependents, &copiedEntry) //never directly take the address of an iterator!
 			}
+			outputCh <- &rootEntry
 		}
 	}()
 	return outputCh, errCh
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"testing"
+)
+
+func TestAsyncEntryFanoutSkipsUnarchived(t *testing.T) {
+	inputCh := make(chan *models.LookupResult, 10)
+	inputCh <- &models.LookupResult{
+		RequestedFile: "unarchived.mxf",
+		Count:         0,
+		Proxies:       []models.FoundEntry{{Bucket: "proxies", Path: "unarchived.mp4", IsProxy: true}},
+	}
+	inputCh <- &models.LookupResult{
+		RequestedFile: "archived.mxf",
+		Count:         1,
+		Proxies:       []models.FoundEntry{{Bucket: "proxies", Path: "archived.mp4", IsProxy: true}},
+	}
+	inputCh <- nil
+
+	outputCh, _ := AsyncEntryFanout(inputCh, "holding-pen", false)
+	entries := make([]*models.FoundEntry, 0)
+	for entry := <-outputCh; entry != nil; entry = <-outputCh {
+		entries = append(entries, entry)
+	}
+	if len(entries) != 1 || entries[0].Path != "archived.mxf" || len(entries[0].Dependents) != 1 || entries[0].Dependents[0].Path != "archived.mp4" {
+		t.Errorf("expected only the archived file with its proxy, got %v", entries)
+	}
+}
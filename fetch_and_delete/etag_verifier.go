@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/**
+the ETag of an object that was uploaded in one go is the MD5 of its content. An object that was uploaded in parts
+has an ETag of the MD5 of the concatenated MD5s of each part, followed by "-" and the number of parts; to check
+that we need to know the part size that the uploader used. It is not recorded anywhere, so we try the sizes that
+common tools use along with the one implied by the part count.
+Objects encrypted with KMS keys have ETags that are not MD5s at all, so they can't be checked this way. The
+version of the SDK that we use does not expose S3's additional checksums, so the ETag is all we have.
+*/
+type etagParts struct {
+	md5Hex    string
+	partCount int
+}
+
+/**
+splits an ETag into its hash and part count. partCount is 0 for an object that was uploaded in one go
+*/
+func parseEtag(etag string) (etagParts, error) {
+	unquoted := strings.Trim(etag, `"`)
+	segments := strings.SplitN(unquoted, "-", 2)
+	if len(segments[0]) != md5.Size*2 {
+		return etagParts{}, fmt.Errorf("'%s' is not an MD5-based ETag", etag)
+	}
+	if len(segments) == 1 {
+		return etagParts{md5Hex: segments[0]}, nil
+	}
+	partCount, parseErr := strconv.Atoi(segments[1])
+	if parseErr != nil || partCount < 1 {
+		return etagParts{}, fmt.Errorf("'%s' has an invalid part count", etag)
+	}
+	return etagParts{md5Hex: segments[0], partCount: partCount}, nil
+}
+
+/**
+works out which upload part sizes could have produced the given number of parts for an object of the given size,
+from the configured candidates plus the size implied by the part count rounded up to a whole megabyte
+*/
+func candidatePartSizes(size int64, partCount int, configured []int64) []int64 {
+	const mb = 1024 * 1024
+	implied := (size + int64(partCount) - 1) / int64(partCount)
+	implied = ((implied + mb - 1) / mb) * mb
+
+	candidates := make([]int64, 0, len(configured)+1)
+	seen := make(map[int64]bool)
+	for _, partSize := range append([]int64{implied}, configured...) {
+		if partSize <= 0 || seen[partSize] {
+			continue
+		}
+		seen[partSize] = true
+		if (size+partSize-1)/partSize == int64(partCount) {
+			candidates = append(candidates, partSize)
+		}
+	}
+	return candidates
+}
+
+/**
+works out the MD5 for a given upload part size as data is written to it
+*/
+type multipartHasher struct {
+	partSize    int64
+	current     hash.Hash
+	currentSize int64
+	digests     []byte
+	parts       int
+}
+
+func (h *multipartHasher) Write(p []byte) {
+	for len(p) > 0 {
+		toWrite := h.partSize - h.currentSize
+		if int64(len(p)) < toWrite {
+			toWrite = int64(len(p))
+		}
+		h.current.Write(p[:toWrite])
+		h.currentSize += toWrite
+		p = p[toWrite:]
+		if h.currentSize == h.partSize {
+			h.finishPart()
+		}
+	}
+}
+
+func (h *multipartHasher) finishPart() {
+	h.digests = append(h.digests, h.current.Sum(nil)...)
+	h.parts++
+	h.current.Reset()
+	h.currentSize = 0
+}
+
+func (h *multipartHasher) Etag() string {
+	if h.currentSize > 0 {
+		h.finishPart()
+	}
+	combined := md5.Sum(h.digests)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(combined[:]), h.parts)
+}
+
+/**
+an io.Writer that hashes an object's content as it goes past, so that it can be checked against the ETag. It is
+given the data in order, either as it is downloaded or by reading the finished file back.
+*/
+type etagHasher struct {
+	expected  etagParts
+	whole     hash.Hash
+	multipart []*multipartHasher
+}
+
+func newEtagHasher(etag string, size int64, configuredPartSizes []int64) (*etagHasher, error) {
+	expected, parseErr := parseEtag(etag)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	hasher := &etagHasher{expected: expected}
+	if expected.partCount == 0 {
+		hasher.whole = md5.New()
+		return hasher, nil
+	}
+	for _, partSize := range candidatePartSizes(size, expected.partCount, configuredPartSizes) {
+		hasher.multipart = append(hasher.multipart, &multipartHasher{partSize: partSize, current: md5.New()})
+	}
+	return hasher, nil
+}
+
+func (h *etagHasher) Write(p []byte) (int, error) {
+	if h.whole != nil {
+		h.whole.Write(p)
+	}
+	for _, partHasher := range h.multipart {
+		partHasher.Write(p)
+	}
+	return len(p), nil
+}
+
+/**
+returns the verification status for everything that has been written. A mismatch against a single-part ETag
+means the data is wrong; if no candidate part size matches a multipart ETag then we can't tell whether the data or
+our guess at the part size was wrong, so the result is only unverifiable.
+*/
+func (h *etagHasher) Result() string {
+	if h.whole != nil {
+		if hex.EncodeToString(h.whole.Sum(nil)) == h.expected.md5Hex {
+			return models.VerifiedEtag
+		}
+		return models.VerificationFailed
+	}
+	expectedEtag := fmt.Sprintf("%s-%d", h.expected.md5Hex, h.expected.partCount)
+	for _, partHasher := range h.multipart {
+		if partHasher.Etag() == expectedEtag {
+			return models.VerifiedMultipartEtag
+		}
+	}
+	return models.VerificationUnverifiable
+}
+
+/**
+hashes a local file from start to finish and checks it against the ETag
+*/
+func verifyLocalFile(localPath string, etag string, size int64, configuredPartSizes []int64) (string, error) {
+	hasher, hasherErr := newEtagHasher(etag, size, configuredPartSizes)
+	if hasherErr != nil {
+		return models.VerificationUnverifiable, nil
+	}
+	file, openErr := os.Open(localPath)
+	if openErr != nil {
+		return models.VerificationNone, openErr
+	}
+	defer file.Close()
+
+	_, copyErr := io.Copy(hasher, file)
+	if copyErr != nil {
+		return models.VerificationNone, copyErr
+	}
+	return hasher.Result(), nil
+}
+
+/**
+parses a comma-separated list of sizes in megabytes into bytes
+*/
+func parseMegabyteList(from string) ([]int64, error) {
+	sizes := make([]int64, 0)
+	for _, part := range strings.Split(from, ",") {
+		trimmed := strings.TrimSpace(part)
+		if trimmed == "" {
+			continue
+		}
+		megabytes, parseErr := strconv.ParseInt(trimmed, 10, 64)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		sizes = append(sizes, megabytes*1024*1024)
+	}
+	return sizes, nil
+}
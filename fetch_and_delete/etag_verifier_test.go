@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"testing"
+)
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestEtagHasherSinglePart(t *testing.T) {
+	content := []byte("some media content")
+	etag := `"` + md5Hex(content) + `"`
+
+	hasher, err := newEtagHasher(etag, int64(len(content)), nil)
+	if err != nil {
+		t.Fatal("could not create hasher: ", err)
+	}
+	hasher.Write(content[:5])
+	hasher.Write(content[5:])
+	if result := hasher.Result(); result != models.VerifiedEtag {
+		t.Errorf("expected %s, got %s", models.VerifiedEtag, result)
+	}
+
+	corrupt, _ := newEtagHasher(etag, int64(len(content)), nil)
+	corrupt.Write([]byte("some media c0ntent"))
+	if result := corrupt.Result(); result != models.VerificationFailed {
+		t.Errorf("expected %s, got %s", models.VerificationFailed, result)
+	}
+}
+
+func TestEtagHasherMultipart(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxy")
+	partSize := 10
+	digests := make([]byte, 0)
+	for start := 0; start < len(content); start += partSize {
+		end := start + partSize
+		if end > len(content) {
+			end = len(content)
+		}
+		sum := md5.Sum(content[start:end])
+		digests = append(digests, sum[:]...)
+	}
+	etag := fmt.Sprintf(`"%s-4"`, md5Hex(digests))
+
+	hasher, err := newEtagHasher(etag, int64(len(content)), []int64{7, 9, 10, 12})
+	if err != nil {
+		t.Fatal("could not create hasher: ", err)
+	}
+	if len(hasher.multipart) != 2 {
+		t.Errorf("expected only the part sizes giving 4 parts to be tried, got %d", len(hasher.multipart))
+	}
+	//write in chunks that don't line up with the parts
+	hasher.Write(content[:3])
+	hasher.Write(content[3:23])
+	hasher.Write(content[23:])
+	if result := hasher.Result(); result != models.VerifiedMultipartEtag {
+		t.Errorf("expected %s, got %s", models.VerifiedMultipartEtag, result)
+	}
+
+	wrongGuess, _ := newEtagHasher(etag, int64(len(content)), []int64{9})
+	wrongGuess.Write(content)
+	if result := wrongGuess.Result(); result != models.VerificationUnverifiable {
+		t.Errorf("expected %s, got %s", models.VerificationUnverifiable, result)
+	}
+}
+
+func TestParseEtag(t *testing.T) {
+	if _, err := parseEtag(`"not-an-md5"`); err == nil {
+		t.Error("expected an error for a non-MD5 ETag")
+	}
+	parsed, err := parseEtag(`"d41d8cd98f00b204e9800998ecf8427e-12"`)
+	if err != nil || parsed.partCount != 12 || parsed.md5Hex != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Errorf("got incorrect result %v (%v)", parsed, err)
+	}
+}
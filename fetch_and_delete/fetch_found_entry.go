@@ -6,15 +6,16 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/guardian/multimedia-holding-pen-utils/models"
 	"io"
 	"log"
 	"math"
-	"net/url"
 	"os"
 	"path"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /**
@@ -43,64 +44,313 @@ func createLocalDir(forPath string) error {
 }
 
 /**
-performs a download of the given s3 object to the local filepath. Returns the number of bytes downloaded or an error.
-if a file already exists that is the _same_ size as the remote target, then the return value is the same as if the
-file had been downloaded.  if a file already exists that is _not_ the same size then an error is returned.
+returned by performDownload if the object in S3 is not the size that the report said it was
 */
-func performDownload(s3Client *s3.Client, bucket string, key string, toFile string) (int64, error) {
-	req := s3.GetObjectInput{
+var SizeChangedSinceReport = errors.New("object size has changed since the report was made")
+
+/**
+returned by performDownload if the downloaded data does not match the object's ETag. The download is thrown away,
+so there is no local copy and the object must not be deleted
+*/
+var ChecksumMismatch = errors.New("downloaded data does not match the object's ETag")
+
+/**
+performs a download of the given s3 object to the local filepath. Returns the number of bytes downloaded and the
+result of checking the local copy against the object's ETag (see models.FoundEntry.Verification), or an error.
+returns the local path that was used as well, since an existing file at toFile that is not a copy of the object
+is dealt with according to options.OnConflict; see resolveLocalPath. If it is a copy then it is checked and the
+return value is the same as if the file had been downloaded.
+if expectedSize is greater than zero and the remote object is not that size then SizeChangedSinceReport is returned
+without downloading anything. if the object is archived and has not been restored then ObjectArchived or
+RestoreInProgress is returned, see checkArchiveState. If the downloaded data does not match the ETag then it is
+removed and ChecksumMismatch is returned.
+the data goes to a ".part" file that is only renamed to toFile once it is complete and has not failed verification,
+and an interrupted download is carried on from where it got to by the next run; see downloadToPartFile.
+*/
+func performDownload(s3Client *s3.Client, bucket string, key string, toFile string, expectedSize int64, options DownloadOptions) (string, int64, string, error) {
+	head, headErr := s3Client.HeadObject(context.Background(), &s3.HeadObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
+	})
+	if headErr != nil {
+		return "", 0, models.VerificationNone, headErr
 	}
 
-	ctx := context.Background()
-
-	response, err := s3Client.GetObject(ctx, &req)
-	if err != nil {
-		return 0, err
+	if expectedSize > 0 && head.ContentLength != expectedSize {
+		log.Printf("WARNING performDownload %s:%s is %d bytes but the report said %d", bucket, key, head.ContentLength, expectedSize)
+		return "", 0, models.VerificationNone, SizeChangedSinceReport
 	}
-	defer response.Body.Close()
 
-	localLength, doesExist, statErr := localFileSize(toFile)
-	if statErr != nil {
-		return 0, statErr
+	etag := aws.ToString(head.ETag)
+	//the ETag of a KMS-encrypted object is not an MD5 of its content, so there is nothing to check it against
+	canVerify := head.ServerSideEncryption != types.ServerSideEncryptionAwsKms
+
+	toFile, existingVerification, resolveErr := resolveLocalPath(bucket, key, toFile, head.ContentLength, etag, canVerify, options)
+	if resolveErr != nil {
+		return "", 0, models.VerificationNone, resolveErr
+	}
+	if existingVerification != models.VerificationNone {
+		return toFile, head.ContentLength, existingVerification, nil
 	}
 
-	if doesExist && localLength == response.ContentLength {
-		log.Printf("INFO performDownload local file %s already exists with the right file size", toFile)
-		return localLength, nil
-	} else if doesExist {
-		log.Printf("ERROR performDownload local file %s exists with size %d but remote has size %d", toFile, localLength, response.ContentLength)
-		//return 0, errors.New(fmt.Sprintf("'%s' - another file exists already", toFile))
-		return performDownload(s3Client, bucket, key, toFile+"-new")
+	//an existing local copy can be checked without the object being restored, but a download has to wait for it
+	archiveErr := checkArchiveState(head)
+	if archiveErr != nil {
+		return "", 0, models.VerificationNone, archiveErr
 	}
 
 	dirErr := createLocalDir(toFile)
 	if dirErr != nil {
 		log.Printf("ERROR performDownload could not create directories for '%s': %s", toFile, dirErr)
-		return 0, dirErr
+		return "", 0, models.VerificationNone, dirErr
+	}
+
+	var hasher *etagHasher
+	if canVerify {
+		var hasherErr error
+		hasher, hasherErr = newEtagHasher(etag, head.ContentLength, options.EtagPartSizes)
+		if hasherErr != nil {
+			log.Printf("WARNING performDownload can't check %s:%s against its ETag: %s", bucket, key, hasherErr)
+			canVerify = false
+		}
 	}
 
-	file, openErr := os.OpenFile(toFile, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0640)
+	var tee io.Writer
+	if hasher != nil {
+		tee = hasher
+	}
+	streamHashed, downloadErr := downloadToPartFile(s3Client, bucket, key, etag, head.ContentLength, toFile, tee, options)
+	if downloadErr != nil {
+		//the partial file is kept, so that the next run can carry on from where this one got to
+		return "", 0, models.VerificationNone, downloadErr
+	}
+
+	partFile := partFilenameFor(toFile)
+	localLength, _, statErr := localFileSize(partFile)
+	if statErr != nil || localLength != head.ContentLength {
+		discardPartialDownload(toFile)
+		return "", 0, models.VerificationNone, errors.New(fmt.Sprintf("Incorrect number of bytes read/written, expected %d got %d", head.ContentLength, localLength))
+	}
+
+	verification := models.VerificationUnverifiable
+	if streamHashed {
+		verification = hasher.Result()
+	} else if canVerify {
+		//the data arrived out of order or over several runs, so it has to be read back to be hashed
+		var verifyErr error
+		verification, verifyErr = verifyLocalFile(partFile, etag, head.ContentLength, options.EtagPartSizes)
+		if verifyErr != nil {
+			return "", 0, models.VerificationNone, verifyErr
+		}
+	}
+	if verification == models.VerificationFailed {
+		log.Printf("ERROR performDownload %s does not match the ETag of %s:%s, removing it", partFile, bucket, key)
+		discardPartialDownload(toFile)
+		return "", 0, models.VerificationNone, ChecksumMismatch
+	}
+
+	renameErr := os.Rename(partFile, toFile)
+	if renameErr != nil {
+		return "", 0, models.VerificationNone, renameErr
+	}
+	os.Remove(sidecarFilenameFor(toFile))
+	return toFile, head.ContentLength, verification, nil
+}
+
+/**
+downloads the object into the ".part" file for toFile, carrying on from a previous attempt if the sidecar shows
+that it was for the same version of the object. Objects larger than options.PartSize are fetched as concurrent
+byte ranges into a file that is created at its full size up front, and only the ranges that did not complete last
+time are fetched again. Smaller objects are written sequentially, so an interrupted download carries on from the
+length of the ".part" file.
+If options.DiskGuard is set then room is claimed for whatever is still to be downloaded before anything is written.
+If tee is given, a download that starts from scratch in one piece is also written to it as it arrives; the return
+value is true if tee saw all of the data in order.
+*/
+func downloadToPartFile(s3Client *s3.Client, bucket string, key string, etag string, size int64, toFile string, tee io.Writer, options DownloadOptions) (bool, error) {
+	partFile := partFilenameFor(toFile)
+	isRanged := options.PartSize > 0 && size > options.PartSize
+	ranges := planRanges(size, size+1)
+	if isRanged {
+		ranges = planRanges(size, options.PartSize)
+	}
+
+	newState := partialDownloadState{ETag: etag, Size: size, PartSize: options.PartSize, CompletedParts: []int{}}
+	state := loadPartialDownloadState(toFile)
+	partLength, partExists, statErr := localFileSize(partFile)
+	if statErr != nil {
+		return false, statErr
+	}
+
+	resuming := state != nil && partExists && state.ETag == etag && state.Size == size && state.PartSize == options.PartSize
+	if !isRanged && resuming && partLength > size {
+		resuming = false
+	}
+	if resuming {
+		log.Printf("INFO performDownload resuming %s:%s from %s", bucket, key, partFile)
+	} else {
+		if state != nil || partExists {
+			log.Printf("INFO performDownload %s does not match the current version of %s:%s, starting again", partFile, bucket, key)
+		}
+		discardPartialDownload(toFile)
+		state = &newState
+	}
+
+	//only the data that isn't already in the ".part" file needs room
+	needed := size
+	if resuming && isRanged {
+		for _, partIdx := range state.CompletedParts {
+			if partIdx < len(ranges) {
+				needed -= ranges[partIdx].Length()
+			}
+		}
+	} else if resuming {
+		needed -= partLength
+	}
+	if options.DiskGuard != nil {
+		guardErr := options.DiskGuard.Acquire(needed, bucket+":"+key)
+		if guardErr != nil {
+			return false, guardErr
+		}
+		defer options.DiskGuard.Release(needed)
+	}
+
+	openFlags := os.O_WRONLY | os.O_CREATE
+	if !resuming {
+		openFlags |= os.O_TRUNC
+	}
+	file, openErr := os.OpenFile(partFile, openFlags, 0640)
 	if openErr != nil {
-		return 0, openErr
+		return false, openErr
 	}
 	defer file.Close()
 
-	bytesCopied, copyErr := io.Copy(file, response.Body)
-	if copyErr != nil {
-		defer os.Remove(toFile)
-		return 0, copyErr
+	if isRanged {
+		//ranges are written wherever they land in the file, so it is made the right size first
+		truncErr := file.Truncate(size)
+		if truncErr != nil {
+			return false, truncErr
+		}
+		log.Printf("INFO performDownload fetching %s:%s in %d parts, %d already done", bucket, key, len(ranges), len(state.CompletedParts))
+	} else if resuming && len(ranges) > 0 {
+		log.Printf("INFO performDownload carrying on from byte %d of %d", partLength, size)
+		ranges[0].Start = partLength
+		if ranges[0].Start > ranges[0].End {
+			ranges = ranges[:0]
+		}
+	}
+
+	progress := newDownloadProgress(toFile, file, *state)
+	saveErr := progress.save()
+	if saveErr != nil {
+		return false, saveErr
+	}
+	if isRanged || resuming {
+		tee = nil
+	}
+	teeComplete, downloadErr := downloadRanges(s3Client, bucket, key, etag, ranges, file, progress, tee, options)
+	if downloadErr != nil {
+		return false, downloadErr
+	}
+	//make sure that every range made it into the file before it is handed on for deletion
+	return teeComplete, file.Sync()
+}
+
+/**
+everything that the fetcher workers share
+*/
+type itemFetcher struct {
+	s3Client    *s3.Client
+	layout      *LocalLayout
+	renamedKeys *csvLog
+	restores    *restoreTracker
+	options     DownloadOptions
+	//the number of entries that have been handed to the workers and not finished with yet
+	outstanding int64
+}
+
+/**
+downloads one entry, then its dependents, and passes it on to outputCh with the dependents that were fetched.
+Entries that can't be fetched for a reason that only affects them are logged and dropped, so that they are not
+deleted, and so are all of their dependents; an error is only returned if the run should stop.
+*/
+func (f *itemFetcher) fetchEntry(rec *models.FoundEntry, outputCh chan *models.FoundEntry) error {
+	fetched, err := f.downloadEntry(rec)
+	if err != nil || !fetched {
+		if len(rec.Dependents) > 0 && err == nil {
+			log.Printf("INFO fetcherThread %s:%s has not been fetched, so its %d proxies have not been either", rec.Bucket, rec.Path, len(rec.Dependents))
+		}
+		return err
+	}
+
+	fetchedDependents := make([]*models.FoundEntry, 0, len(rec.Dependents))
+	for _, dependent := range rec.Dependents {
+		dependentFetched, dependentErr := f.downloadEntry(dependent)
+		if dependentErr != nil {
+			return dependentErr
+		}
+		if dependentFetched {
+			fetchedDependents = append(fetchedDependents, dependent)
+		}
+	}
+	rec.Dependents = fetchedDependents
+	outputCh <- rec
+	return nil
+}
+
+/**
+downloads one entry, returning true if there is now a local copy of it. An archived entry is handed to the restore
+tracker, which passes it back to be fetched again once it has been restored.
+*/
+func (f *itemFetcher) downloadEntry(rec *models.FoundEntry) (bool, error) {
+	keyToUse := rec.Path
+
+	localPath, renamed, pathErr := f.layout.PathFor(rec)
+	if pathErr != nil {
+		log.Printf("WARNING fetcherThread can't save %s:%s locally, not fetching or deleting it: %s", rec.Bucket, keyToUse, pathErr)
+		return false, nil
 	}
-	if bytesCopied != response.ContentLength {
-		defer os.Remove(toFile)
-		return 0, errors.New(fmt.Sprintf("Incorrect number of bytes read/written, expected %d got %d", response.ContentLength, bytesCopied))
+
+	startedAt := time.Now()
+	savedPath, bytesCopied, verification, err := performDownload(f.s3Client, rec.Bucket, keyToUse, localPath, rec.Size, f.options)
+	elapsed := time.Since(startedAt)
+
+	switch {
+	case err == SizeChangedSinceReport:
+		log.Printf("WARNING fetcherThread %s:%s has changed since the report was made, not fetching or deleting it", rec.Bucket, keyToUse)
+		return false, nil
+	case err == ChecksumMismatch:
+		log.Printf("ERROR fetcherThread the download of %s:%s was corrupted, not deleting it. It will be fetched again by the next run", rec.Bucket, keyToUse)
+		return false, nil
+	case err == LocalConflictSkipped:
+		return false, nil
+	case err == ObjectArchived || err == RestoreInProgress:
+		if f.restores == nil {
+			log.Printf("WARNING fetcherThread %s:%s is archived and restores are turned off, not fetching or deleting it", rec.Bucket, keyToUse)
+			return false, nil
+		}
+		restoreErr := f.restores.Request(rec, err == RestoreInProgress)
+		if restoreErr != nil {
+			log.Printf("ERROR fetcherThread can't restore %s:%s, not fetching or deleting it: %s", rec.Bucket, keyToUse, restoreErr)
+		}
+		return false, nil
+	case err != nil:
+		log.Printf("ERROR fetcherThread can't download %s:%s - %s", rec.Bucket, keyToUse, err)
+		return false, err
 	}
 
-	return bytesCopied, nil
+	downloadedMb := float64(bytesCopied) / math.Pow(1024, 2)
+	elapsedSeconds := math.Max(elapsed.Seconds(), 0.001)
+	log.Printf("INFO fetcherThread %s %.1fMb in %s (%.1fMb/s), verification %s", keyToUse, downloadedMb, elapsed.Round(time.Second), downloadedMb/elapsedSeconds, verification)
+	if renamed || savedPath != localPath {
+		log.Printf("INFO fetcherThread %s was saved as %s", keyToUse, savedPath)
+		f.renamedKeys.Record(savedPath, rec.Bucket, keyToUse)
+	}
+	rec.Verification = verification
+	return true, nil
 }
 
-func fetcherThread(s3Client *s3.Client, inputCh chan *models.FoundEntry, outputCh chan *models.FoundEntry, errCh chan error, waitGroup *sync.WaitGroup) {
+func fetcherThread(fetcher *itemFetcher, inputCh chan *models.FoundEntry, outputCh chan *models.FoundEntry, errCh chan error, waitGroup *sync.WaitGroup) {
 	defer waitGroup.Done()
 
 	for {
@@ -110,65 +360,105 @@ func fetcherThread(s3Client *s3.Client, inputCh chan *models.FoundEntry, outputC
 			return
 		}
 
-		keyToUse := rec.Path
-		if strings.HasPrefix(keyToUse, "/") {
-			keyToUse = keyToUse[1:]
+		err := fetcher.fetchEntry(rec, outputCh)
+		atomic.AddInt64(&fetcher.outstanding, -1)
+		if err != nil {
+			errCh <- err
+			return
 		}
+	}
+}
 
-		if strings.Contains(keyToUse, "%2F") {
-			decoded, decErr := url.QueryUnescape(keyToUse)
-			if decErr != nil {
-				log.Printf("ERROR fetcherThread could not urldecode '%s': %s", keyToUse, decErr)
-				continue
-			}
-			keyToUse = decoded
-		}
+/**
+hands entries from inputCh to the workers, along with archived entries whose restores have finished. Once
+inputCh reaches the end, it carries on until nothing is outstanding and there are no restores left to wait for, or
+the restores have been waited for as long as RestoreOptions.Wait allows.
+*/
+func dispatchEntries(fetcher *itemFetcher, inputCh chan *models.FoundEntry, workerCh chan *models.FoundEntry) {
+	var readyCh chan *models.FoundEntry
+	var pollCh <-chan time.Time
+	if fetcher.restores != nil {
+		readyCh = fetcher.restores.readyCh
+		stopPollingCh := make(chan struct{})
+		defer close(stopPollingCh)
+		go fetcher.restores.Run(stopPollingCh)
+		//how often to check whether everything is done once the input has finished
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		pollCh = ticker.C
+	}
+
+	forward := func(rec *models.FoundEntry) {
+		atomic.AddInt64(&fetcher.outstanding, 1)
+		workerCh <- rec
+	}
 
-		localPath := path.Join("media", keyToUse)
-		if rec.IsProxy {
-			localPath = path.Join("proxy", keyToUse)
+	for inputCh != nil {
+		select {
+		case rec := <-inputCh:
+			if rec == nil {
+				log.Print("INFO AsyncItemFetcher reached end of input")
+				inputCh = nil
+			} else if rec.Bucket != "" && rec.Path != "" {
+				forward(rec)
+			}
+		case rec := <-readyCh:
+			forward(rec)
 		}
+	}
 
-		bytesCopied, err := performDownload(s3Client, rec.Bucket, keyToUse, localPath)
-		if err != nil {
-			log.Printf("ERROR fetcherThread can't download %s:%s - %s", rec.Bucket, keyToUse, err)
-			errCh <- err
-			return
-		} else {
-			downloadedMb := float64(bytesCopied) / math.Pow(1024, 2)
-			log.Printf("INFO fetcherThread %s %.1fMb", keyToUse, downloadedMb)
-			outputCh <- rec
+	if fetcher.restores != nil {
+		inputFinishedAt := time.Now()
+		loggedWaiting := false
+		for waiting := true; waiting; {
+			select {
+			case rec := <-readyCh:
+				forward(rec)
+			case <-pollCh:
+				if atomic.LoadInt64(&fetcher.outstanding) > 0 {
+					continue
+				}
+				restoresLeft := fetcher.restores.Waiting()
+				if restoresLeft == 0 {
+					waiting = false
+				} else if time.Since(inputFinishedAt) >= fetcher.restores.options.Wait {
+					log.Printf("WARNING AsyncItemFetcher giving up waiting for %d restores, they are recorded in %s for the next run", restoresLeft, fetcher.restores.options.StateFile)
+					waiting = false
+				} else if !loggedWaiting {
+					log.Printf("INFO AsyncItemFetcher everything else is done, waiting up to %s for %d restores", fetcher.restores.options.Wait, restoresLeft)
+					loggedWaiting = true
+				}
+			}
 		}
 	}
 }
 
-func AsyncItemFetcher(s3Client *s3.Client, inputCh chan *models.FoundEntry, threads int) (chan *models.FoundEntry, chan error) {
+func AsyncItemFetcher(s3Client *s3.Client, inputCh chan *models.FoundEntry, threads int, layout *LocalLayout, renamedKeys *csvLog, restores *restoreTracker, options DownloadOptions) (chan *models.FoundEntry, chan error) {
 	outputCh := make(chan *models.FoundEntry, 100)
 	modifiedInputCh := make(chan *models.FoundEntry, 100)
 	errCh := make(chan error, 1)
 	waitGroup := &sync.WaitGroup{}
+	fetcher := &itemFetcher{
+		s3Client:    s3Client,
+		layout:      layout,
+		renamedKeys: renamedKeys,
+		restores:    restores,
+		options:     options,
+	}
 
 	go func() {
-		for {
-			rec := <-inputCh
-			if rec == nil {
-				log.Print("INFO AsyncItemFetcher reached end of stream, sending EOS to workers")
-				for i := 0; i < threads; i++ {
-					modifiedInputCh <- nil
-				}
-				waitGroup.Wait()
-				log.Print("INFO AsyncItemFetcher all workers shut down, exiting")
-				return
-			} else {
-				if rec.Bucket != "" && rec.Path != "" {
-					modifiedInputCh <- rec
-				}
-			}
+		dispatchEntries(fetcher, inputCh, modifiedInputCh)
+		log.Print("INFO AsyncItemFetcher sending EOS to workers")
+		for i := 0; i < threads; i++ {
+			modifiedInputCh <- nil
 		}
+		waitGroup.Wait()
+		log.Print("INFO AsyncItemFetcher all workers shut down, exiting")
+		outputCh <- nil
 	}()
 
 	for i := 0; i < threads; i++ {
-		go fetcherThread(s3Client, modifiedInputCh, outputCh, errCh, waitGroup)
+		go fetcherThread(fetcher, modifiedInputCh, outputCh, errCh, waitGroup)
 		waitGroup.Add(1)
 	}
 
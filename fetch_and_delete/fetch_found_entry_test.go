@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/**
+serves HeadObject, ranged GetObject and DeleteObject for a single object, whatever key is asked for, counting the
+deletions
+*/
+type fakeObject struct {
+	content []byte
+	etag    string
+	deletes int64
+}
+
+func (o *fakeObject) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		atomic.AddInt64(&o.deletes, 1)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("ETag", o.etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(o.content))
+}
+
+func (o *fakeObject) Deletes() int64 {
+	return atomic.LoadInt64(&o.deletes)
+}
+
+func md5Etag(content []byte) string {
+	digest := md5.Sum(content)
+	return `"` + hex.EncodeToString(digest[:]) + `"`
+}
+
+func newFakeObjectServer(content []byte) (*httptest.Server, string) {
+	etag := md5Etag(content)
+	return httptest.NewServer(&fakeObject{content: content, etag: etag}), etag
+}
+
+func newFakeS3Client(server *httptest.Server) *s3.Client {
+	return s3.New(s3.Options{
+		Region:           "eu-west-1",
+		EndpointResolver: s3.EndpointResolverFromURL(server.URL),
+		UsePathStyle:     true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+}
+
+func TestPerformDownloadClaimsSpaceForWhatIsLeft(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	server, etag := newFakeObjectServer(content)
+	defer server.Close()
+	s3Client := newFakeS3Client(server)
+
+	tempDir, _ := ioutil.TempDir("", "fetch-found-entry-test")
+	defer os.RemoveAll(tempDir)
+	toFile := path.Join(tempDir, "media.mxf")
+
+	//the report gave no size, so the guard has to go by what S3 says
+	volume := &fakeVolume{free: int64(len(content)) - 1}
+	options := DownloadOptions{PartThreads: 1, DiskGuard: newTestGuard(volume, 0, 0)}
+	_, _, _, err := performDownload(s3Client, "bucket", "media.mxf", toFile, 0, options)
+	if err != InsufficientDiskSpace {
+		t.Fatalf("expected InsufficientDiskSpace for a %d byte object with %d bytes free, got %v", len(content), volume.free, err)
+	}
+
+	//a resumed download only needs room for the part that it hasn't got yet
+	ioutil.WriteFile(partFilenameFor(toFile), content[:400], 0640)
+	newDownloadProgress(toFile, nil, partialDownloadState{ETag: etag, Size: int64(len(content)), CompletedParts: []int{}}).save()
+	volume.setFree(600)
+	savedPath, bytesCopied, verification, err := performDownload(s3Client, "bucket", "media.mxf", toFile, 0, options)
+	if err != nil {
+		t.Fatal("unexpected error resuming the download: ", err)
+	}
+	if savedPath != toFile || bytesCopied != int64(len(content)) || verification != models.VerifiedEtag {
+		t.Errorf("got %s %d %s, expected %s %d %s", savedPath, bytesCopied, verification, toFile, len(content), models.VerifiedEtag)
+	}
+	downloaded, _ := ioutil.ReadFile(toFile)
+	if !bytes.Equal(downloaded, content) {
+		t.Error("downloaded file does not match the object")
+	}
+}
+
+func TestAsyncItemFetcherPassesOnEndOfStream(t *testing.T) {
+	inputCh := make(chan *models.FoundEntry, 10)
+	//entries with no bucket or path are dropped without being fetched
+	inputCh <- &models.FoundEntry{Path: "no-bucket.mxf"}
+	inputCh <- &models.FoundEntry{Bucket: "bucket"}
+	inputCh <- nil
+
+	outputCh, errCh := AsyncItemFetcher(nil, inputCh, 3, &LocalLayout{Root: "/data", Template: DefaultLayoutTemplate}, nil, nil, DownloadOptions{})
+	select {
+	case rec := <-outputCh:
+		if rec != nil {
+			t.Errorf("expected end of stream, got %v", rec)
+		}
+	case err := <-errCh:
+		t.Fatal("unexpected error: ", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("AsyncItemFetcher never passed on the end of stream")
+	}
+}
+
+func TestCorruptedDownloadIsNeverDeleted(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	//the data that arrives does not match the ETag, as if it had been corrupted on the way
+	object := &fakeObject{content: content, etag: md5Etag(content[1:])}
+	server := httptest.NewServer(object)
+	defer server.Close()
+	s3Client := newFakeS3Client(server)
+
+	tempDir, _ := ioutil.TempDir("", "fetch-found-entry-test")
+	defer os.RemoveAll(tempDir)
+	layout, _ := NewLocalLayout(tempDir, DefaultLayoutTemplate)
+
+	inputCh := make(chan *models.FoundEntry, 10)
+	inputCh <- &models.FoundEntry{Bucket: "bucket", Path: "media.mxf", Size: int64(len(content))}
+	inputCh <- nil
+	fetchedCh, fetchErrCh := AsyncItemFetcher(s3Client, inputCh, 1, layout, nil, nil, DownloadOptions{PartThreads: 1})
+	//as with -really-delete -delete-unverified
+	deleteErrCh := AsyncEntryDeleter(s3Client, fetchedCh, 1, true, false)
+
+	select {
+	case err := <-fetchErrCh:
+		t.Fatal("unexpected error from the fetcher: ", err)
+	case err := <-deleteErrCh:
+		if err != nil {
+			t.Fatal("unexpected error from the deleter: ", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the pipeline to finish")
+	}
+	if object.Deletes() != 0 {
+		t.Errorf("the object was deleted %d times although its download was corrupted", object.Deletes())
+	}
+	if _, err := os.Stat(path.Join(tempDir, "media", "media.mxf")); !os.IsNotExist(err) {
+		t.Error("the corrupted download was kept")
+	}
+}
+
+func TestProxiesFollowTheirOriginal(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	server, _ := newFakeObjectServer(content)
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "fetch-found-entry-test")
+	defer os.RemoveAll(tempDir)
+	layout, _ := NewLocalLayout(tempDir, DefaultLayoutTemplate)
+
+	makeOriginal := func(name string, size int64) *models.FoundEntry {
+		return &models.FoundEntry{Bucket: "holding-pen", Path: name + ".mxf", Size: size, Dependents: []*models.FoundEntry{
+			{Bucket: "proxies", Path: name + ".mp4", IsProxy: true},
+		}}
+	}
+	inputCh := make(chan *models.FoundEntry, 10)
+	inputCh <- makeOriginal("fetched", int64(len(content)))
+	//the report's size is out of date, so this original is skipped and its proxy must be too
+	inputCh <- makeOriginal("changed", int64(len(content))+1)
+	inputCh <- nil
+
+	outputCh, errCh := AsyncItemFetcher(newFakeS3Client(server), inputCh, 1, layout, nil, nil, DownloadOptions{PartThreads: 1})
+	results := make([]*models.FoundEntry, 0)
+	func() {
+		for {
+			select {
+			case rec := <-outputCh:
+				if rec == nil {
+					return
+				}
+				results = append(results, rec)
+			case err := <-errCh:
+				t.Fatal("unexpected error: ", err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the fetcher")
+			}
+		}
+	}()
+
+	if len(results) != 1 || results[0].Path != "fetched.mxf" || len(results[0].Dependents) != 1 || results[0].Dependents[0].Verification != models.VerifiedEtag {
+		t.Errorf("expected only fetched.mxf with its verified proxy, got %v", results)
+	}
+	if _, err := os.Stat(path.Join(tempDir, "proxy", "changed.mp4")); !os.IsNotExist(err) {
+		t.Error("the proxy of a skipped original was fetched")
+	}
+}
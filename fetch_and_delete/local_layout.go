@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"path"
+	"regexp"
+	"strings"
+)
+
+/**
+the layout that we have always used, originals under media/ and proxies under proxy/ in the working directory
+*/
+const DefaultLayoutTemplate = "{root}/{kind}/{key}"
+
+var layoutPlaceholder = regexp.MustCompile(`{[^{}]*}`)
+
+var knownLayoutPlaceholders = map[string]bool{
+	"{root}":   true,
+	"{kind}":   true,
+	"{bucket}": true,
+	"{key}":    true,
+	"{dir}":    true,
+	"{name}":   true,
+	"{stem}":   true,
+	"{ext}":    true,
+	"{yyyy}":   true,
+	"{mm}":     true,
+	"{dd}":     true,
+}
+
+/**
+works out where on the local filesystem each downloaded entry goes, from a template such as
+"{root}/{bucket}/{yyyy}/{key}". The placeholders are:
+
+	{root}   the destination root directory
+	{kind}   "media" for originals and "proxy" for proxies
+	{bucket} the bucket that the entry is in
+	{key}    the whole key
+	{dir}    the directory part of the key, {name} the file name, {stem} the file name without its extension and
+	         {ext} the extension without the dot
+	{yyyy}, {mm} and {dd} the date that the object was last modified, or "unknown" if the report did not say
+*/
+type LocalLayout struct {
+	Root     string
+	Template string
+}
+
+func NewLocalLayout(root string, template string) (*LocalLayout, error) {
+	for _, placeholder := range layoutPlaceholder.FindAllString(template, -1) {
+		if !knownLayoutPlaceholders[placeholder] {
+			return nil, fmt.Errorf("'%s' in layout template is not a recognised placeholder", placeholder)
+		}
+	}
+	if !strings.Contains(template, "{key}") && !strings.Contains(template, "{name}") && !strings.Contains(template, "{stem}") {
+		return nil, fmt.Errorf("layout template '%s' must include the key or file name, otherwise every file would go to the same place", template)
+	}
+	return &LocalLayout{Root: root, Template: template}, nil
+}
+
+/**
+returns the local path for the given entry, and whether the key had to be changed to make it safe to write (see
+sanitiseKey). Returns an error if there is no safe local path for the key.
+*/
+func (l *LocalLayout) PathFor(entry *models.FoundEntry) (string, bool, error) {
+	key, sanitiseErr := sanitiseKey(entry.Path)
+	if sanitiseErr != nil {
+		return "", false, sanitiseErr
+	}
+	name := path.Base(key)
+	ext := path.Ext(name)
+	dir := path.Dir(key)
+	if dir == "." {
+		dir = ""
+	}
+	kind := "media"
+	if entry.IsProxy {
+		kind = "proxy"
+	}
+	year, month, day := "unknown", "unknown", "unknown"
+	if !entry.LastModified.IsZero() {
+		year = entry.LastModified.Format("2006")
+		month = entry.LastModified.Format("01")
+		day = entry.LastModified.Format("02")
+	}
+
+	replacer := strings.NewReplacer(
+		"{root}", l.Root,
+		"{kind}", kind,
+		"{bucket}", entry.Bucket,
+		"{key}", key,
+		"{dir}", dir,
+		"{name}", name,
+		"{stem}", strings.TrimSuffix(name, ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+		"{yyyy}", year,
+		"{mm}", month,
+		"{dd}", day,
+	)
+	return path.Clean(replacer.Replace(l.Template)), key != entry.Path, nil
+}
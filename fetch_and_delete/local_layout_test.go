@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"testing"
+	"time"
+)
+
+func TestLocalLayoutPathFor(t *testing.T) {
+	original := &models.FoundEntry{Bucket: "media-bucket", Path: "project/clips/interview.mxf", LastModified: time.Date(2019, 3, 7, 12, 0, 0, 0, time.UTC)}
+	proxy := &models.FoundEntry{Bucket: "proxy-bucket", Path: "project/clips/interview.mp4", IsProxy: true}
+
+	tests := []struct {
+		template string
+		entry    *models.FoundEntry
+		expected string
+	}{
+		{DefaultLayoutTemplate, original, "/data/media/project/clips/interview.mxf"},
+		{DefaultLayoutTemplate, proxy, "/data/proxy/project/clips/interview.mp4"},
+		{"{root}/{bucket}/{yyyy}/{key}", original, "/data/media-bucket/2019/project/clips/interview.mxf"},
+		{"{root}/{bucket}/{yyyy}/{key}", proxy, "/data/proxy-bucket/unknown/project/clips/interview.mp4"},
+		{"{root}/{dir}/{stem}-{kind}.{ext}", proxy, "/data/project/clips/interview-proxy.mp4"},
+		{"{root}/{yyyy}-{mm}-{dd}/{name}", original, "/data/2019-03-07/interview.mxf"},
+	}
+
+	for _, test := range tests {
+		layout, err := NewLocalLayout("/data", test.template)
+		if err != nil {
+			t.Errorf("%s gave unexpected error %s", test.template, err)
+			continue
+		}
+		result, _, pathErr := layout.PathFor(test.entry)
+		if pathErr != nil || result != test.expected {
+			t.Errorf("%s gave %s %v, expected %s", test.template, result, pathErr, test.expected)
+		}
+	}
+}
+
+func TestNewLocalLayoutInvalid(t *testing.T) {
+	for _, template := range []string{"{root}/{year}/{key}", "{root}/{bucket}"} {
+		_, err := NewLocalLayout("/data", template)
+		if err == nil {
+			t.Errorf("expected %s to be rejected", template)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+/**
+the longest file or directory name that we will write, in bytes. This is the limit on our SMB shares and on most
+local filesystems
+*/
+const maxLocalNameBytes = 255
+
+/**
+characters that can't appear in a file name on SMB shares. '%' is included so that the escaping can be undone
+*/
+const reservedLocalChars = `<>:"\|?*%`
+
+/**
+names that Windows (and so SMB) treats as devices, with or without an extension
+*/
+var reservedLocalNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+/**
+turns an S3 key into a relative path that is safe to write under the download root. Keys with ".." components are
+refused outright, since they would escape the download directory. Empty and "." components are dropped.
+Each remaining component has reserved and control characters, trailing dots and spaces and the first character of
+device names percent-escaped, which url.PathUnescape can undo. Components that are still too long are shortened
+and given a hash of the full name so that they stay unique; only the manifest can tell you what those were.
+*/
+func sanitiseKey(key string) (string, error) {
+	components := make([]string, 0)
+	for _, component := range strings.Split(key, "/") {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("key '%s' contains '..' and would be written outside the download directory", key)
+		}
+		components = append(components, shortenLocalName(escapeLocalName(component)))
+	}
+	if len(components) == 0 {
+		return "", fmt.Errorf("key '%s' has no file name", key)
+	}
+	return strings.Join(components, "/"), nil
+}
+
+func escapeLocalName(name string) string {
+	isDevice := reservedLocalNames[strings.ToUpper(strings.SplitN(name, ".", 2)[0])]
+	var escaped strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		isLast := i == len(name)-1
+		if c < 0x20 || c == 0x7f || strings.IndexByte(reservedLocalChars, c) >= 0 || (isLast && (c == '.' || c == ' ')) || (i == 0 && isDevice) {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		} else {
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+/**
+cuts a name down to maxLocalNameBytes, keeping its extension and adding "~" and a hash of the whole name. The cut
+never falls inside a multi-byte character or an escape sequence.
+*/
+func shortenLocalName(name string) string {
+	if len(name) <= maxLocalNameBytes {
+		return name
+	}
+	ext := path.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	digest := sha1.Sum([]byte(name))
+	suffix := "~" + hex.EncodeToString(digest[:4])
+
+	cut := maxLocalNameBytes - len(suffix) - len(ext)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	if escapeStart := strings.LastIndexByte(name[:cut], '%'); escapeStart >= 0 && escapeStart > cut-3 {
+		cut = escapeStart
+	}
+	return name[:cut] + suffix + ext
+}
+
+/**
+opens the CSV file that records the original bucket and key for every download whose local path is not simply the
+key, so that the mapping can be reversed later
+*/
+func openRenamedKeysManifest(filename string) (*csvLog, error) {
+	return openCsvLog(filename, []string{"Local path", "Bucket", "Key"})
+}
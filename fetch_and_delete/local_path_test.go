@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitiseKey(t *testing.T) {
+	tests := map[string]string{
+		"project/clips/interview.mxf":  "project/clips/interview.mxf",
+		"/leading/slash.mxf":           "leading/slash.mxf",
+		"double//slash/./dot.mxf":      "double/slash/dot.mxf",
+		"what? when: \"now\" <*>|.mxf": "what%3F when%3A %22now%22 %3C%2A%3E%7C.mxf",
+		"back\\slash and 100%.mxf":     "back%5Cslash and 100%25.mxf",
+		"trailing dot./and space ":     "trailing dot%2E/and space%20",
+		"devices/con.txt/NUL/console":  "devices/%63on.txt/%4EUL/console",
+		"control/new\nline\x7f.mxf":    "control/new%0Aline%7F.mxf",
+		"unicode/café ☕.mxf":           "unicode/café ☕.mxf",
+	}
+	for key, expected := range tests {
+		result, err := sanitiseKey(key)
+		if err != nil {
+			t.Errorf("%q gave unexpected error %s", key, err)
+			continue
+		}
+		if result != expected {
+			t.Errorf("%q gave %q, expected %q", key, result, expected)
+		}
+		unescaped, _ := url.PathUnescape(result)
+		if !strings.Contains(key, "//") && !strings.Contains(key, "./") && !strings.HasPrefix(key, "/") && unescaped != key {
+			t.Errorf("%q did not unescape back to the key, got %q", result, unescaped)
+		}
+	}
+}
+
+func TestSanitiseKeyRefusesTraversal(t *testing.T) {
+	for _, key := range []string{"../etc/passwd", "media/../../escape.mxf", "..", "/", "./"} {
+		result, err := sanitiseKey(key)
+		if err == nil {
+			t.Errorf("expected %q to be refused, got %q", key, result)
+		}
+	}
+}
+
+func TestSanitiseKeyLongNames(t *testing.T) {
+	long := strings.Repeat("ü", 200) + ".mxf"
+	otherLong := strings.Repeat("ü", 199) + "x.mxf"
+	escapes := strings.Repeat("a", 240) + strings.Repeat("?", 20) + ".mxf"
+
+	for _, key := range []string{long, otherLong, escapes} {
+		result, err := sanitiseKey("dir/" + key)
+		if err != nil {
+			t.Errorf("unexpected error %s", err)
+			continue
+		}
+		name := path.Base(result)
+		if len(name) > maxLocalNameBytes || !utf8.ValidString(name) || !strings.HasSuffix(name, ".mxf") {
+			t.Errorf("bad shortened name %q (%d bytes)", name, len(name))
+		}
+		if _, unescapeErr := url.PathUnescape(name); unescapeErr != nil {
+			t.Errorf("shortened name %q is not a valid escaped name: %s", name, unescapeErr)
+		}
+	}
+
+	first, _ := sanitiseKey(long)
+	second, _ := sanitiseKey(otherLong)
+	if first == second {
+		t.Errorf("two different long names were shortened to the same thing %q", first)
+	}
+}
+
+func TestPathForRenamed(t *testing.T) {
+	layout, _ := NewLocalLayout("/data", DefaultLayoutTemplate)
+
+	_, renamed, _ := layout.PathFor(&models.FoundEntry{Path: "plain/key.mxf"})
+	if renamed {
+		t.Error("plain key should not count as renamed")
+	}
+	localPath, renamed, _ := layout.PathFor(&models.FoundEntry{Path: "odd/key?.mxf"})
+	if !renamed || localPath != "/data/media/odd/key%3F.mxf" {
+		t.Errorf("got %s %v for a key that needs escaping", localPath, renamed)
+	}
+	_, _, err := layout.PathFor(&models.FoundEntry{Path: "../key.mxf"})
+	if err == nil {
+		t.Error("expected an error for a key that escapes the root")
+	}
+}
+
+func TestRenamedKeysManifest(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "renamed-keys-test")
+	defer os.RemoveAll(tempDir)
+	filename := path.Join(tempDir, "renamed-keys.csv")
+
+	for _, key := range []string{"first?.mxf", "second\n.mxf"} {
+		manifest, err := openRenamedKeysManifest(filename)
+		if err != nil {
+			t.Fatal("could not open manifest: ", err)
+		}
+		localName, _ := sanitiseKey(key)
+		manifest.Record(path.Join(tempDir, localName), "bucket", key)
+		manifest.Close()
+	}
+
+	content, _ := ioutil.ReadFile(filename)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if lines[0] != "Local path,Bucket,Key" || strings.Count(string(content), "Local path") != 1 {
+		t.Errorf("expected one header row, got %q", content)
+	}
+	if !strings.Contains(string(content), "first%3F.mxf,bucket,first?.mxf") || !strings.Contains(string(content), "\"second\n.mxf\"") {
+		t.Errorf("manifest does not record both keys: %q", content)
+	}
+}
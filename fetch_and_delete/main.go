@@ -7,14 +7,44 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/guardian/multimedia-holding-pen-utils/models"
 	"log"
+	"os"
+	"path"
+	"time"
 )
 
 func main() {
-	inputFilePtr := flag.String("input", "report.csv", "CSV report to read from")
+	inputFilePtr := flag.String("input", "report.csv", "report to read from, either a local file, an s3:// URI or - for stdin")
+	inputFormatPtr := flag.String("format", "auto", "format of the input report, csv, jsonl or sqlite. auto picks the format from the -input file extension")
+	sqlFilterPtr := flag.String("where", "", "when reading from a results database, only process requested files matching this SQL condition")
+	runIdPtr := flag.Int64("run", 0, "when reading from a results database, the scan run to process. Defaults to the most recent one that finished")
 	bucketPtr := flag.String("bucket", "holding-pen", "Bucket name that contains the original media files")
 	desiredThreadsPtr := flag.Int("threads", 4, "Number of concurrent deletion operations to run")
 	reallyDeletePtr := flag.Bool("really-delete", false, "Only attempt to delete files if this option is set")
 	noCopyPtr := flag.Bool("no-copy", false, "don't try to download the files first")
+	includeInvalidProxiesPtr := flag.Bool("delete-invalid-proxies", false, "also fetch and delete proxies that the report flagged as invalid")
+	allowIncompletePtr := flag.Bool("allow-incomplete", false, "act on a report even if it has no end-of-report trailer or the trailer does not match, e.g. reports from older versions, or on a -run that has not finished")
+	destRootPtr := flag.String("dest", ".", "root directory to download files into")
+	layoutPtr := flag.String("layout", DefaultLayoutTemplate, "where to put each download under -dest. Placeholders are {root}, {kind} (media or proxy), {bucket}, {key}, {dir}, {name}, {stem}, {ext}, {yyyy}, {mm} and {dd}")
+	renamedManifestPtr := flag.String("renamed-manifest", "", "CSV file recording the original key of every download that had to be saved under a different name. Defaults to renamed-keys.csv under -dest")
+	minFreeSpacePtr := flag.Int64("min-free-space", 1024, "megabytes to always leave free on the -dest volume. Downloads pause when they would eat into this. Negative turns the check off")
+	diskWaitPtr := flag.Duration("disk-wait", 10*time.Minute, "how long to wait for space to be freed on the -dest volume, once nothing else is downloading, before stopping the run")
+	bandwidthLimitPtr := flag.Float64("bandwidth-limit", 0, "maximum total download speed in megabytes per second, shared by all threads. 0 for no limit")
+	bandwidthSchedulePtr := flag.String("bandwidth-schedule", "", "comma-separated times with their own limits in megabytes per second, which take precedence over -bandwidth-limit, e.g. \"mon-fri 08:00-18:00=2,mon-fri 18:00-08:00=0\". Times are local and 0 means no limit")
+	noRestorePtr := flag.Bool("no-restore", false, "skip objects that are in GLACIER or DEEP_ARCHIVE instead of restoring them")
+	restoreTierPtr := flag.String("restore-tier", "bulk", "retrieval tier for restoring archived objects, bulk, standard or expedited")
+	restoreDaysPtr := flag.Int("restore-days", 7, "number of days to keep restored copies of archived objects for")
+	restoreStatePtr := flag.String("restore-state", "", "file that records the restores that have been requested. Defaults to pending-restores.json under -dest")
+	restorePollPtr := flag.Duration("restore-poll", 15*time.Minute, "how often to check whether restores have finished")
+	restoreWaitPtr := flag.Duration("restore-wait", 48*time.Hour, "how long to keep waiting for restores once everything else is done. 0 leaves them for the next run")
+	onConflictPtr := flag.String("on-conflict", "rename", "what to do when a different file is already at the local path: skip, overwrite, rename (download alongside it as name-1.ext etc.) or trust-size (as rename, but also reuse a file of the right size that can't be checked against the ETag). compare is the same as rename")
+	conflictsFilePtr := flag.String("conflicts", "", "CSV file recording every conflict with an existing local file and how it was resolved. Defaults to conflicts.csv under -dest")
+	partSizePtr := flag.Int64("part-size", 64, "files bigger than this many megabytes are downloaded as several byte ranges at once")
+	partThreadsPtr := flag.Int("part-threads", 4, "number of byte ranges of a large file to download at once")
+	etagPartSizesPtr := flag.String("etag-part-sizes", "8,16,5,15,64,100", "comma-separated upload part sizes in megabytes to try when checking a download against a multipart ETag")
+	deleteUnverifiedPtr := flag.Bool("delete-unverified", false, "delete files even if the local copy could not be checked against S3, e.g. with -no-copy or for KMS-encrypted objects. Files whose local copy does not match are never deleted")
+	rejectsFilePtr := flag.String("rejects", "", "if set, write any report rows that can't be read to this file, with their line numbers and the reason")
+	maxRejectsPtr := flag.Int("max-rejects", 0, "stop if more than this many report rows can't be read. The whole report is checked before anything is deleted, except with -allow-incomplete or when reading from stdin, where rows before the one that went over the limit may already have been deleted. Set to -1 for no limit")
+	shardPtr := flag.Int("shard", 0, "if set, -input is a shard manifest and only this shard of it (counting from 1) is processed")
 	flag.Parse()
 
 	s3config, confErr := awsconfig.LoadDefaultConfig(context.Background())
@@ -24,18 +54,142 @@ func main() {
 
 	s3client := s3.NewFromConfig(s3config)
 
-	inputCh, inputErrCh := models.AsyncCsvReader(*inputFilePtr)
-	entriesCh, entryErrCh := AsyncEntryFanout(inputCh, *bucketPtr)
+	inputFile := *inputFilePtr
+	if *shardPtr > 0 {
+		manifest, manifestErr := models.ReadShardManifest(s3client, *inputFilePtr)
+		if manifestErr != nil {
+			log.Fatalf("Could not read shard manifest %s: %s", *inputFilePtr, manifestErr)
+		}
+		shardLocation, shardErr := manifest.ShardLocation(*inputFilePtr, *shardPtr)
+		if shardErr != nil {
+			log.Fatal("Could not find shard: ", shardErr)
+		}
+		log.Printf("INFO Processing shard %d of %d (split by %s) from %s", *shardPtr, len(manifest.Shards), manifest.Strategy, shardLocation)
+		inputFile = shardLocation
+	}
+
+	inputFormat, formatErr := models.ReportFormatForFilename(inputFile, *inputFormatPtr)
+	if formatErr != nil {
+		log.Fatal("Could not determine report format: ", formatErr)
+	}
+	if *partThreadsPtr < 1 {
+		log.Fatal("-part-threads must be at least 1")
+	}
+	etagPartSizes, partSizesErr := parseMegabyteList(*etagPartSizesPtr)
+	if partSizesErr != nil {
+		log.Fatal("Could not read -etag-part-sizes: ", partSizesErr)
+	}
+	layout, layoutErr := NewLocalLayout(*destRootPtr, *layoutPtr)
+	if layoutErr != nil {
+		log.Fatal("Invalid download layout: ", layoutErr)
+	}
+	onConflict, conflictErr := ParseConflictPolicy(*onConflictPtr)
+	if conflictErr != nil {
+		log.Fatal("Invalid -on-conflict: ", conflictErr)
+	}
+	bandwidthSchedule, scheduleErr := parseBandwidthSchedule(*bandwidthSchedulePtr, *bandwidthLimitPtr*1024*1024)
+	if scheduleErr != nil {
+		log.Fatal("Could not read -bandwidth-schedule: ", scheduleErr)
+	}
+	limiter := newBandwidthLimiter(bandwidthSchedule)
+	downloadOptions := DownloadOptions{PartSize: *partSizePtr * 1024 * 1024, PartThreads: *partThreadsPtr, EtagPartSizes: etagPartSizes, Limiter: limiter, OnConflict: onConflict}
+	readerOptions := models.ReportReaderOptions{RejectsFile: *rejectsFilePtr, MaxRejects: *maxRejectsPtr, RequireTrailer: !*allowIncompletePtr}
+
+	var inputCh chan *models.LookupResult
+	var inputErrCh chan error
+	if inputFormat == models.ReportFormatSQLite {
+		if models.IsStdioLocation(inputFile) {
+			log.Fatal("A results database can't be read from stdin")
+		}
+		inputCh, inputErrCh = models.AsyncSqliteReader(inputFile, *runIdPtr, *sqlFilterPtr, *allowIncompletePtr)
+	} else {
+		if (models.IsStdioLocation(inputFile) || *allowIncompletePtr) && *maxRejectsPtr >= 0 && *reallyDeletePtr {
+			//the rows are acted on as they are read, so the limit can only stop whatever comes after it is reached
+			log.Print("WARNING -max-rejects is only checked as the report is read, files from earlier rows may already have been deleted by the time it stops the run")
+		}
+		if models.IsStdioLocation(inputFile) && !*allowIncompletePtr {
+			//stdin can't be read twice, so the report is processed as it arrives and only checked once it ends
+			log.Print("WARNING Reading the report from stdin, it can only be checked for completeness once it has all been read")
+		} else if !*allowIncompletePtr {
+			log.Printf("INFO Checking that %s is complete before acting on it...", inputFile)
+			verifyErr := models.VerifyReport(s3client, inputFile, inputFormat, readerOptions)
+			if verifyErr != nil {
+				log.Fatalf("Refusing to act on %s: %s. Use -allow-incomplete to override.", inputFile, verifyErr)
+			}
+		}
+		inputCh, inputErrCh = models.AsyncReportReader(s3client, inputFile, inputFormat, readerOptions)
+	}
+	entriesCh, entryErrCh := AsyncEntryFanout(inputCh, *bucketPtr, *includeInvalidProxiesPtr)
 	var downloadedCh chan *models.FoundEntry
 	var downloadErrCh chan error
 	if *noCopyPtr {
+		if !*deleteUnverifiedPtr {
+			log.Print("WARNING Nothing will be deleted with -no-copy, since there are no local copies to verify. Add -delete-unverified to delete anyway")
+		}
 		downloadedCh = entriesCh
 		downloadErrCh = make(chan error, 1)
 	} else {
-		downloadedCh, downloadErrCh = AsyncItemFetcher(s3client, entriesCh, *desiredThreadsPtr)
+		renamedManifestFile := *renamedManifestPtr
+		if renamedManifestFile == "" {
+			renamedManifestFile = path.Join(*destRootPtr, "renamed-keys.csv")
+		}
+		renamedKeys, manifestErr := openRenamedKeysManifest(renamedManifestFile)
+		if manifestErr != nil {
+			log.Fatal("Could not open renamed keys manifest: ", manifestErr)
+		}
+		defer renamedKeys.Close()
+		conflictsFile := *conflictsFilePtr
+		if conflictsFile == "" {
+			conflictsFile = path.Join(*destRootPtr, "conflicts.csv")
+		}
+		conflicts, conflictsErr := openConflictLog(conflictsFile)
+		if conflictsErr != nil {
+			log.Fatal("Could not open conflicts file: ", conflictsErr)
+		}
+		defer conflicts.Close()
+		downloadOptions.Conflicts = conflicts
+		if *minFreeSpacePtr >= 0 {
+			mkdirErr := os.MkdirAll(*destRootPtr, 0755)
+			if mkdirErr != nil {
+				log.Fatal("Could not create download directory: ", mkdirErr)
+			}
+			downloadOptions.DiskGuard = newDiskSpaceGuard(*destRootPtr, *minFreeSpacePtr*1024*1024, *diskWaitPtr)
+			if _, freeErr := freeDiskSpace(*destRootPtr); freeErr != nil {
+				log.Fatal("Could not check free space in download directory: ", freeErr)
+			}
+		}
+		stopReportingCh := make(chan struct{})
+		defer close(stopReportingCh)
+		go limiter.ReportThroughput(time.Minute, stopReportingCh)
+		var restores *restoreTracker
+		if !*noRestorePtr {
+			restoreTier, tierErr := ParseRestoreTier(*restoreTierPtr)
+			if tierErr != nil {
+				log.Fatal("Invalid -restore-tier: ", tierErr)
+			}
+			if *restoreDaysPtr < 1 {
+				log.Fatal("-restore-days must be at least 1")
+			}
+			restoreStateFile := *restoreStatePtr
+			if restoreStateFile == "" {
+				restoreStateFile = path.Join(*destRootPtr, "pending-restores.json")
+			}
+			var restoreErr error
+			restores, restoreErr = newRestoreTracker(s3client, RestoreOptions{
+				Tier:         restoreTier,
+				Days:         int32(*restoreDaysPtr),
+				StateFile:    restoreStateFile,
+				PollInterval: *restorePollPtr,
+				Wait:         *restoreWaitPtr,
+			})
+			if restoreErr != nil {
+				log.Fatal("Could not load restore state: ", restoreErr)
+			}
+		}
+		downloadedCh, downloadErrCh = AsyncItemFetcher(s3client, entriesCh, *desiredThreadsPtr, layout, renamedKeys, restores, downloadOptions)
 	}
 
-	deleteErrCh := AsyncEntryDeleter(s3client, downloadedCh, 1, *reallyDeletePtr)
+	deleteErrCh := AsyncEntryDeleter(s3client, downloadedCh, 1, *reallyDeletePtr, !*deleteUnverifiedPtr)
 
 	func() {
 		for {
@@ -47,7 +201,11 @@ func main() {
 				log.Print("ERROR main received error from fanout: ", err)
 				return
 			case err := <-downloadErrCh:
-				log.Print("ERROR main received error from download: ", err)
+				if err == InsufficientDiskSpace {
+					log.Printf("ERROR main stopping because %s is out of space. Nothing that was not downloaded has been deleted; free up some space or lower -min-free-space, then run again and partial downloads will carry on where they left off", *destRootPtr)
+				} else {
+					log.Print("ERROR main received error from download: ", err)
+				}
 				return
 			case err := <-deleteErrCh:
 				if err == nil {
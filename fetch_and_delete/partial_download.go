@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+/**
+the sidecar that is written next to a ".part" file, recording which object the partial data came from and how far
+the download got. A download is only resumed if the object still has the same ETag and size and the same part size
+is in use, since otherwise the ranges would not line up.
+*/
+type partialDownloadState struct {
+	ETag           string `json:"etag"`
+	Size           int64  `json:"size"`
+	PartSize       int64  `json:"partSize"`
+	CompletedParts []int  `json:"completedParts"`
+}
+
+func partFilenameFor(toFile string) string {
+	return toFile + ".part"
+}
+
+func sidecarFilenameFor(toFile string) string {
+	return toFile + ".part.json"
+}
+
+/**
+reads the sidecar for the given download, returning nil if there isn't one or it can't be read
+*/
+func loadPartialDownloadState(toFile string) *partialDownloadState {
+	content, readErr := ioutil.ReadFile(sidecarFilenameFor(toFile))
+	if readErr != nil {
+		if !os.IsNotExist(readErr) {
+			log.Printf("WARNING loadPartialDownloadState could not read sidecar for %s: %s", toFile, readErr)
+		}
+		return nil
+	}
+	var state partialDownloadState
+	unmarshalErr := json.Unmarshal(content, &state)
+	if unmarshalErr != nil {
+		log.Printf("WARNING loadPartialDownloadState sidecar for %s is corrupt: %s", toFile, unmarshalErr)
+		return nil
+	}
+	return &state
+}
+
+/**
+removes the partial file and its sidecar, so that the download starts again from scratch
+*/
+func discardPartialDownload(toFile string) {
+	os.Remove(partFilenameFor(toFile))
+	os.Remove(sidecarFilenameFor(toFile))
+}
+
+/**
+tracks the progress of a download into a ".part" file, saving it to the sidecar every time a part is completed
+*/
+type downloadProgress struct {
+	mutex     sync.Mutex
+	toFile    string
+	file      *os.File
+	state     partialDownloadState
+	completed map[int]bool
+}
+
+func newDownloadProgress(toFile string, file *os.File, state partialDownloadState) *downloadProgress {
+	completed := make(map[int]bool, len(state.CompletedParts))
+	for _, idx := range state.CompletedParts {
+		completed[idx] = true
+	}
+	return &downloadProgress{toFile: toFile, file: file, state: state, completed: completed}
+}
+
+func (p *downloadProgress) IsComplete(partIdx int) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.completed[partIdx]
+}
+
+/**
+records that a part is complete. The data is synced to disk before the sidecar says that it is there, so a crash
+can't leave the sidecar claiming parts that were never written.
+*/
+func (p *downloadProgress) MarkComplete(partIdx int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	syncErr := p.file.Sync()
+	if syncErr != nil {
+		return syncErr
+	}
+	p.completed[partIdx] = true
+	p.state.CompletedParts = make([]int, 0, len(p.completed))
+	for idx := range p.completed {
+		p.state.CompletedParts = append(p.state.CompletedParts, idx)
+	}
+	sort.Ints(p.state.CompletedParts)
+	return p.save()
+}
+
+/**
+writes the sidecar out, via a temporary file so that it is never seen half-written
+*/
+func (p *downloadProgress) save() error {
+	content, marshalErr := json.Marshal(&p.state)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	tempName := sidecarFilenameFor(p.toFile) + ".tmp"
+	writeErr := ioutil.WriteFile(tempName, content, 0640)
+	if writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tempName, sidecarFilenameFor(p.toFile))
+}
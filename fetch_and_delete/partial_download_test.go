@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestDownloadProgress(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "partial-download-test")
+	defer os.RemoveAll(tempDir)
+	toFile := path.Join(tempDir, "media.mxf")
+
+	if loadPartialDownloadState(toFile) != nil {
+		t.Error("expected no state before anything was downloaded")
+	}
+
+	file, _ := os.Create(partFilenameFor(toFile))
+	defer file.Close()
+	progress := newDownloadProgress(toFile, file, partialDownloadState{ETag: `"abc"`, Size: 300, PartSize: 100, CompletedParts: []int{}})
+	progress.MarkComplete(2)
+	progress.MarkComplete(0)
+
+	state := loadPartialDownloadState(toFile)
+	if state == nil || state.ETag != `"abc"` || !reflect.DeepEqual(state.CompletedParts, []int{0, 2}) {
+		t.Errorf("got incorrect state %v", state)
+	}
+
+	resumed := newDownloadProgress(toFile, file, *state)
+	if !resumed.IsComplete(2) || resumed.IsComplete(1) {
+		t.Error("resumed progress did not pick up the completed parts")
+	}
+
+	discardPartialDownload(toFile)
+	if _, err := os.Stat(partFilenameFor(toFile)); !os.IsNotExist(err) {
+		t.Error("part file was not removed")
+	}
+	if loadPartialDownloadState(toFile) != nil {
+		t.Error("sidecar was not removed")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+/**
+controls how large objects are downloaded. Objects bigger than PartSize are fetched as byte ranges of that size,
+PartThreads at a time.
+*/
+type DownloadOptions struct {
+	PartSize    int64
+	PartThreads int
+	//upload part sizes to try when checking a multipart ETag, see etagHasher
+	EtagPartSizes []int64
+	//if set, every download shares this limit on the total download speed
+	Limiter *bandwidthLimiter
+	//what to do about existing local files that are not copies of the object, see resolveLocalPath
+	OnConflict ConflictPolicy
+	//if set, every conflict is recorded here
+	Conflicts *csvLog
+	//if set, every download waits for room on the download volume once it knows how much it still has to fetch
+	DiskGuard *diskSpaceGuard
+}
+
+/**
+an inclusive range of bytes within an object, as used by the HTTP Range header
+*/
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r byteRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+func (r byteRange) Header() string {
+	return fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
+}
+
+/**
+splits an object of the given size into ranges of at most partSize bytes
+*/
+func planRanges(size int64, partSize int64) []byteRange {
+	ranges := make([]byteRange, 0, size/partSize+1)
+	for start := int64(0); start < size; start += partSize {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		ranges = append(ranges, byteRange{Start: start, End: end})
+	}
+	return ranges
+}
+
+/**
+writes sequentially into a file starting at the given offset, so that several ranges can be written into the
+same file at once
+*/
+type sectionWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *sectionWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+/**
+downloads one range of the object into the right place in the file. The ETag is given as IfMatch so that if the
+object is replaced part way through, we get an error rather than a file made of two different objects.
+*/
+func downloadRange(s3Client *s3.Client, bucket string, key string, etag string, part byteRange, to io.Writer, limiter *bandwidthLimiter) error {
+	response, getErr := s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		Range:   aws.String(part.Header()),
+		IfMatch: aws.String(etag),
+	})
+	if getErr != nil {
+		return getErr
+	}
+	defer response.Body.Close()
+
+	var body io.Reader = response.Body
+	if limiter != nil {
+		body = &throttledReader{from: response.Body, limiter: limiter}
+	}
+	bytesCopied, copyErr := io.Copy(to, body)
+	if copyErr != nil {
+		return copyErr
+	}
+	if bytesCopied != part.Length() {
+		return fmt.Errorf("range %s gave %d bytes, expected %d", part.Header(), bytesCopied, part.Length())
+	}
+	return nil
+}
+
+/**
+downloads the given ranges of an object into a file that has already been created at the full size, using up to
+options.PartThreads concurrent requests. Ranges that progress already has are skipped, and each one is recorded
+in progress as it completes. Each range is retried a few times before giving up on the whole file.
+If tee is given then there must only be one range, and the data is also written to tee as it arrives. Returns
+true if tee saw all of the data; after a retry it would have seen some of it twice, so it is abandoned.
+*/
+func downloadRanges(s3Client *s3.Client, bucket string, key string, etag string, ranges []byteRange, file *os.File, progress *downloadProgress, tee io.Writer, options DownloadOptions) (bool, error) {
+	rangeCh := make(chan int, len(ranges))
+	for partIdx := range ranges {
+		if progress.IsComplete(partIdx) {
+			continue
+		}
+		rangeCh <- partIdx
+	}
+	close(rangeCh)
+
+	errCh := make(chan error, options.PartThreads)
+	waitGroup := &sync.WaitGroup{}
+	teeComplete := tee != nil
+	for i := 0; i < options.PartThreads; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for partIdx := range rangeCh {
+				part := ranges[partIdx]
+				var rangeErr error
+				for attempt := 1; attempt <= 3; attempt++ {
+					var to io.Writer = &sectionWriter{file: file, offset: part.Start}
+					if tee != nil && attempt == 1 {
+						to = io.MultiWriter(to, tee)
+					}
+					rangeErr = downloadRange(s3Client, bucket, key, etag, part, to, options.Limiter)
+					if rangeErr == nil {
+						break
+					}
+					teeComplete = false
+					log.Printf("WARNING downloadRanges attempt %d at %s of %s:%s failed: %s", attempt, part.Header(), bucket, key, rangeErr)
+				}
+				if rangeErr == nil {
+					rangeErr = progress.MarkComplete(partIdx)
+				}
+				if rangeErr != nil {
+					errCh <- rangeErr
+					return
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	select {
+	case err := <-errCh:
+		return false, err
+	default:
+		return teeComplete, nil
+	}
+}
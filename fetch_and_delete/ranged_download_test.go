@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanRanges(t *testing.T) {
+	ranges := planRanges(250, 100)
+	expected := []byteRange{{Start: 0, End: 99}, {Start: 100, End: 199}, {Start: 200, End: 249}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("got incorrect ranges %v", ranges)
+	}
+	if ranges[2].Header() != "bytes=200-249" || ranges[2].Length() != 50 {
+		t.Errorf("got incorrect header %s or length %d", ranges[2].Header(), ranges[2].Length())
+	}
+
+	if exact := planRanges(200, 100); len(exact) != 2 || exact[1].End != 199 {
+		t.Errorf("got incorrect ranges for an exact multiple %v", exact)
+	}
+	if empty := planRanges(0, 100); len(empty) != 0 {
+		t.Errorf("expected no ranges for an empty object, got %v", empty)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+returned by performDownload if the object has gone to GLACIER or DEEP_ARCHIVE and has not been restored, so it
+can't be downloaded until a restore is requested and has finished
+*/
+var ObjectArchived = errors.New("object is in an archive storage class and has not been restored")
+
+/**
+returned by performDownload if the object has gone to GLACIER or DEEP_ARCHIVE and a restore has been requested but
+has not finished yet
+*/
+var RestoreInProgress = errors.New("object is being restored from archive")
+
+/**
+works out whether an object can be downloaded from its HeadObject response. Objects in GLACIER and DEEP_ARCHIVE
+can only be downloaded once a restore has finished, which S3 tells us about in the x-amz-restore header: it says
+ongoing-request="true" while a restore is running and ongoing-request="false" once the restored copy is available.
+*/
+func checkArchiveState(head *s3.HeadObjectOutput) error {
+	if head.StorageClass != types.StorageClassGlacier && head.StorageClass != types.StorageClassDeepArchive {
+		return nil
+	}
+	restore := aws.ToString(head.Restore)
+	switch {
+	case strings.Contains(restore, `ongoing-request="false"`):
+		return nil
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return RestoreInProgress
+	default:
+		return ObjectArchived
+	}
+}
+
+func ParseRestoreTier(from string) (types.Tier, error) {
+	for _, tier := range []types.Tier{types.TierBulk, types.TierStandard, types.TierExpedited} {
+		if strings.EqualFold(from, string(tier)) {
+			return tier, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' is not a restore tier, expected bulk, standard or expedited", from)
+}
+
+/**
+controls how the fetcher restores archived objects
+*/
+type RestoreOptions struct {
+	Tier types.Tier
+	//how many days the restored copy is kept for
+	Days int32
+	//where the pending restores are recorded, so that the next run knows what has already been requested
+	StateFile    string
+	PollInterval time.Duration
+	//how long to keep waiting for restores once everything else has been done. 0 means don't wait, and leave them
+	//for the next run
+	Wait time.Duration
+}
+
+/**
+a restore that has been requested, as recorded in the state file
+*/
+type pendingRestore struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	Tier        string    `json:"tier"`
+	RequestedAt time.Time `json:"requestedAt"`
+	//the entry to fetch once the restore has finished. It is not saved, so restores that are loaded from the state
+	//file are only waited for if the same object comes up again in this run
+	entry *models.FoundEntry
+}
+
+func restoreId(bucket string, key string) string {
+	return bucket + ":" + key
+}
+
+/**
+keeps track of archived objects that are being restored, so that the fetcher can get on with other items in the
+meantime. Restores are requested with Request, which records them in the state file; Run checks on them with
+HeadObject and sends the entries for the ones that have finished to readyCh, so that they can be fetched.
+*/
+type restoreTracker struct {
+	s3Client *s3.Client
+	options  RestoreOptions
+	//unbuffered, so that an entry is always either waiting here or has been taken by the fetcher
+	readyCh chan *models.FoundEntry
+
+	mutex   sync.Mutex
+	pending map[string]*pendingRestore
+	//the number of finished restores that are being handed back on readyCh
+	handingBack int
+}
+
+func newRestoreTracker(s3Client *s3.Client, options RestoreOptions) (*restoreTracker, error) {
+	tracker := &restoreTracker{
+		s3Client: s3Client,
+		options:  options,
+		readyCh:  make(chan *models.FoundEntry),
+		pending:  make(map[string]*pendingRestore),
+	}
+
+	dirErr := os.MkdirAll(path.Dir(options.StateFile), 0755)
+	if dirErr != nil {
+		return nil, dirErr
+	}
+	content, readErr := ioutil.ReadFile(options.StateFile)
+	if readErr != nil {
+		if os.IsNotExist(readErr) {
+			return tracker, nil
+		}
+		return nil, readErr
+	}
+	var saved []*pendingRestore
+	unmarshalErr := json.Unmarshal(content, &saved)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("restore state file %s is corrupt: %s", options.StateFile, unmarshalErr)
+	}
+	for _, restore := range saved {
+		tracker.pending[restoreId(restore.Bucket, restore.Key)] = restore
+	}
+	if len(saved) > 0 {
+		log.Printf("INFO restoreTracker %d restores were requested by earlier runs", len(saved))
+	}
+	return tracker, nil
+}
+
+/**
+starts a restore of the given entry's object and waits for it to finish. alreadyRunning should be set if S3 says
+that a restore is already underway, in which case it is only waited for.
+*/
+func (t *restoreTracker) Request(entry *models.FoundEntry, alreadyRunning bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	id := restoreId(entry.Bucket, entry.Path)
+	existing, alreadyRequested := t.pending[id]
+	if alreadyRequested {
+		existing.entry = entry
+	} else {
+		existing = &pendingRestore{Bucket: entry.Bucket, Key: entry.Path, Tier: string(t.options.Tier), RequestedAt: time.Now(), entry: entry}
+		t.pending[id] = existing
+	}
+
+	if !alreadyRunning {
+		log.Printf("INFO restoreTracker requesting %s restore of %s for %d days", t.options.Tier, id, t.options.Days)
+		_, restoreErr := t.s3Client.RestoreObject(context.Background(), &s3.RestoreObjectInput{
+			Bucket: aws.String(entry.Bucket),
+			Key:    aws.String(entry.Path),
+			RestoreRequest: &types.RestoreRequest{
+				Days:                 t.options.Days,
+				GlacierJobParameters: &types.GlacierJobParameters{Tier: t.options.Tier},
+			},
+		})
+		var alreadyActive *types.ObjectAlreadyInActiveTierError
+		if restoreErr != nil && !errors.As(restoreErr, &alreadyActive) {
+			delete(t.pending, id)
+			return restoreErr
+		}
+		existing.RequestedAt = time.Now()
+	} else {
+		log.Printf("INFO restoreTracker %s is already being restored, waiting for it", id)
+	}
+	return t.save()
+}
+
+/**
+returns the number of restores that this run is waiting for, including finished ones that have not been handed
+back yet
+*/
+func (t *restoreTracker) Waiting() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	count := t.handingBack
+	for _, restore := range t.pending {
+		if restore.entry != nil {
+			count++
+		}
+	}
+	return count
+}
+
+/**
+checks on every restore that this run is waiting for, sending the ones that have finished to readyCh
+*/
+func (t *restoreTracker) Poll(stopCh chan struct{}) {
+	t.mutex.Lock()
+	waiting := make([]*pendingRestore, 0, len(t.pending))
+	for _, restore := range t.pending {
+		if restore.entry != nil {
+			waiting = append(waiting, restore)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, restore := range waiting {
+		head, headErr := t.s3Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+			Bucket: aws.String(restore.Bucket),
+			Key:    aws.String(restore.Key),
+		})
+		if headErr != nil {
+			log.Printf("WARNING restoreTracker can't check on %s, will try again: %s", restoreId(restore.Bucket, restore.Key), headErr)
+			continue
+		}
+		state := checkArchiveState(head)
+		if state == RestoreInProgress {
+			continue
+		}
+		if state == ObjectArchived {
+			log.Printf("WARNING restoreTracker the restored copy of %s has expired or the restore was abandoned, requesting it again", restoreId(restore.Bucket, restore.Key))
+		} else {
+			log.Printf("INFO restoreTracker %s has been restored after %s", restoreId(restore.Bucket, restore.Key), time.Since(restore.RequestedAt).Round(time.Minute))
+		}
+
+		t.mutex.Lock()
+		delete(t.pending, restoreId(restore.Bucket, restore.Key))
+		t.handingBack++
+		saveErr := t.save()
+		t.mutex.Unlock()
+		if saveErr != nil {
+			log.Printf("ERROR restoreTracker could not update %s: %s", t.options.StateFile, saveErr)
+		}
+		select {
+		case t.readyCh <- restore.entry:
+		case <-stopCh:
+		}
+		t.mutex.Lock()
+		t.handingBack--
+		t.mutex.Unlock()
+	}
+}
+
+/**
+polls the restores every PollInterval until stopCh is closed
+*/
+func (t *restoreTracker) Run(stopCh chan struct{}) {
+	ticker := time.NewTicker(t.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			t.Poll(stopCh)
+		}
+	}
+}
+
+/**
+writes out the state file, via a temporary file so that it is never seen half-written. Must be called with the
+mutex held
+*/
+func (t *restoreTracker) save() error {
+	saved := make([]*pendingRestore, 0, len(t.pending))
+	for _, restore := range t.pending {
+		saved = append(saved, restore)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return restoreId(saved[i].Bucket, saved[i].Key) < restoreId(saved[j].Bucket, saved[j].Key)
+	})
+	content, marshalErr := json.MarshalIndent(saved, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	tempName := t.options.StateFile + ".tmp"
+	writeErr := ioutil.WriteFile(tempName, content, 0640)
+	if writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tempName, t.options.StateFile)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckArchiveState(t *testing.T) {
+	tests := []struct {
+		storageClass types.StorageClass
+		restore      string
+		expected     error
+	}{
+		{types.StorageClassStandard, "", nil},
+		{"", "", nil},
+		{types.StorageClassGlacier, "", ObjectArchived},
+		{types.StorageClassDeepArchive, "", ObjectArchived},
+		{types.StorageClassDeepArchive, `ongoing-request="true"`, RestoreInProgress},
+		{types.StorageClassGlacier, `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`, nil},
+	}
+	for _, test := range tests {
+		head := &s3.HeadObjectOutput{StorageClass: test.storageClass}
+		if test.restore != "" {
+			head.Restore = aws.String(test.restore)
+		}
+		result := checkArchiveState(head)
+		if result != test.expected {
+			t.Errorf("%s with restore '%s' gave %v, expected %v", test.storageClass, test.restore, result, test.expected)
+		}
+	}
+}
+
+func TestParseRestoreTier(t *testing.T) {
+	tier, err := ParseRestoreTier("Bulk")
+	if err != nil || tier != types.TierBulk {
+		t.Errorf("got %s %v for Bulk", tier, err)
+	}
+	tier, err = ParseRestoreTier("expedited")
+	if err != nil || tier != types.TierExpedited {
+		t.Errorf("got %s %v for expedited", tier, err)
+	}
+	_, err = ParseRestoreTier("instant")
+	if err == nil {
+		t.Error("expected an unknown tier to be rejected")
+	}
+}
+
+func newTestRestoreTracker(t *testing.T, stateFile string, wait time.Duration) *restoreTracker {
+	tracker, err := newRestoreTracker(nil, RestoreOptions{Tier: types.TierBulk, Days: 1, StateFile: stateFile, PollInterval: time.Hour, Wait: wait})
+	if err != nil {
+		t.Fatal("could not create tracker: ", err)
+	}
+	return tracker
+}
+
+func TestRestoreTrackerState(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "restore-tracker-test")
+	defer os.RemoveAll(tempDir)
+	stateFile := path.Join(tempDir, "state", "pending-restores.json")
+
+	tracker := newTestRestoreTracker(t, stateFile, 0)
+	//a restore that S3 says is already running is only waited for, so this doesn't need a client
+	err := tracker.Request(&models.FoundEntry{Bucket: "bucket", Path: "archived.mxf"}, true)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if tracker.Waiting() != 1 {
+		t.Errorf("expected to be waiting for 1 restore, got %d", tracker.Waiting())
+	}
+
+	reloaded := newTestRestoreTracker(t, stateFile, 0)
+	if len(reloaded.pending) != 1 || reloaded.pending["bucket:archived.mxf"] == nil {
+		t.Errorf("restore was not saved, got %v", reloaded.pending)
+	}
+	//restores from earlier runs are only waited for if they come up again
+	if reloaded.Waiting() != 0 {
+		t.Errorf("expected not to be waiting for restores from earlier runs, got %d", reloaded.Waiting())
+	}
+	reloaded.Request(&models.FoundEntry{Bucket: "bucket", Path: "archived.mxf"}, true)
+	if reloaded.Waiting() != 1 || len(reloaded.pending) != 1 {
+		t.Errorf("expected the earlier restore to be picked up, got %d waiting of %d", reloaded.Waiting(), len(reloaded.pending))
+	}
+}
+
+/**
+stands in for the fetcher workers, putting the entries in archivedPaths into the tracker as RestoreInProgress would
+*/
+func fakeWorker(fetcher *itemFetcher, workerCh chan *models.FoundEntry, archivedPaths map[string]bool, fetchedCh chan string) {
+	for rec := range workerCh {
+		if archivedPaths[rec.Path] {
+			delete(archivedPaths, rec.Path)
+			fetcher.restores.Request(rec, true)
+		} else {
+			fetchedCh <- rec.Path
+		}
+		atomic.AddInt64(&fetcher.outstanding, -1)
+	}
+}
+
+func TestDispatchEntriesWaitsForRestores(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "restore-tracker-test")
+	defer os.RemoveAll(tempDir)
+
+	fetcher := &itemFetcher{restores: newTestRestoreTracker(t, path.Join(tempDir, "pending-restores.json"), time.Hour)}
+	inputCh := make(chan *models.FoundEntry, 10)
+	workerCh := make(chan *models.FoundEntry, 10)
+	fetchedCh := make(chan string, 10)
+	inputCh <- &models.FoundEntry{Bucket: "bucket", Path: "standard.mxf"}
+	inputCh <- &models.FoundEntry{Bucket: "bucket", Path: "archived.mxf"}
+	inputCh <- nil
+	go fakeWorker(fetcher, workerCh, map[string]bool{"archived.mxf": true}, fetchedCh)
+
+	doneCh := make(chan struct{})
+	go func() {
+		dispatchEntries(fetcher, inputCh, workerCh)
+		close(doneCh)
+	}()
+
+	if fetched := <-fetchedCh; fetched != "standard.mxf" {
+		t.Errorf("expected standard.mxf to be fetched first, got %s", fetched)
+	}
+	select {
+	case <-doneCh:
+		t.Fatal("dispatchEntries finished while a restore was still pending")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	//as Poll does when the restore finishes
+	fetcher.restores.mutex.Lock()
+	restore := fetcher.restores.pending["bucket:archived.mxf"]
+	delete(fetcher.restores.pending, "bucket:archived.mxf")
+	fetcher.restores.handingBack++
+	fetcher.restores.mutex.Unlock()
+	fetcher.restores.readyCh <- restore.entry
+	fetcher.restores.mutex.Lock()
+	fetcher.restores.handingBack--
+	fetcher.restores.mutex.Unlock()
+
+	if fetched := <-fetchedCh; fetched != "archived.mxf" {
+		t.Errorf("expected archived.mxf to be fetched once restored, got %s", fetched)
+	}
+	select {
+	case <-doneCh:
+	case <-time.After(3 * time.Second):
+		t.Error("dispatchEntries did not finish once the restore had been fetched")
+	}
+}
+
+func TestDispatchEntriesGivesUpWaiting(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "restore-tracker-test")
+	defer os.RemoveAll(tempDir)
+
+	fetcher := &itemFetcher{restores: newTestRestoreTracker(t, path.Join(tempDir, "pending-restores.json"), 0)}
+	inputCh := make(chan *models.FoundEntry, 10)
+	workerCh := make(chan *models.FoundEntry, 10)
+	inputCh <- &models.FoundEntry{Bucket: "bucket", Path: "archived.mxf"}
+	inputCh <- nil
+	go fakeWorker(fetcher, workerCh, map[string]bool{"archived.mxf": true}, make(chan string, 10))
+
+	doneCh := make(chan struct{})
+	go func() {
+		dispatchEntries(fetcher, inputCh, workerCh)
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(3 * time.Second):
+		t.Error("dispatchEntries did not give up waiting with a wait of 0")
+	}
+	if len(fetcher.restores.pending) != 1 {
+		t.Error("expected the restore to be left in the state for the next run")
+	}
+}
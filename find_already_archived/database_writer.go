@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"log"
+)
+
+/**
+passes every record straight through, recording it in the results database at the given path as it goes
+*/
+func AsyncDatabaseWriter(filename string, info models.ScanRunInfo, inputCh chan *models.LookupResult) (chan *models.LookupResult, chan error) {
+	outputCh := make(chan *models.LookupResult, 100)
+	errCh := make(chan error, 1)
+
+	go func() {
+		db, openErr := models.OpenResultsDatabase(filename)
+		if openErr != nil {
+			log.Printf("ERROR can't open results database %s: %s", filename, openErr)
+			errCh <- openErr
+			return
+		}
+		defer db.Close()
+
+		writer, writerErr := models.NewResultsDatabaseWriter(db, info)
+		if writerErr != nil {
+			log.Printf("ERROR can't start scan run in %s: %s", filename, writerErr)
+			errCh <- writerErr
+			return
+		}
+
+		for {
+			rec := <-inputCh
+			if rec == nil {
+				finishErr := writer.Finish()
+				if finishErr != nil {
+					errCh <- finishErr
+					return
+				}
+				log.Print("INFO AsyncDatabaseWriter reached end of stream, terminating")
+				outputCh <- nil
+				return
+			}
+
+			err := writer.Write(rec)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			outputCh <- rec
+		}
+	}()
+	return outputCh, errCh
+}
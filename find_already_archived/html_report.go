@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"html/template"
+	"math"
+	"time"
+)
+
+const htmlReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Holding pen summary for {{.Bucket}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>Holding pen summary for {{.Bucket}}</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}</p>
+
+<h2>Totals</h2>
+<table>
+<tr><th></th><th>Files</th><th>Size</th></tr>
+<tr><td>Scanned</td><td>{{.Summary.Total.Files}}</td><td>{{humanSize .Summary.Total.Bytes}}</td></tr>
+<tr><td>Already archived (reclaimable)</td><td>{{.Summary.Total.MatchedFiles}}</td><td>{{humanSize .Summary.Total.MatchedBytes}}</td></tr>
+<tr><td>Not archived</td><td>{{.Summary.Total.UnmatchedFiles}}</td><td>{{humanSize .Summary.Total.UnmatchedBytes}}</td></tr>
+</table>
+<p>{{printf "%.1f" .Summary.Total.MatchedPercent}}% of the holding pen by size is already archived.</p>
+
+{{define "aggregateTable"}}
+<table>
+<tr><th>{{.Title}}</th><th>Files</th><th>Size</th><th>Archived files</th><th>Archived size</th><th>Not archived size</th><th>Archived %</th></tr>
+{{range .Rows}}<tr><td>{{.Name}}</td><td>{{.Files}}</td><td>{{humanSize .Bytes}}</td><td>{{.MatchedFiles}}</td><td>{{humanSize .MatchedBytes}}</td><td>{{humanSize .UnmatchedBytes}}</td><td>{{printf "%.1f" .MatchedPercent}}</td></tr>
+{{end}}</table>
+{{end}}
+
+<h2>By top-level folder</h2>
+{{template "aggregateTable" (table "Folder" .Summary.SortedFolders)}}
+
+<h2>By archive bucket</h2>
+<p>A file that is archived in more than one bucket is counted against each of them.</p>
+{{template "aggregateTable" (table "Bucket" .Summary.SortedBuckets)}}
+
+<h2>By file extension</h2>
+{{template "aggregateTable" (table "Extension" .Summary.SortedExtensions)}}
+
+<h2>Largest files that are not archived</h2>
+<table>
+<tr><th>File</th><th>Size</th><th>Storage class</th><th>Last modified</th></tr>
+{{range .Summary.LargestUnmatched}}<tr><td>{{.RequestedFile}}</td><td>{{humanSize .RequestedFileSize}}</td><td>{{.RequestedFileStorageClass}}</td><td>{{if not .RequestedFileLastModified.IsZero}}{{.RequestedFileLastModified.Format "2006-01-02"}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`
+
+/**
+formats a byte count in the largest sensible binary unit
+*/
+func humanSize(bytes int64) string {
+	units := []string{"bytes", "Kb", "Mb", "Gb", "Tb", "Pb"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", bytes, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", math.Round(value*10)/10, units[unit])
+}
+
+type aggregateTableData struct {
+	Title string
+	Rows  []*SummaryAggregate
+}
+
+/**
+renders the given summary as a standalone HTML page at the given local path or s3:// URI
+*/
+func WriteHtmlReport(s3Client *s3.Client, filename string, bucket string, summary *ReportSummary) error {
+	tmpl, parseErr := template.New("report").Funcs(template.FuncMap{
+		"humanSize": humanSize,
+		"table": func(title string, rows []*SummaryAggregate) aggregateTableData {
+			return aggregateTableData{Title: title, Rows: rows}
+		},
+	}).Parse(htmlReportTemplate)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	dest, openErr := models.CreateReport(s3Client, filename)
+	if openErr != nil {
+		return openErr
+	}
+
+	execErr := tmpl.Execute(dest, map[string]interface{}{
+		"Bucket":    bucket,
+		"Generated": time.Now(),
+		"Summary":   summary,
+	})
+	if execErr != nil {
+		dest.Abort()
+		return execErr
+	}
+	return dest.Close()
+}
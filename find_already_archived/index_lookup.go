@@ -7,7 +7,6 @@ import (
 	"github.com/guardian/multimedia-holding-pen-utils/models"
 	"github.com/olivere/elastic"
 	"log"
-	"net/url"
 	"sync"
 )
 
@@ -53,7 +52,7 @@ func lookupProcessor(esClient *elastic.Client,
 			return
 		}
 
-		decodedFilename, decodeErr := url.QueryUnescape(*rec.Key)
+		decodedFilename, decodeErr := models.DecodeListedKey(*rec.Key)
 		if decodeErr != nil {
 			log.Printf("ERROR lookupProcessor can't urldecode '%s': %s", *rec.Key, decodeErr)
 			continue
@@ -77,15 +76,27 @@ func lookupProcessor(esClient *elastic.Client,
 			} else {
 				entryList[i].Bucket = archiveEntry.Bucket
 				entryList[i].Path = archiveEntry.Path
+				entryList[i].Region = archiveEntry.Region
 				entryList[i].Size = archiveEntry.Size
+				entryList[i].StorageClass = archiveEntry.StorageClass
+				entryList[i].LastModified = archiveEntry.LastModified
+				entryList[i].ArchiveId = archiveEntry.Id
+				if entryList[i].ArchiveId == "" {
+					entryList[i].ArchiveId = hit.Id
+				}
+				entryList[i].Proxied = archiveEntry.Proxied
 			}
 		}
 
 		result := &models.LookupResult{
-			RequestedFile:     decodedFilename,
-			RequestedFileSize: rec.Size,
-			Count:             response.TotalHits(),
-			Entries:           entryList,
+			RequestedFile:             decodedFilename,
+			RequestedFileSize:         rec.Size,
+			RequestedFileStorageClass: string(rec.StorageClass),
+			Count:                     response.TotalHits(),
+			Entries:                   entryList,
+		}
+		if rec.LastModified != nil {
+			result.RequestedFileLastModified = *rec.LastModified
 		}
 		outputCh <- result
 	}
@@ -5,9 +5,9 @@ import (
 	"flag"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
 	"github.com/olivere/elastic"
 	"log"
-	"math"
 	"strings"
 	"time"
 )
@@ -20,8 +20,20 @@ func main() {
 	excludeBucketsPtr := flag.String("exclude", "", "comma-separated list of buckets to exclude")
 	desiredThreadsPtr := flag.Int("threads", 4, "number of concurrent lookups to perform")
 	proxyBucketPtr := flag.String("proxy", "proxies", "name of bucket to look for proxies in")
-	outputFilePtr := flag.String("out", "holding-pen.csv", "CSV report to write")
+	outputFilePtr := flag.String("out", "holding-pen.csv", "report to write, either a local file, an s3:// URI or - for stdout")
+	outputFormatPtr := flag.String("format", "auto", "report format to write, csv or jsonl. auto picks the format from the -out file extension")
+	proxyIndexPtr := flag.Bool("proxy-index", false, "list the whole proxy bucket once at startup and locate proxies from memory, rather than making a request per file")
+	proxyIndexMaxAgePtr := flag.String("proxy-index-maxage", "6h", "rebuild the proxy index once it gets older than this. Set to 0 to never rebuild")
+	validateProxiesPtr := flag.Bool("validate-proxies", true, "check that proxies of archived items are not empty, truncated or unplayable and flag the ones that are in the report")
+	proxyMinSizePtr := flag.Int64("proxy-min-size", 1024, "proxies smaller than this many bytes are flagged as invalid")
+	needsProxyFilePtr := flag.String("needs-proxy", "", "if set, write a JSON-lines list of archive copies that have no usable proxy to this file")
+	needsProxyUnproxiedOnlyPtr := flag.Bool("needs-proxy-unproxied-only", false, "only list archive copies in the needs-proxy output if the archive index also says that they are not proxied")
+	databaseFilePtr := flag.String("db", "", "if set, also record every result in the SQLite database at this path")
+	shardCountPtr := flag.Int("shards", 0, "if more than 1, split the report into this many shard files with a manifest, so that separate fetch_and_delete runs can work on them")
+	shardByPtr := flag.String("shard-by", models.ShardByCount, "how to split up a sharded report: count (equal numbers of files), bytes (equal sizes) or prefix (keep top-level folders together)")
+	htmlReportPtr := flag.String("html", "", "if set, write an HTML summary of the scan to this file at the end")
 	flag.Parse()
+	startTime := time.Now()
 
 	s3config, confErr := awsconfig.LoadDefaultConfig(context.Background())
 	if confErr != nil {
@@ -33,6 +45,22 @@ func main() {
 		log.Fatalf("Could not parse '%s' as a duration: %s", *timeoutStringPtr, tParseErr)
 	}
 
+	outputFormat, formatErr := models.ReportFormatForFilename(*outputFilePtr, *outputFormatPtr)
+	if formatErr != nil {
+		log.Fatal("Could not determine report format: ", formatErr)
+	}
+
+	shardOptions := models.ShardOptions{Count: *shardCountPtr, Strategy: *shardByPtr}
+	if shardErr := shardOptions.Validate(); shardErr != nil {
+		log.Fatal("Invalid sharding options: ", shardErr)
+	}
+	if shardOptions.Enabled() && models.IsStdioLocation(*outputFilePtr) {
+		log.Fatal("Can't shard a report that is being written to stdout")
+	}
+	if shardOptions.Enabled() {
+		log.Printf("INFO Splitting the report into %d shards by %s, manifest will be %s", shardOptions.Count, shardOptions.Strategy, models.ShardManifestLocation(*outputFilePtr))
+	}
+
 	excludeBuckets := strings.Split(*excludeBucketsPtr, ",")
 
 	if *excludeBucketsPtr == "" {
@@ -53,48 +81,69 @@ func main() {
 
 	s3Client := s3.NewFromConfig(s3config)
 
-	s3ObjectCh, errCh := AsyncReadBucket(s3Client, *targetBucketPtr, timeout)
+	var proxySource ProxySource
+	var proxyIndex *ProxyIndex
+	if *proxyIndexPtr {
+		maxAge, maParseErr := time.ParseDuration(*proxyIndexMaxAgePtr)
+		if maParseErr != nil {
+			log.Fatalf("Could not parse '%s' as a duration: %s", *proxyIndexMaxAgePtr, maParseErr)
+		}
+		var indexErr error
+		proxyIndex, indexErr = NewProxyIndex(s3Client, *proxyBucketPtr, timeout, maxAge)
+		if indexErr != nil {
+			log.Fatal("Could not build proxy index: ", indexErr)
+		}
+		proxySource = proxyIndex
+	} else {
+		proxySource = NewLiveProxySource(s3Client, *proxyBucketPtr, timeout)
+	}
+
+	s3ObjectCh, errCh := models.AsyncReadBucket(s3Client, *targetBucketPtr, timeout)
 	lookedUpCh, lookupErrCh := AsyncIndexLookup(esClient, *indexNamePtr, *targetBucketPtr, *desiredThreadsPtr, &excludeBuckets, s3ObjectCh)
-	proxyLocatedCh, locatorErrCh := AsyncLocateProxy(s3Client, lookedUpCh, *proxyBucketPtr, 10)
-	writerErrCh := AsyncOutputWriter(*outputFilePtr, true, proxyLocatedCh)
+	proxyLocatedCh, locatorErrCh := AsyncLocateProxy(proxySource, lookedUpCh, 10)
+	var validatedCh chan *models.LookupResult
+	var validatorErrCh chan error
+	if *validateProxiesPtr {
+		validator := NewProxyValidator(s3Client, *proxyMinSizePtr, timeout)
+		validatedCh, validatorErrCh = AsyncValidateProxies(validator, proxyLocatedCh, 10)
+	} else {
+		validatedCh = proxyLocatedCh
+		validatorErrCh = make(chan error, 1)
+	}
+	var needsProxyCh chan *models.LookupResult
+	var needsProxyErrCh chan error
+	if *needsProxyFilePtr != "" {
+		needsProxyCh, needsProxyErrCh = AsyncNeedsProxyWriter(s3Client, *needsProxyFilePtr, *needsProxyUnproxiedOnlyPtr, validatedCh)
+	} else {
+		needsProxyCh = validatedCh
+		needsProxyErrCh = make(chan error, 1)
+	}
+	var databaseCh chan *models.LookupResult
+	var databaseErrCh chan error
+	if *databaseFilePtr != "" {
+		runInfo := models.ScanRunInfo{
+			TargetBucket:    *targetBucketPtr,
+			IndexName:       *indexNamePtr,
+			ProxyBucket:     *proxyBucketPtr,
+			ExcludedBuckets: excludeBuckets,
+		}
+		databaseCh, databaseErrCh = AsyncDatabaseWriter(*databaseFilePtr, runInfo, needsProxyCh)
+	} else {
+		databaseCh = needsProxyCh
+		databaseErrCh = make(chan error, 1)
+	}
+	summary := NewReportSummary(50)
+	summarisedCh := AsyncSummaryCollector(summary, databaseCh)
+	writerErrCh := AsyncOutputWriter(s3Client, *outputFilePtr, outputFormat, shardOptions, true, summarisedCh)
 
-	var totalSize int64 = 0
-	var fileCount int64 = 0
-	var matchedFiles int64 = 0
-	var matchedSize int64 = 0
+	completed := false
 	func() {
 		for {
 			select {
-			//case file := <-proxyLocatedCh:
-			//	if file == nil {
-			//		log.Print("INFO main All done")
-			//		return
-			//	}
-			//
-			//	//decodedFileName, decodeErr := url.QueryUnescape(*file.Key)
-			//	//if decodeErr != nil {
-			//	//	log.Printf("ERROR could not decode filename '%s': %s", *file.Key, decodeErr)
-			//	//} else {
-			//	//	log.Printf("Got %s in class %s, with size %d", decodedFileName, file.StorageClass, file.Size)
-			//	//}
-			//	//totalSize += file.Size
-			//	bucketsList := make([]string, len(file.Entries))
-			//	for i, e := range file.Entries {
-			//		bucketsList[i] = e.Bucket
-			//	}
-			//
-			//	bucketsListStr := "(" + strings.Join(bucketsList, ",") + ")"
-			//	log.Printf("INFO %s has %d results in %s and %d proxies", file.RequestedFile, file.Count, bucketsListStr, len(file.Proxies))
-			//	totalSize += file.RequestedFileSize
-			//	fileCount++
-			//
-			//	if file.Count > 0 {
-			//		matchedFiles++
-			//		matchedSize += file.RequestedFileSize
-			//	}
 			case err := <-writerErrCh:
 				if err == nil {
 					log.Print("INFO writer reached end of stream, exiting")
+					completed = true
 					return
 				} else {
 					log.Print("ERROR main got error from writer: ", err)
@@ -108,11 +157,45 @@ func main() {
 				return
 			case err := <-locatorErrCh:
 				log.Print("WARNING main got error from AsyncProxyLookup: ", err)
+			case err := <-databaseErrCh:
+				log.Print("ERROR main got error from AsyncDatabaseWriter: ", err)
+				return
+			case err := <-needsProxyErrCh:
+				log.Print("ERROR main got error from AsyncNeedsProxyWriter: ", err)
+				return
+			case err := <-validatorErrCh:
+				log.Print("WARNING main got error from AsyncValidateProxies: ", err)
 			}
 		}
 	}()
 
-	totalSizeInTb := float64(totalSize) / math.Pow(1024.0, 4)
-	matchedSizeInTb := float64(matchedSize) / math.Pow(1024.0, 4)
-	log.Printf("All done, got a total of %0.1fTb in %d files of which %0.1fTb in %d files was matched", totalSizeInTb, fileCount, matchedSizeInTb, matchedFiles)
+	stats := NewRunStats(*targetBucketPtr, startTime, completed, summary)
+	stats.Log()
+	if models.IsStdioLocation(*outputFilePtr) { //there's nowhere alongside stdout to put the stats, so they are only logged
+		log.Print("INFO Report was written to stdout, not writing run stats")
+	} else {
+		statsFile := statsFilenameFor(*outputFilePtr)
+		statsErr := stats.WriteJson(s3Client, statsFile)
+		if statsErr != nil {
+			log.Printf("ERROR Could not write run stats to %s: %s", statsFile, statsErr)
+		} else {
+			log.Printf("INFO Wrote run stats to %s", statsFile)
+		}
+	}
+
+	if *htmlReportPtr != "" && completed {
+		htmlErr := WriteHtmlReport(s3Client, *htmlReportPtr, *targetBucketPtr, summary)
+		if htmlErr != nil {
+			log.Printf("ERROR Could not write HTML summary to %s: %s", *htmlReportPtr, htmlErr)
+		} else {
+			log.Printf("INFO Wrote HTML summary to %s", *htmlReportPtr)
+		}
+	}
+
+	if proxyIndex != nil {
+		hits, misses, rebuilds := proxyIndex.Stats()
+		log.Printf("INFO Proxy index found proxies for %d files and none for %d files, index was built %d times", hits, misses, rebuilds)
+	}
+
+	log.Printf("All done, got a total of %0.1fTb in %d files of which %0.1fTb in %d files was matched", bytesToTb(stats.Total.Bytes), stats.Total.Files, bytesToTb(stats.Total.MatchedBytes), stats.Total.MatchedFiles)
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"log"
+)
+
+/**
+a single archive copy that has no usable proxy, in the form that the proxy-generation job queue expects
+*/
+type NeedsProxyRequest struct {
+	ArchiveId      string `json:"archiveId"`
+	Bucket         string `json:"bucket"`
+	Path           string `json:"path"`
+	Size           int64  `json:"size"`
+	RequestedFile  string `json:"requestedFile"`
+	ArchiveProxied bool   `json:"archiveProxied"`
+}
+
+/**
+returns true if the lookup result has at least one proxy that was not flagged as invalid
+*/
+func hasUsableProxy(rec *models.LookupResult) bool {
+	for _, p := range rec.Proxies {
+		if !p.Invalid {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+builds a list of NeedsProxyRequest for every archive copy in the lookup result, if there is no usable proxy for it.
+if unproxiedOnly is set, then copies that the archive index already believes to be proxied are left out.
+*/
+func needsProxyRequests(rec *models.LookupResult, unproxiedOnly bool) []NeedsProxyRequest {
+	if rec.Count == 0 || hasUsableProxy(rec) {
+		return nil
+	}
+
+	requests := make([]NeedsProxyRequest, 0, len(rec.Entries))
+	for _, e := range rec.Entries {
+		if e.Bucket == "" || (unproxiedOnly && e.Proxied) {
+			continue
+		}
+		requests = append(requests, NeedsProxyRequest{
+			ArchiveId:      e.ArchiveId,
+			Bucket:         e.Bucket,
+			Path:           e.Path,
+			Size:           e.Size,
+			RequestedFile:  rec.RequestedFile,
+			ArchiveProxied: e.Proxied,
+		})
+	}
+	return requests
+}
+
+/**
+passes every record straight through, writing a JSON line to the given file for each archive copy that has no proxy
+*/
+func AsyncNeedsProxyWriter(s3Client *s3.Client, filename string, unproxiedOnly bool, inputCh chan *models.LookupResult) (chan *models.LookupResult, chan error) {
+	outputCh := make(chan *models.LookupResult, 100)
+	errCh := make(chan error, 1)
+
+	go func() {
+		dest, openErr := models.CreateReport(s3Client, filename)
+		if openErr != nil {
+			log.Printf("ERROR can't open %s to write: %s", filename, openErr)
+			errCh <- openErr
+			return
+		}
+
+		writer := bufio.NewWriter(dest)
+		encoder := json.NewEncoder(writer)
+
+		var needsProxyCount int64 = 0
+		for {
+			rec := <-inputCh
+			if rec == nil {
+				log.Printf("INFO AsyncNeedsProxyWriter reached end of stream, found %d archive copies needing proxies", needsProxyCount)
+				flushErr := writer.Flush()
+				if flushErr != nil {
+					dest.Abort()
+					errCh <- flushErr
+					return
+				}
+				closeErr := dest.Close()
+				if closeErr != nil {
+					errCh <- closeErr
+					return
+				}
+				outputCh <- nil
+				return
+			}
+
+			for _, req := range needsProxyRequests(rec, unproxiedOnly) {
+				err := encoder.Encode(&req)
+				if err != nil {
+					dest.Abort()
+					errCh <- err
+					return
+				}
+				needsProxyCount++
+			}
+			outputCh <- rec
+		}
+	}()
+	return outputCh, errCh
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"reflect"
+	"testing"
+)
+
+func TestNeedsProxyRequests(t *testing.T) {
+	valid := models.FoundEntry{Bucket: "proxies", Path: "news/one.mp4", IsProxy: true}
+	invalid := models.FoundEntry{Bucket: "proxies", Path: "news/one_thumb.jpg", IsProxy: true, Invalid: true, InvalidReason: "not a jpeg"}
+	entries := []models.FoundEntry{
+		{ArchiveId: "a1", Bucket: "archive-a", Path: "news/one.mxf", Size: 100, Proxied: true},
+		{ArchiveId: "b1", Bucket: "archive-b", Path: "news/one.mxf", Size: 100},
+		//an entry with no bucket can't have a proxy made for it
+		{ArchiveId: "c1", Path: "news/one.mxf", Size: 100},
+	}
+	allRequests := []NeedsProxyRequest{
+		{ArchiveId: "a1", Bucket: "archive-a", Path: "news/one.mxf", Size: 100, RequestedFile: "news/one.mxf", ArchiveProxied: true},
+		{ArchiveId: "b1", Bucket: "archive-b", Path: "news/one.mxf", Size: 100, RequestedFile: "news/one.mxf"},
+	}
+
+	tests := []struct {
+		name          string
+		count         int64
+		proxies       []models.FoundEntry
+		unproxiedOnly bool
+		usable        bool
+		expected      []NeedsProxyRequest
+	}{
+		{"no proxies", 3, nil, false, false, allRequests},
+		{"only invalid proxies", 3, []models.FoundEntry{invalid, invalid}, false, false, allRequests},
+		{"a mix of valid and invalid proxies", 3, []models.FoundEntry{invalid, valid}, false, true, nil},
+		{"only valid proxies", 3, []models.FoundEntry{valid}, false, true, nil},
+		{"no proxies, unproxiedOnly", 3, nil, true, false, allRequests[1:]},
+		{"only invalid proxies, unproxiedOnly", 3, []models.FoundEntry{invalid}, true, false, allRequests[1:]},
+		{"a mix, unproxiedOnly", 3, []models.FoundEntry{valid, invalid}, true, true, nil},
+		{"not archived", 0, nil, false, false, nil},
+	}
+
+	for _, test := range tests {
+		rec := &models.LookupResult{RequestedFile: "news/one.mxf", Count: test.count, Entries: entries, Proxies: test.proxies}
+		if test.count == 0 {
+			rec.Entries = nil
+		}
+		if usable := hasUsableProxy(rec); usable != test.usable {
+			t.Errorf("%s: hasUsableProxy gave %v, expected %v", test.name, usable, test.usable)
+		}
+		result := needsProxyRequests(rec, test.unproxiedOnly)
+		if len(result) != len(test.expected) || (len(result) > 0 && !reflect.DeepEqual(result, test.expected)) {
+			t.Errorf("%s: got requests %+v, expected %+v", test.name, result, test.expected)
+		}
+	}
+}
@@ -1,46 +1,94 @@
 package main
 
 import (
-	"encoding/csv"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/guardian/multimedia-holding-pen-utils/models"
 	"log"
-	"os"
 )
 
-func AsyncOutputWriter(filename string, onlyWithDupes bool, inputCh chan *models.LookupResult) chan error {
+/**
+somewhere that report records are written to, either a single report or a set of shards
+*/
+type reportOutput interface {
+	Write(rec *models.LookupResult) error
+	Finish() error
+	Abort()
+}
+
+type singleReportOutput struct {
+	dest            models.ReportDestination
+	writer          models.ReportWriter
+	flushEachRecord bool
+}
+
+func (o *singleReportOutput) Write(rec *models.LookupResult) error {
+	writeErr := o.writer.Write(rec)
+	if writeErr != nil || !o.flushEachRecord {
+		return writeErr
+	}
+	return o.writer.Flush()
+}
+
+func (o *singleReportOutput) Finish() error {
+	finishErr := o.writer.Finish()
+	if finishErr != nil {
+		o.dest.Abort()
+		return finishErr
+	}
+	return o.dest.Close()
+}
+
+func (o *singleReportOutput) Abort() {
+	o.dest.Abort()
+}
+
+func openReportOutput(s3Client *s3.Client, filename string, format string, shards models.ShardOptions) (reportOutput, error) {
+	if shards.Enabled() {
+		return models.CreateShardedReport(s3Client, filename, format, shards)
+	}
+
+	dest, openErr := models.CreateReport(s3Client, filename)
+	if openErr != nil {
+		return nil, openErr
+	}
+	reportWriter, writerErr := models.NewReportWriter(format, dest)
+	if writerErr != nil {
+		dest.Abort()
+		return nil, writerErr
+	}
+	//when streaming to another process, get each record to it straight away rather than when the buffer fills
+	return &singleReportOutput{dest: dest, writer: reportWriter, flushEachRecord: models.IsStdioLocation(filename)}, nil
+}
+
+/**
+writes the report to a local file, s3:// URI or stdout, split into shards if requested. If anything goes wrong part-way
+through, the destination is aborted rather than being left looking like a complete report
+*/
+func AsyncOutputWriter(s3Client *s3.Client, filename string, format string, shards models.ShardOptions, onlyWithDupes bool, inputCh chan *models.LookupResult) chan error {
 	errCh := make(chan error, 1)
 
 	go func() {
-		file, openErr := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+		output, openErr := openReportOutput(s3Client, filename, format, shards)
 		if openErr != nil {
 			log.Printf("ERROR can't open %s to write: %s", filename, openErr)
 			errCh <- openErr
 			return
 		}
-		defer file.Close()
-
-		csvWriter := csv.NewWriter(file)
-		defer csvWriter.Flush()
-
-		headerErr := csvWriter.Write(models.LookupResultCSVHeader())
-		if headerErr != nil {
-			errCh <- headerErr
-			return
-		}
 
 		for {
 			rec := <-inputCh
 			if rec == nil {
 				log.Print("AsyncOutputWriter reached end of stream, terminating")
-				errCh <- nil
+				errCh <- output.Finish()
 				return
 			}
 			if onlyWithDupes && rec.Count == 0 {
 				continue
 			}
 
-			err := csvWriter.Write(rec.ToCSVRow())
+			err := output.Write(rec)
 			if err != nil {
+				output.Abort()
 				errCh <- err
 				return
 			}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+a single object in the proxy bucket, as held in the ProxyIndex
+*/
+type indexedProxy struct {
+	Key  string
+	Size int64
+}
+
+/**
+ProxySource that lists the whole proxy bucket up-front and then resolves proxies from memory.
+The index is kept sorted on key so that a lookup by stem gives exactly the same results as a
+ListObjectsV2 with that stem as the prefix.
+If maxAge is non-zero then the index is rebuilt from the bucket once it becomes older than that, so
+that proxies created during a long run are not missed.
+*/
+type ProxyIndex struct {
+	s3Client    *s3.Client
+	proxybucket string
+	timeout     time.Duration
+	maxAge      time.Duration
+
+	rebuildLock sync.Mutex
+	lock        sync.RWMutex
+	entries     []indexedProxy
+	builtAt     time.Time
+
+	hits     int64
+	misses   int64
+	rebuilds int64
+}
+
+func NewProxyIndex(s3Client *s3.Client, proxybucket string, timeout time.Duration, maxAge time.Duration) (*ProxyIndex, error) {
+	idx := &ProxyIndex{
+		s3Client:    s3Client,
+		proxybucket: proxybucket,
+		timeout:     timeout,
+		maxAge:      maxAge,
+	}
+	err := idx.rebuild()
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+/**
+reads the entire proxy bucket into a new, sorted list of entries
+*/
+func (idx *ProxyIndex) loadEntries() ([]indexedProxy, error) {
+	objectCh, errCh := models.AsyncReadBucket(idx.s3Client, idx.proxybucket, idx.timeout)
+	entries := make([]indexedProxy, 0, 1000)
+
+	for {
+		select {
+		case obj := <-objectCh:
+			if obj == nil {
+				sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+				return entries, nil
+			}
+			decodedKey, decodeErr := models.DecodeListedKey(*obj.Key)
+			if decodeErr != nil {
+				log.Printf("ERROR ProxyIndex can't urldecode '%s': %s", *obj.Key, decodeErr)
+				continue
+			}
+			entries = append(entries, indexedProxy{Key: decodedKey, Size: obj.Size})
+		case err := <-errCh:
+			return nil, err
+		}
+	}
+}
+
+func (idx *ProxyIndex) rebuild() error {
+	log.Printf("INFO ProxyIndex building index of %s, this may take a while...", idx.proxybucket)
+	startTime := time.Now()
+	entries, err := idx.loadEntries()
+	if err != nil {
+		log.Printf("ERROR ProxyIndex could not build index of %s: %s", idx.proxybucket, err)
+		return err
+	}
+
+	idx.lock.Lock()
+	idx.entries = entries
+	idx.builtAt = time.Now()
+	idx.lock.Unlock()
+	atomic.AddInt64(&idx.rebuilds, 1)
+	log.Printf("INFO ProxyIndex indexed %d proxies in %s", len(entries), time.Since(startTime))
+	return nil
+}
+
+/**
+rebuilds the index, unless another thread got there first while we were waiting for the lock
+*/
+func (idx *ProxyIndex) rebuildIfStale() error {
+	idx.rebuildLock.Lock()
+	defer idx.rebuildLock.Unlock()
+	if !idx.isStale() {
+		return nil
+	}
+	log.Printf("INFO ProxyIndex index of %s is older than %s, rebuilding", idx.proxybucket, idx.maxAge)
+	return idx.rebuild()
+}
+
+func (idx *ProxyIndex) isStale() bool {
+	if idx.maxAge == 0 {
+		return false
+	}
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return time.Since(idx.builtAt) > idx.maxAge
+}
+
+/**
+returns all of the indexed proxies whose key starts with the given prefix
+*/
+func (idx *ProxyIndex) lookupPrefix(prefix string) []models.FoundEntry {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	start := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].Key >= prefix })
+	results := make([]models.FoundEntry, 0)
+	for i := start; i < len(idx.entries) && strings.HasPrefix(idx.entries[i].Key, prefix); i++ {
+		results = append(results, models.FoundEntry{
+			Bucket:  idx.proxybucket,
+			Path:    idx.entries[i].Key,
+			Size:    idx.entries[i].Size,
+			IsProxy: true,
+		})
+	}
+	return results
+}
+
+func (idx *ProxyIndex) FindProxies(rec *models.LookupResult) ([]models.FoundEntry, error) {
+	if idx.isStale() {
+		err := idx.rebuildIfStale()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prefix, gotPrefix := models.PrefixFromFilename(rec.RequestedFile)
+	if !gotPrefix {
+		log.Printf("WARNING ProxyIndex.FindProxies - could not get prefix from '%s'", rec.RequestedFile)
+	}
+
+	results := idx.lookupPrefix(prefix)
+	if len(results) == 0 {
+		atomic.AddInt64(&idx.misses, 1)
+		return nil, nil
+	}
+	atomic.AddInt64(&idx.hits, 1)
+	return results, nil
+}
+
+/**
+returns the number of lookups that found at least one proxy, the number that found none and the number of
+times that the index has been built
+*/
+func (idx *ProxyIndex) Stats() (int64, int64, int64) {
+	return atomic.LoadInt64(&idx.hits), atomic.LoadInt64(&idx.misses), atomic.LoadInt64(&idx.rebuilds)
+}
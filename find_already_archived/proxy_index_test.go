@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"testing"
+	"time"
+)
+
+func TestProxyIndexFindProxies(t *testing.T) {
+	idx := &ProxyIndex{
+		proxybucket: "proxies",
+		entries: []indexedProxy{
+			{Key: "path/to/other_file.mp4", Size: 10},
+			{Key: "path/to/some_file.jpg", Size: 20},
+			{Key: "path/to/some_file.mp4", Size: 30},
+			{Key: "path/to/some_file_thumb.jpg", Size: 40},
+			{Key: "path/to/zzz.mp4", Size: 50},
+		},
+		builtAt: time.Now(),
+	}
+
+	results, err := idx.FindProxies(&models.LookupResult{RequestedFile: "path/to/some_file.mxf"})
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if results[0].Path != "path/to/some_file.jpg" || results[0].Size != 20 || results[0].Bucket != "proxies" {
+		t.Errorf("got incorrect first result %v", results[0])
+	}
+	if results[2].Path != "path/to/some_file_thumb.jpg" {
+		t.Errorf("got incorrect last result %v", results[2])
+	}
+
+	noResults, _ := idx.FindProxies(&models.LookupResult{RequestedFile: "path/to/missing.mxf"})
+	if noResults != nil {
+		t.Errorf("expected no results for missing file, got %v", noResults)
+	}
+
+	hits, misses, _ := idx.Stats()
+	if hits != 1 || misses != 1 {
+		t.Errorf("expected 1 hit and 1 miss, got %d and %d", hits, misses)
+	}
+}
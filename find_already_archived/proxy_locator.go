@@ -6,29 +6,15 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/guardian/multimedia-holding-pen-utils/models"
 	"log"
-	"regexp"
 	"sync"
 	"time"
 )
 
-/**
-strip any file extension to get the prefix to search on for proxies
-*/
-func prefixFromFilename(filename string) (string, bool) {
-	xtractor := regexp.MustCompile("^(.*)\\.([^.]+)$")
-	matches := xtractor.FindAllStringSubmatch(filename, -1)
-	if matches == nil {
-		return filename, false
-	} else {
-		return matches[0][1], true
-	}
-}
-
 /**
 make a list request to the given bucket name with a timeout
 */
 func makeSearchRequest(s3Client *s3.Client, proxybucket string, rec *models.LookupResult, timeout time.Duration) (*s3.ListObjectsV2Output, error) {
-	prefix, gotPrefix := prefixFromFilename(rec.RequestedFile)
+	prefix, gotPrefix := models.PrefixFromFilename(rec.RequestedFile)
 	if !gotPrefix {
 		log.Printf("WARNING ProxyLocator.makeSearchRequest - could not get prefix from '%s'", rec.RequestedFile)
 	}
@@ -54,11 +40,51 @@ func proxyListFromResponse(response *s3.ListObjectsV2Output, bucketName string)
 		entries[i].Path = *obj.Key
 		entries[i].Size = obj.Size
 		entries[i].Bucket = bucketName
+		entries[i].IsProxy = true
+		entries[i].StorageClass = string(obj.StorageClass)
+		if obj.LastModified != nil {
+			entries[i].LastModified = *obj.LastModified
+		}
 	}
 	return entries
 }
 
-func proxyLocator(s3Client *s3.Client, proxybucket string, inputCh chan *models.LookupResult, outputCh chan *models.LookupResult, errCh chan error, waitGroup *sync.WaitGroup) {
+/**
+anything that can tell us which proxies exist for a given lookup result
+*/
+type ProxySource interface {
+	FindProxies(rec *models.LookupResult) ([]models.FoundEntry, error)
+}
+
+/**
+ProxySource that makes a list request to the proxy bucket for every record
+*/
+type LiveProxySource struct {
+	s3Client    *s3.Client
+	proxybucket string
+	timeout     time.Duration
+}
+
+func NewLiveProxySource(s3Client *s3.Client, proxybucket string, timeout time.Duration) *LiveProxySource {
+	return &LiveProxySource{
+		s3Client:    s3Client,
+		proxybucket: proxybucket,
+		timeout:     timeout,
+	}
+}
+
+func (s *LiveProxySource) FindProxies(rec *models.LookupResult) ([]models.FoundEntry, error) {
+	response, searchErr := makeSearchRequest(s.s3Client, s.proxybucket, rec, s.timeout)
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	if response.KeyCount == 0 {
+		return nil, nil
+	}
+	return proxyListFromResponse(response, s.proxybucket), nil
+}
+
+func proxyLocator(source ProxySource, inputCh chan *models.LookupResult, outputCh chan *models.LookupResult, errCh chan error, waitGroup *sync.WaitGroup) {
 	defer waitGroup.Done()
 	for {
 		rec := <-inputCh
@@ -66,21 +92,21 @@ func proxyLocator(s3Client *s3.Client, proxybucket string, inputCh chan *models.
 			log.Print("INFO proxyLocator thread got nil, terminating")
 			return
 		}
-		response, searchErr := makeSearchRequest(s3Client, proxybucket, rec, 30*time.Second)
+		proxies, searchErr := source.FindProxies(rec)
 		if searchErr != nil {
 			errCh <- searchErr
 			continue
 		}
 
-		if response.KeyCount != 0 {
-			//log.Printf("DEBUG proxyLocator found %d proxies for %s", response.KeyCount, rec.RequestedFile)
-			rec.Proxies = proxyListFromResponse(response, proxybucket)
+		if len(proxies) != 0 {
+			//log.Printf("DEBUG proxyLocator found %d proxies for %s", len(proxies), rec.RequestedFile)
+			rec.Proxies = proxies
 		}
 		outputCh <- rec
 	}
 }
 
-func AsyncLocateProxy(s3Client *s3.Client, inputCh chan *models.LookupResult, proxybucket string, threads int) (chan *models.LookupResult, chan error) {
+func AsyncLocateProxy(source ProxySource, inputCh chan *models.LookupResult, threads int) (chan *models.LookupResult, chan error) {
 	outputCh := make(chan *models.LookupResult, 100)
 	errCh := make(chan error, 1)
 	modifiedInputCh := make(chan *models.LookupResult, 100)
@@ -109,7 +135,7 @@ func AsyncLocateProxy(s3Client *s3.Client, inputCh chan *models.LookupResult, pr
 	}()
 
 	for i := 0; i < threads; i++ {
-		go proxyLocator(s3Client, proxybucket, modifiedInputCh, outputCh, errCh, waitGroup)
+		go proxyLocator(source, modifiedInputCh, outputCh, errCh, waitGroup)
 		waitGroup.Add(1)
 	}
 	return outputCh, errCh
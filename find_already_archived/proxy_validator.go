@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+reads `length` bytes from the object starting at `offset`. May return fewer bytes if the object ends first.
+*/
+type rangeReader func(offset int64, length int64) ([]byte, error)
+
+/**
+reasons for a proxy failing validation
+*/
+var (
+	ProxyTooSmall        = errors.New("proxy is smaller than the minimum size")
+	ProxyBadContentType  = errors.New("proxy has an unexpected content type")
+	ProxyTruncated       = errors.New("proxy container is truncated")
+	ProxyCorruptHeader   = errors.New("proxy container header is not valid")
+	ProxyMissingMoovAtom = errors.New("proxy has no moov atom")
+)
+
+var acceptableProxyContentTypes = []string{
+	"video/",
+	"audio/",
+	"image/",
+	"application/mp4",
+	"application/octet-stream",
+	"binary/octet-stream",
+}
+
+func isAcceptableContentType(contentType string) bool {
+	for _, prefix := range acceptableProxyContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+walks the top-level atoms of an MP4/Quicktime file, checking that each one lies within the file and that a moov
+atom is present
+*/
+func validateMp4(reader rangeReader, fileLength int64) error {
+	var offset int64 = 0
+	foundMoov := false
+
+	for atomCount := 0; offset < fileLength; atomCount++ {
+		if atomCount > 1000 {
+			return ProxyCorruptHeader
+		}
+		header, readErr := reader(offset, 16)
+		if readErr != nil {
+			return readErr
+		}
+		if len(header) < 8 {
+			return ProxyTruncated
+		}
+
+		atomSize := int64(binary.BigEndian.Uint32(header[0:4]))
+		atomType := string(header[4:8])
+		switch atomSize {
+		case 0: //atom extends to the end of the file
+			atomSize = fileLength - offset
+		case 1: //64-bit extended size follows the type
+			if len(header) < 16 {
+				return ProxyTruncated
+			}
+			atomSize = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if atomSize < 8 {
+			return ProxyCorruptHeader
+		}
+		if offset == 0 && atomType != "ftyp" && atomType != "moov" && atomType != "wide" && atomType != "free" && atomType != "mdat" {
+			return ProxyCorruptHeader
+		}
+		if offset+atomSize > fileLength {
+			return ProxyTruncated
+		}
+		if atomType == "moov" {
+			foundMoov = true
+		}
+		offset += atomSize
+	}
+
+	if !foundMoov {
+		return ProxyMissingMoovAtom
+	}
+	return nil
+}
+
+/**
+checks that a JPEG starts with the SOI marker and finishes with the EOI marker
+*/
+func validateJpeg(reader rangeReader, fileLength int64) error {
+	if fileLength < 4 {
+		return ProxyTruncated
+	}
+	start, startErr := reader(0, 2)
+	if startErr != nil {
+		return startErr
+	}
+	if len(start) < 2 || start[0] != 0xFF || start[1] != 0xD8 {
+		return ProxyCorruptHeader
+	}
+	end, endErr := reader(fileLength-2, 2)
+	if endErr != nil {
+		return endErr
+	}
+	if len(end) < 2 || end[0] != 0xFF || end[1] != 0xD9 {
+		return ProxyTruncated
+	}
+	return nil
+}
+
+/**
+returns the container check to use for the given file, based on its extension, or nil if we don't know how to
+check it
+*/
+func containerValidatorFor(filename string) func(rangeReader, int64) error {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".mp4", ".m4v", ".m4a", ".mov":
+		return validateMp4
+	case ".jpg", ".jpeg":
+		return validateJpeg
+	default:
+		return nil
+	}
+}
+
+type ProxyValidator struct {
+	s3Client *s3.Client
+	minSize  int64
+	timeout  time.Duration
+}
+
+func NewProxyValidator(s3Client *s3.Client, minSize int64, timeout time.Duration) *ProxyValidator {
+	return &ProxyValidator{
+		s3Client: s3Client,
+		minSize:  minSize,
+		timeout:  timeout,
+	}
+}
+
+func (v *ProxyValidator) headObject(entry *models.FoundEntry) (*s3.HeadObjectOutput, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), v.timeout)
+	defer cancelFunc()
+
+	return v.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(entry.Bucket),
+		Key:    aws.String(entry.Path),
+	})
+}
+
+/**
+returns a rangeReader that makes ranged GET requests to the given object
+*/
+func (v *ProxyValidator) s3RangeReader(entry *models.FoundEntry) rangeReader {
+	return func(offset int64, length int64) ([]byte, error) {
+		ctx, cancelFunc := context.WithTimeout(context.Background(), v.timeout)
+		defer cancelFunc()
+
+		response, err := v.s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(entry.Bucket),
+			Key:    aws.String(entry.Path),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		return ioutil.ReadAll(response.Body)
+	}
+}
+
+/**
+returns true if the given error means that the proxy was checked and found to be invalid, or false if it means
+that the check itself failed
+*/
+func isValidationFailure(err error) bool {
+	return err == ProxyTooSmall || err == ProxyBadContentType || err == ProxyTruncated || err == ProxyCorruptHeader || err == ProxyMissingMoovAtom
+}
+
+/**
+checks a single proxy. Returns nil if it is valid, or an error; use isValidationFailure to tell whether the proxy
+is invalid or whether the check could not be performed
+*/
+func (v *ProxyValidator) Validate(entry *models.FoundEntry) error {
+	if entry.Size < v.minSize {
+		return ProxyTooSmall
+	}
+
+	headResponse, headErr := v.headObject(entry)
+	if headErr != nil {
+		return headErr
+	}
+	if headResponse.ContentLength < v.minSize {
+		return ProxyTooSmall
+	}
+	if headResponse.ContentType != nil && !isAcceptableContentType(*headResponse.ContentType) {
+		return ProxyBadContentType
+	}
+
+	containerCheck := containerValidatorFor(entry.Path)
+	if containerCheck == nil {
+		return nil
+	}
+	return containerCheck(v.s3RangeReader(entry), headResponse.ContentLength)
+}
+
+func proxyValidatorThread(validator *ProxyValidator, inputCh chan *models.LookupResult, outputCh chan *models.LookupResult, errCh chan error, waitGroup *sync.WaitGroup) {
+	defer waitGroup.Done()
+	for {
+		rec := <-inputCh
+		if rec == nil {
+			log.Print("INFO proxyValidatorThread got nil, terminating")
+			return
+		}
+
+		//only items that have been archived elsewhere are going to be deleted, so don't bother checking the others
+		if rec.Count > 0 {
+			for i := range rec.Proxies {
+				validationErr := validator.Validate(&rec.Proxies[i])
+				if validationErr != nil && !isValidationFailure(validationErr) {
+					//a proxy that we couldn't look at must not be taken as a good one, or it could be deleted
+					log.Printf("WARNING proxyValidatorThread could not check %s, marking it invalid: %s", rec.Proxies[i].MustUri(), validationErr)
+					rec.Proxies[i].Invalid = true
+					rec.Proxies[i].InvalidReason = "could not be checked: " + validationErr.Error()
+					errCh <- validationErr
+				} else if validationErr != nil {
+					log.Printf("WARNING proxyValidatorThread %s is not valid: %s", rec.Proxies[i].MustUri(), validationErr)
+					rec.Proxies[i].Invalid = true
+					rec.Proxies[i].InvalidReason = validationErr.Error()
+				}
+			}
+		}
+		outputCh <- rec
+	}
+}
+
+/**
+checks the proxies on every record that has been archived elsewhere and marks the ones that are empty, truncated or
+otherwise unplayable as invalid. Proxies that could not be checked, e.g. because S3 refused the request, are marked
+as invalid too, and the reason is sent to the error channel
+*/
+func AsyncValidateProxies(validator *ProxyValidator, inputCh chan *models.LookupResult, threads int) (chan *models.LookupResult, chan error) {
+	outputCh := make(chan *models.LookupResult, 100)
+	errCh := make(chan error, 1)
+	modifiedInputCh := make(chan *models.LookupResult, 100)
+	waitGroup := &sync.WaitGroup{}
+
+	go func() {
+		for {
+			rec := <-inputCh
+			if rec == nil {
+				for i := 0; i < threads; i++ {
+					modifiedInputCh <- nil
+				}
+				log.Print("INFO AsyncValidateProxies terminating, waiting for worker threads")
+				waitGroup.Wait()
+				log.Print("INFO AsyncValidateProxies all worker threads completed, exiting")
+				outputCh <- nil
+				return
+			} else {
+				modifiedInputCh <- rec
+			}
+		}
+	}()
+
+	for i := 0; i < threads; i++ {
+		go proxyValidatorThread(validator, modifiedInputCh, outputCh, errCh, waitGroup)
+		waitGroup.Add(1)
+	}
+	return outputCh, errCh
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func memoryRangeReader(content []byte) rangeReader {
+	return func(offset int64, length int64) ([]byte, error) {
+		end := offset + length
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		return content[offset:end], nil
+	}
+}
+
+func makeAtom(atomType string, size int) []byte {
+	atom := make([]byte, size)
+	binary.BigEndian.PutUint32(atom[0:4], uint32(size))
+	copy(atom[4:8], atomType)
+	return atom
+}
+
+func TestValidateMp4(t *testing.T) {
+	content := append(makeAtom("ftyp", 24), makeAtom("moov", 100)...)
+	content = append(content, makeAtom("mdat", 1000)...)
+	err := validateMp4(memoryRangeReader(content), int64(len(content)))
+	if err != nil {
+		t.Error("valid mp4 failed validation: ", err)
+	}
+
+	truncated := content[0 : len(content)-10]
+	err = validateMp4(memoryRangeReader(truncated), int64(len(truncated)))
+	if err != ProxyTruncated {
+		t.Errorf("expected ProxyTruncated for truncated mp4, got %v", err)
+	}
+
+	noMoov := append(makeAtom("ftyp", 24), makeAtom("mdat", 1000)...)
+	err = validateMp4(memoryRangeReader(noMoov), int64(len(noMoov)))
+	if err != ProxyMissingMoovAtom {
+		t.Errorf("expected ProxyMissingMoovAtom, got %v", err)
+	}
+
+	notMp4 := []byte("this is not an mp4 file at all")
+	err = validateMp4(memoryRangeReader(notMp4), int64(len(notMp4)))
+	if err != ProxyCorruptHeader {
+		t.Errorf("expected ProxyCorruptHeader for text file, got %v", err)
+	}
+}
+
+func TestValidateJpeg(t *testing.T) {
+	content := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x01, 0xFF, 0xD9}
+	err := validateJpeg(memoryRangeReader(content), int64(len(content)))
+	if err != nil {
+		t.Error("valid jpeg failed validation: ", err)
+	}
+
+	truncated := content[0:6]
+	err = validateJpeg(memoryRangeReader(truncated), int64(len(truncated)))
+	if err != ProxyTruncated {
+		t.Errorf("expected ProxyTruncated for truncated jpeg, got %v", err)
+	}
+
+	empty := []byte{}
+	err = validateJpeg(memoryRangeReader(empty), 0)
+	if err != ProxyTruncated {
+		t.Errorf("expected ProxyTruncated for empty jpeg, got %v", err)
+	}
+}
+
+func newFakeS3Client(server *httptest.Server) *s3.Client {
+	return s3.New(s3.Options{
+		Region:           "eu-west-1",
+		EndpointResolver: s3.EndpointResolverFromURL(server.URL),
+		UsePathStyle:     true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+}
+
+func TestAsyncValidateProxiesMarksUncheckedProxiesInvalid(t *testing.T) {
+	jpeg := append([]byte{0xFF, 0xD8}, bytes.Repeat([]byte{0}, 100)...)
+	jpeg = append(jpeg, 0xFF, 0xD9)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/refused.jpg") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(jpeg))
+	}))
+	defer server.Close()
+
+	inputCh := make(chan *models.LookupResult, 10)
+	inputCh <- &models.LookupResult{RequestedFile: "news/one.mxf", Count: 1, Proxies: []models.FoundEntry{
+		{Bucket: "proxies", Path: "news/good.jpg", Size: int64(len(jpeg)), IsProxy: true},
+		{Bucket: "proxies", Path: "news/refused.jpg", Size: int64(len(jpeg)), IsProxy: true},
+	}}
+	inputCh <- nil
+
+	validator := NewProxyValidator(newFakeS3Client(server), 10, 10*time.Second)
+	outputCh, errCh := AsyncValidateProxies(validator, inputCh, 1)
+	var result *models.LookupResult
+	gotError := false
+	func() {
+		for {
+			select {
+			case rec := <-outputCh:
+				if rec == nil {
+					return
+				}
+				result = rec
+			case err := <-errCh:
+				gotError = err != nil
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the validator")
+			}
+		}
+	}()
+
+	if result == nil {
+		t.Fatal("the record was not passed on")
+	}
+	if result.Proxies[0].Invalid {
+		t.Errorf("the good proxy was marked invalid: %s", result.Proxies[0].InvalidReason)
+	}
+	if !result.Proxies[1].Invalid || !strings.HasPrefix(result.Proxies[1].InvalidReason, "could not be checked") {
+		t.Errorf("the proxy that could not be checked was not marked invalid, got %v %q", result.Proxies[1].Invalid, result.Proxies[1].InvalidReason)
+	}
+	select {
+	case err := <-errCh:
+		gotError = gotError || err != nil
+	default:
+	}
+	if !gotError {
+		t.Error("the failed check was not reported")
+	}
+}
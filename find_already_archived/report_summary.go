@@ -0,0 +1,246 @@
+package main
+
+import (
+	"container/heap"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+counts and bytes for one group of files, e.g. one top-level folder. Files only count as having a proxy if at least
+one of their proxies is valid; files whose proxies were all flagged as invalid are counted separately
+*/
+type SummaryAggregate struct {
+	Name              string `json:"name"`
+	Files             int64  `json:"files"`
+	Bytes             int64  `json:"bytes"`
+	MatchedFiles      int64  `json:"matchedFiles"`
+	MatchedBytes      int64  `json:"matchedBytes"`
+	WithProxyFiles    int64  `json:"withProxyFiles"`
+	WithProxyBytes    int64  `json:"withProxyBytes"`
+	InvalidProxyFiles int64  `json:"invalidProxyFiles"`
+	InvalidProxyBytes int64  `json:"invalidProxyBytes"`
+}
+
+func (a *SummaryAggregate) add(rec *models.LookupResult) {
+	a.Files++
+	a.Bytes += rec.RequestedFileSize
+	if rec.Count > 0 {
+		a.MatchedFiles++
+		a.MatchedBytes += rec.RequestedFileSize
+	}
+	if hasUsableProxy(rec) {
+		a.WithProxyFiles++
+		a.WithProxyBytes += rec.RequestedFileSize
+	} else if len(rec.Proxies) > 0 {
+		a.InvalidProxyFiles++
+		a.InvalidProxyBytes += rec.RequestedFileSize
+	}
+}
+
+func (a *SummaryAggregate) UnmatchedFiles() int64 {
+	return a.Files - a.MatchedFiles
+}
+
+func (a *SummaryAggregate) UnmatchedBytes() int64 {
+	return a.Bytes - a.MatchedBytes
+}
+
+/**
+returns the percentage of bytes that have been matched, i.e. could be reclaimed
+*/
+func (a *SummaryAggregate) MatchedPercent() float64 {
+	if a.Bytes == 0 {
+		return 0
+	}
+	return 100 * float64(a.MatchedBytes) / float64(a.Bytes)
+}
+
+/**
+min-heap of files by size, so that we can keep the N largest without holding on to everything
+*/
+type fileSizeHeap []*models.LookupResult
+
+func (h fileSizeHeap) Len() int            { return len(h) }
+func (h fileSizeHeap) Less(i, j int) bool  { return h[i].RequestedFileSize < h[j].RequestedFileSize }
+func (h fileSizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fileSizeHeap) Push(x interface{}) { *h = append(*h, x.(*models.LookupResult)) }
+func (h *fileSizeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[0 : n-1]
+	return item
+}
+
+/**
+aggregated view of an entire scan, broken down by top-level folder, archive bucket, file extension and storage class
+*/
+type ReportSummary struct {
+	Total          SummaryAggregate
+	ByFolder       map[string]*SummaryAggregate
+	ByBucket       map[string]*SummaryAggregate
+	ByExtension    map[string]*SummaryAggregate
+	ByStorageClass map[string]*SummaryAggregate
+
+	largestUnmatchedLimit int
+	largestUnmatched      fileSizeHeap
+
+	//guards against the summary being read while the collector is still adding to it, e.g. if the run is aborted
+	lock sync.Mutex
+}
+
+func NewReportSummary(largestUnmatchedLimit int) *ReportSummary {
+	return &ReportSummary{
+		Total:                 SummaryAggregate{Name: "Total"},
+		ByFolder:              make(map[string]*SummaryAggregate),
+		ByBucket:              make(map[string]*SummaryAggregate),
+		ByExtension:           make(map[string]*SummaryAggregate),
+		ByStorageClass:        make(map[string]*SummaryAggregate),
+		largestUnmatchedLimit: largestUnmatchedLimit,
+		largestUnmatched:      make(fileSizeHeap, 0, largestUnmatchedLimit+1),
+	}
+}
+
+func topLevelFolder(filePath string) string {
+	parts := strings.SplitN(strings.TrimPrefix(filePath, "/"), "/", 2)
+	if len(parts) < 2 {
+		return "(root)"
+	}
+	return parts[0]
+}
+
+func extensionOf(filePath string) string {
+	ext := strings.ToLower(path.Ext(filePath))
+	if ext == "" {
+		return "(none)"
+	}
+	return ext
+}
+
+func storageClassOf(rec *models.LookupResult) string {
+	if rec.RequestedFileStorageClass == "" {
+		return "(unknown)"
+	}
+	return rec.RequestedFileStorageClass
+}
+
+func aggregateFor(from map[string]*SummaryAggregate, name string) *SummaryAggregate {
+	agg, exists := from[name]
+	if !exists {
+		agg = &SummaryAggregate{Name: name}
+		from[name] = agg
+	}
+	return agg
+}
+
+func (s *ReportSummary) Add(rec *models.LookupResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Total.add(rec)
+	aggregateFor(s.ByFolder, topLevelFolder(rec.RequestedFile)).add(rec)
+	aggregateFor(s.ByExtension, extensionOf(rec.RequestedFile)).add(rec)
+	aggregateFor(s.ByStorageClass, storageClassOf(rec)).add(rec)
+
+	//a file can be archived in more than one bucket, so these can add up to more than the total
+	seenBuckets := make(map[string]bool)
+	for _, e := range rec.Entries {
+		if e.Bucket != "" && !seenBuckets[e.Bucket] {
+			seenBuckets[e.Bucket] = true
+			aggregateFor(s.ByBucket, e.Bucket).add(rec)
+		}
+	}
+
+	if rec.Count == 0 && s.largestUnmatchedLimit > 0 {
+		heap.Push(&s.largestUnmatched, rec)
+		if s.largestUnmatched.Len() > s.largestUnmatchedLimit {
+			heap.Pop(&s.largestUnmatched)
+		}
+	}
+}
+
+/**
+returns the given aggregates ordered by bytes, largest first
+*/
+func (s *ReportSummary) sortedAggregates(from map[string]*SummaryAggregate) []*SummaryAggregate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]*SummaryAggregate, 0, len(from))
+	for _, agg := range from {
+		copied := *agg
+		result = append(result, &copied)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes == result[j].Bytes {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Bytes > result[j].Bytes
+	})
+	return result
+}
+
+func (s *ReportSummary) SortedFolders() []*SummaryAggregate {
+	return s.sortedAggregates(s.ByFolder)
+}
+
+func (s *ReportSummary) SortedBuckets() []*SummaryAggregate {
+	return s.sortedAggregates(s.ByBucket)
+}
+
+func (s *ReportSummary) SortedExtensions() []*SummaryAggregate {
+	return s.sortedAggregates(s.ByExtension)
+}
+
+func (s *ReportSummary) SortedStorageClasses() []*SummaryAggregate {
+	return s.sortedAggregates(s.ByStorageClass)
+}
+
+/**
+returns a copy of the overall totals
+*/
+func (s *ReportSummary) Totals() SummaryAggregate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Total
+}
+
+/**
+returns the largest files that were not found in the archive, largest first
+*/
+func (s *ReportSummary) LargestUnmatched() []*models.LookupResult {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]*models.LookupResult, len(s.largestUnmatched))
+	copy(result, s.largestUnmatched)
+	sort.Slice(result, func(i, j int) bool { return result[i].RequestedFileSize > result[j].RequestedFileSize })
+	return result
+}
+
+/**
+passes every record straight through, adding it to the summary as it goes. The summary must not be read until the
+end of the stream has been passed on.
+*/
+func AsyncSummaryCollector(summary *ReportSummary, inputCh chan *models.LookupResult) chan *models.LookupResult {
+	outputCh := make(chan *models.LookupResult, 100)
+
+	go func() {
+		for {
+			rec := <-inputCh
+			if rec == nil {
+				log.Print("INFO AsyncSummaryCollector reached end of stream, terminating")
+				outputCh <- nil
+				return
+			}
+			summary.Add(rec)
+			outputCh <- rec
+		}
+	}()
+	return outputCh
+}
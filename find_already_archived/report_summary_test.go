@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestReportSummary(t *testing.T) {
+	summary := NewReportSummary(2)
+	summary.Add(&models.LookupResult{RequestedFile: "news/one.mxf", RequestedFileSize: 100, Count: 1, Entries: []models.FoundEntry{{Bucket: "archive-a"}, {Bucket: "archive-b"}}})
+	summary.Add(&models.LookupResult{RequestedFile: "news/two.MXF", RequestedFileSize: 200})
+	summary.Add(&models.LookupResult{RequestedFile: "sport/three.mp4", RequestedFileSize: 50})
+	summary.Add(&models.LookupResult{RequestedFile: "four", RequestedFileSize: 10})
+
+	if summary.Total.Files != 4 || summary.Total.Bytes != 360 || summary.Total.MatchedBytes != 100 {
+		t.Errorf("got incorrect totals %v", summary.Total)
+	}
+
+	folders := summary.SortedFolders()
+	if len(folders) != 3 || folders[0].Name != "news" || folders[0].Bytes != 300 || folders[2].Name != "(root)" {
+		t.Errorf("got incorrect folder breakdown %v", folders)
+	}
+
+	extensions := summary.SortedExtensions()
+	if extensions[0].Name != ".mxf" || extensions[0].Files != 2 {
+		t.Errorf("got incorrect extension breakdown %v", extensions)
+	}
+
+	if len(summary.ByBucket) != 2 || summary.ByBucket["archive-b"].MatchedBytes != 100 {
+		t.Errorf("got incorrect bucket breakdown %v", summary.ByBucket)
+	}
+
+	largest := summary.LargestUnmatched()
+	if len(largest) != 2 || largest[0].RequestedFile != "news/two.MXF" || largest[1].RequestedFile != "sport/three.mp4" {
+		t.Errorf("got incorrect largest unmatched files %v", largest)
+	}
+}
+
+func TestSummaryAggregateProxyCounts(t *testing.T) {
+	valid := models.FoundEntry{Bucket: "proxies", Path: "a.mp4", IsProxy: true}
+	invalid := models.FoundEntry{Bucket: "proxies", Path: "b.mp4", IsProxy: true, Invalid: true, InvalidReason: "zero length"}
+
+	tests := []struct {
+		name                 string
+		proxies              []models.FoundEntry
+		expectedWithProxy    int64
+		expectedInvalidProxy int64
+	}{
+		{"no proxies", nil, 0, 0},
+		{"only valid proxies", []models.FoundEntry{valid}, 1, 0},
+		{"only invalid proxies", []models.FoundEntry{invalid, invalid}, 0, 1},
+		{"a mix", []models.FoundEntry{invalid, valid}, 1, 0},
+	}
+
+	for _, test := range tests {
+		agg := &SummaryAggregate{}
+		agg.add(&models.LookupResult{RequestedFile: "news/one.mxf", RequestedFileSize: 100, Count: 1, Proxies: test.proxies})
+		if agg.WithProxyFiles != test.expectedWithProxy || agg.WithProxyBytes != 100*test.expectedWithProxy {
+			t.Errorf("%s: got %d files and %d bytes with proxies, expected %d files", test.name, agg.WithProxyFiles, agg.WithProxyBytes, test.expectedWithProxy)
+		}
+		if agg.InvalidProxyFiles != test.expectedInvalidProxy || agg.InvalidProxyBytes != 100*test.expectedInvalidProxy {
+			t.Errorf("%s: got %d files and %d bytes with only invalid proxies, expected %d files", test.name, agg.InvalidProxyFiles, agg.InvalidProxyBytes, test.expectedInvalidProxy)
+		}
+	}
+}
+
+func TestWriteHtmlReport(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "html-report-test")
+	defer os.RemoveAll(tempDir)
+	filename := path.Join(tempDir, "summary.html")
+
+	summary := NewReportSummary(10)
+	summary.Add(&models.LookupResult{RequestedFile: "news/<script>.mxf", RequestedFileSize: 3 * 1024 * 1024})
+
+	err := WriteHtmlReport(nil, filename, "holding-pen", summary)
+	if err != nil {
+		t.Fatal("could not write report: ", err)
+	}
+	content, _ := ioutil.ReadFile(filename)
+	if !strings.Contains(string(content), "3.0 Mb") {
+		t.Error("report does not contain the expected size")
+	}
+	if strings.Contains(string(content), "<script>") {
+		t.Error("file names were not escaped")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"log"
+	"math"
+	"path"
+	"strings"
+	"time"
+)
+
+/**
+headline figures for a scan, as written out next to the report
+*/
+type RunStats struct {
+	TargetBucket   string              `json:"targetBucket"`
+	StartedAt      time.Time           `json:"startedAt"`
+	FinishedAt     time.Time           `json:"finishedAt"`
+	Completed      bool                `json:"completed"`
+	Total          SummaryAggregate    `json:"total"`
+	ByStorageClass []*SummaryAggregate `json:"byStorageClass"`
+}
+
+func NewRunStats(targetBucket string, startedAt time.Time, completed bool, summary *ReportSummary) *RunStats {
+	return &RunStats{
+		TargetBucket:   targetBucket,
+		StartedAt:      startedAt,
+		FinishedAt:     time.Now(),
+		Completed:      completed,
+		Total:          summary.Totals(),
+		ByStorageClass: summary.SortedStorageClasses(),
+	}
+}
+
+/**
+returns the filename to write stats to for the given report, i.e. the report name with the extension replaced by
+".stats.json"
+*/
+func statsFilenameFor(reportFilename string) string {
+	uncompressed := models.StripCompressionExtension(reportFilename)
+	return strings.TrimSuffix(uncompressed, path.Ext(uncompressed)) + ".stats.json"
+}
+
+func bytesToTb(bytes int64) float64 {
+	return float64(bytes) / math.Pow(1024.0, 4)
+}
+
+/**
+logs the stats in human-readable form
+*/
+func (s *RunStats) Log() {
+	log.Printf("INFO Scanned %d files totalling %0.1fTb", s.Total.Files, bytesToTb(s.Total.Bytes))
+	log.Printf("INFO %d files totalling %0.1fTb were matched in the archive", s.Total.MatchedFiles, bytesToTb(s.Total.MatchedBytes))
+	log.Printf("INFO %d files totalling %0.1fTb have proxies", s.Total.WithProxyFiles, bytesToTb(s.Total.WithProxyBytes))
+	log.Printf("INFO %d files totalling %0.1fTb only have invalid proxies", s.Total.InvalidProxyFiles, bytesToTb(s.Total.InvalidProxyBytes))
+	for _, class := range s.ByStorageClass {
+		log.Printf("INFO   %s: %d files totalling %0.1fTb, of which %d files totalling %0.1fTb were matched", class.Name, class.Files, bytesToTb(class.Bytes), class.MatchedFiles, bytesToTb(class.MatchedBytes))
+	}
+}
+
+/**
+writes the stats as JSON to a local file or s3:// URI
+*/
+func (s *RunStats) WriteJson(s3Client *s3.Client, filename string) error {
+	content, marshalErr := json.MarshalIndent(s, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	dest, openErr := models.CreateReport(s3Client, filename)
+	if openErr != nil {
+		return openErr
+	}
+	_, writeErr := dest.Write(content)
+	if writeErr != nil {
+		dest.Abort()
+		return writeErr
+	}
+	return dest.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func makeTestRunStats() *RunStats {
+	summary := NewReportSummary(0)
+	summary.Add(&models.LookupResult{RequestedFile: "news/one.mxf", RequestedFileSize: 100, RequestedFileStorageClass: "STANDARD", Count: 1, Proxies: []models.FoundEntry{{Bucket: "proxies", Path: "news/one.mp4"}}})
+	summary.Add(&models.LookupResult{RequestedFile: "news/two.mxf", RequestedFileSize: 300, RequestedFileStorageClass: "GLACIER", Count: 2})
+	summary.Add(&models.LookupResult{RequestedFile: "news/three.mxf", RequestedFileSize: 50, RequestedFileStorageClass: "STANDARD", Proxies: []models.FoundEntry{{Bucket: "proxies", Path: "news/three.mp4", Invalid: true}}})
+	return NewRunStats("holding-pen", time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC), true, summary)
+}
+
+func TestNewRunStats(t *testing.T) {
+	stats := makeTestRunStats()
+
+	expectedTotal := SummaryAggregate{Name: "Total", Files: 3, Bytes: 450, MatchedFiles: 2, MatchedBytes: 400, WithProxyFiles: 1, WithProxyBytes: 100, InvalidProxyFiles: 1, InvalidProxyBytes: 50}
+	if stats.Total != expectedTotal {
+		t.Errorf("got totals %+v, expected %+v", stats.Total, expectedTotal)
+	}
+	if len(stats.ByStorageClass) != 2 {
+		t.Fatalf("expected 2 storage classes, got %v", stats.ByStorageClass)
+	}
+	glacier, standard := stats.ByStorageClass[0], stats.ByStorageClass[1]
+	if glacier.Name != "GLACIER" || glacier.Files != 1 || glacier.MatchedBytes != 300 {
+		t.Errorf("got incorrect GLACIER breakdown %+v", glacier)
+	}
+	if standard.Name != "STANDARD" || standard.Files != 2 || standard.Bytes != 150 || standard.MatchedBytes != 100 || standard.InvalidProxyFiles != 1 {
+		t.Errorf("got incorrect STANDARD breakdown %+v", standard)
+	}
+	if stats.TargetBucket != "holding-pen" || !stats.Completed || stats.FinishedAt.Before(stats.StartedAt) {
+		t.Errorf("got incorrect run details %+v", stats)
+	}
+}
+
+func TestStatsFilenameFor(t *testing.T) {
+	tests := map[string]string{
+		"holding-pen.csv":                  "holding-pen.stats.json",
+		"reports/holding-pen.jsonl":        "reports/holding-pen.stats.json",
+		"reports/holding-pen.csv.gz":       "reports/holding-pen.stats.json",
+		"s3://reports/scans/run.jsonl.zst": "s3://reports/scans/run.stats.json",
+		"reports.d/holding-pen":            "reports.d/holding-pen.stats.json",
+	}
+	for reportFilename, expected := range tests {
+		if result := statsFilenameFor(reportFilename); result != expected {
+			t.Errorf("%s gave %s, expected %s", reportFilename, result, expected)
+		}
+	}
+}
+
+func TestRunStatsWriteJson(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "run-stats-test")
+	defer os.RemoveAll(tempDir)
+	filename := path.Join(tempDir, "holding-pen.stats.json")
+
+	stats := makeTestRunStats()
+	writeErr := stats.WriteJson(nil, filename)
+	if writeErr != nil {
+		t.Fatal("could not write stats: ", writeErr)
+	}
+
+	content, readErr := ioutil.ReadFile(filename)
+	if readErr != nil {
+		t.Fatal("could not read stats back: ", readErr)
+	}
+	var readBack RunStats
+	unmarshalErr := json.Unmarshal(content, &readBack)
+	if unmarshalErr != nil {
+		t.Fatal("stats are not valid JSON: ", unmarshalErr)
+	}
+	if readBack.Total != stats.Total || !readBack.StartedAt.Equal(stats.StartedAt) || len(readBack.ByStorageClass) != 2 || *readBack.ByStorageClass[0] != *stats.ByStorageClass[0] {
+		t.Errorf("got %+v back, expected %+v", readBack, stats)
+	}
+}
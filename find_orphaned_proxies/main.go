@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"github.com/olivere/elastic"
+	"log"
+	"strings"
+	"time"
+)
+
+func main() {
+	proxyBucketPtr := flag.String("proxy", "proxies", "name of the proxy bucket to check")
+	holdingPenPtr := flag.String("holding-pen", "holding-pen", "name of the holding pen bucket to look for originals in")
+	esUrlPtr := flag.String("elastic", "http://127.0.0.1:9200", "Comma-separated list of Elasticsearch addresses")
+	indexNamePtr := flag.String("index", "archivehunter", "Name of the index to query")
+	timeoutStringPtr := flag.String("timeout", "30s", "default network timeout")
+	desiredThreadsPtr := flag.Int("threads", 4, "number of concurrent lookups to perform")
+	suffixesPtr := flag.String("suffixes", "_thumb,_poster,_prox", "comma-separated list of suffixes that may be added to the original's name to make a proxy name, as well as anything after a _, - or .")
+	outputFilePtr := flag.String("out", "orphaned-proxies.csv", "CSV report to write, either a local file, an s3:// URI or - for stdout")
+	reallyDeletePtr := flag.Bool("really-delete", false, "Only attempt to delete orphaned proxies if this option is set")
+	flag.Parse()
+
+	s3config, confErr := awsconfig.LoadDefaultConfig(context.Background())
+	if confErr != nil {
+		log.Fatal("Could not set up default AWS config: ", confErr)
+	}
+
+	timeout, tParseErr := time.ParseDuration(*timeoutStringPtr)
+	if tParseErr != nil {
+		log.Fatalf("Could not parse '%s' as a duration: %s", *timeoutStringPtr, tParseErr)
+	}
+
+	knownSuffixes := strings.Split(*suffixesPtr, ",")
+	if *suffixesPtr == "" {
+		knownSuffixes = []string{}
+	}
+
+	esClient, esErr := elastic.NewClient(elastic.SetURL(*esUrlPtr),
+		elastic.SetSniff(false),
+		elastic.SetHealthcheck(false),
+	)
+
+	if esErr != nil {
+		log.Fatal("Could not connect to Elastic Search: ", esErr)
+	}
+
+	s3Client := s3.NewFromConfig(s3config)
+
+	proxyObjectCh, readErrCh := models.AsyncReadBucket(s3Client, *proxyBucketPtr, timeout)
+	orphanCh, orphanErrCh := AsyncFindOrphans(s3Client, esClient, *indexNamePtr, *holdingPenPtr, *proxyBucketPtr, knownSuffixes, timeout, *desiredThreadsPtr, proxyObjectCh)
+	reportedCh, writerErrCh := AsyncOrphanReportWriter(s3Client, *outputFilePtr, orphanCh)
+	deleteErrCh := AsyncOrphanDeleter(s3Client, reportedCh, *reallyDeletePtr)
+
+	func() {
+		for {
+			select {
+			case err := <-readErrCh:
+				log.Print("ERROR main got error from AsyncReadBucket: ", err)
+				return
+			case err := <-orphanErrCh:
+				log.Print("ERROR main got error from AsyncFindOrphans: ", err)
+				return
+			case err := <-writerErrCh:
+				log.Print("ERROR main got error from AsyncOrphanReportWriter: ", err)
+				return
+			case err := <-deleteErrCh:
+				if err == nil {
+					log.Print("INFO main deletion thread exited normally, completed")
+				} else {
+					log.Print("ERROR main deletion thread reported an error: ", err)
+				}
+				return
+			}
+		}
+	}()
+
+	log.Print("All done.")
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	awstypes "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"github.com/olivere/elastic"
+	"log"
+	"sync"
+	"time"
+)
+
+/**
+a proxy for which no original could be found, along with the stems that we searched for
+*/
+type OrphanedProxy struct {
+	Proxy      models.FoundEntry
+	Candidates []string
+}
+
+/**
+returns true if the holding pen bucket contains an original for the given stem, i.e. the stem itself or the stem
+plus an extension.
+the bare stem sorts before everything else that starts with it, so a listing of one key tells us whether it is there.
+keys with the stem plus an extension all start with stem+".", and every page of those is checked, since lookalikes
+such as "stem.old.mxf" can take up any number of places in the listing
+*/
+func existsInHoldingPen(s3Client *s3.Client, holdingPen string, stem string, timeout time.Duration) (bool, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
+	defer cancelFunc()
+
+	bareResponse, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(holdingPen),
+		MaxKeys: 1,
+		Prefix:  aws.String(stem),
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(bareResponse.Contents) > 0 && aws.ToString(bareResponse.Contents[0].Key) == stem {
+		return true, nil
+	}
+
+	var continuationToken *string
+	for {
+		response, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(holdingPen),
+			Prefix:            aws.String(stem + "."),
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return false, err
+		}
+		for _, obj := range response.Contents {
+			if models.MatchesOriginalStem(aws.ToString(obj.Key), stem) {
+				return true, nil
+			}
+		}
+		if !response.IsTruncated {
+			return false, nil
+		}
+		continuationToken = response.NextContinuationToken
+	}
+}
+
+/**
+builds a query looking for any path that could be an original for the given stem, in any bucket other than the
+proxy bucket
+*/
+func makeOriginalQuery(stem string, proxyBucket string) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().Should(
+		elastic.NewTermQuery("path.keyword", stem),
+		elastic.NewPrefixQuery("path.keyword", stem+"."),
+	).MinimumNumberShouldMatch(1).MustNot(
+		elastic.NewTermQuery("bucket.keyword", proxyBucket),
+	)
+}
+
+/**
+the number of index results to check at a time in existsInArchive
+*/
+const archivePageSize = 100
+
+/**
+returns true if the archive index contains an original for the given stem. The query can also match lookalikes
+such as "stem.old.mxf", so every page of results is checked until a real original turns up or they run out.
+Pages are fetched with search_after rather than from/size, since the index refuses to go past
+index.max_result_window (10,000 by default) that way. Results that share a path can be skipped when a page
+boundary falls between them, but they would all give the same answer anyway.
+Any error is returned rather than treated as "not found", so that a proxy is never made to look orphaned just
+because its original could not be confirmed
+*/
+func existsInArchive(esClient *elastic.Client, indexName string, proxyBucket string, stem string) (bool, error) {
+	var searchAfter []interface{}
+	for {
+		search := esClient.Search(indexName).
+			Query(makeOriginalQuery(stem, proxyBucket)).
+			Sort("path.keyword", true).
+			Size(archivePageSize)
+		if searchAfter != nil {
+			search = search.SearchAfter(searchAfter...)
+		}
+		response, err := search.Do(context.Background())
+		if err != nil {
+			return false, err
+		}
+		for _, hit := range response.Hits.Hits {
+			var archiveEntry models.ArchiveEntry
+			unmarshalErr := json.Unmarshal(*hit.Source, &archiveEntry)
+			if unmarshalErr != nil {
+				log.Print("ERROR could not unmarshal index result to archive entry: ", unmarshalErr)
+				continue
+			}
+			if models.MatchesOriginalStem(archiveEntry.Path, stem) {
+				return true, nil
+			}
+		}
+		if len(response.Hits.Hits) < archivePageSize {
+			return false, nil
+		}
+		searchAfter = response.Hits.Hits[len(response.Hits.Hits)-1].Sort
+		if len(searchAfter) == 0 {
+			return false, fmt.Errorf("index results for %s have no sort values to page on from", stem)
+		}
+	}
+}
+
+func originalCheckerThread(s3Client *s3.Client,
+	esClient *elastic.Client,
+	indexName string,
+	holdingPen string,
+	proxyBucket string,
+	knownSuffixes []string,
+	timeout time.Duration,
+	inputCh chan *awstypes.Object,
+	outputCh chan *OrphanedProxy,
+	errCh chan error,
+	waitGroup *sync.WaitGroup) {
+
+	defer waitGroup.Done()
+
+	for {
+		rec := <-inputCh
+		if rec == nil {
+			log.Print("DEBUG originalCheckerThread terminating at end of stream")
+			return
+		}
+
+		decodedKey, decodeErr := models.DecodeListedKey(*rec.Key)
+		if decodeErr != nil {
+			log.Printf("ERROR originalCheckerThread can't urldecode '%s': %s", *rec.Key, decodeErr)
+			continue
+		}
+
+		candidates := models.CandidateOriginalStems(decodedKey, knownSuffixes)
+		foundOriginal := false
+		for _, stem := range candidates {
+			inHoldingPen, hpErr := existsInHoldingPen(s3Client, holdingPen, stem, timeout)
+			if hpErr != nil {
+				log.Printf("ERROR originalCheckerThread can't check holding pen for %s: %s", stem, hpErr)
+				errCh <- hpErr
+				return
+			}
+			if inHoldingPen {
+				foundOriginal = true
+				break
+			}
+
+			inArchive, archiveErr := existsInArchive(esClient, indexName, proxyBucket, stem)
+			if archiveErr != nil {
+				log.Printf("ERROR originalCheckerThread can't search archive for %s: %s", stem, archiveErr)
+				errCh <- archiveErr
+				return
+			}
+			if inArchive {
+				foundOriginal = true
+				break
+			}
+		}
+
+		if !foundOriginal {
+			log.Printf("INFO originalCheckerThread %s has no original", decodedKey)
+			outputCh <- &OrphanedProxy{
+				Proxy: models.FoundEntry{
+					Bucket:  proxyBucket,
+					Path:    decodedKey,
+					Size:    rec.Size,
+					IsProxy: true,
+				},
+				Candidates: candidates,
+			}
+		}
+	}
+}
+
+/**
+checks every proxy coming in from the proxy bucket for an original in the holding pen or the archive, and outputs
+the ones that have none
+*/
+func AsyncFindOrphans(s3Client *s3.Client,
+	esClient *elastic.Client,
+	indexName string,
+	holdingPen string,
+	proxyBucket string,
+	knownSuffixes []string,
+	timeout time.Duration,
+	threads int,
+	inputCh chan *awstypes.Object) (chan *OrphanedProxy, chan error) {
+
+	outputCh := make(chan *OrphanedProxy, 100)
+	errCh := make(chan error, 1)
+	internalErrCh := make(chan error, 1)
+	modifiedInputCh := make(chan *awstypes.Object, 100)
+	waitGroup := &sync.WaitGroup{}
+
+	//duplicate the end-of-stream marker for each of our goroutines
+	go func() {
+		for {
+			select {
+			case rec := <-inputCh:
+				if rec == nil {
+					for i := 0; i < threads; i++ {
+						modifiedInputCh <- nil
+					}
+					log.Print("DEBUG AsyncFindOrphans sent termination signal, waiting for threads to terminate...")
+					waitGroup.Wait()
+					log.Print("DEBUG AsyncFindOrphans threads have terminated, now exiting")
+					outputCh <- nil
+					return
+				} else {
+					modifiedInputCh <- rec
+				}
+			case err := <-internalErrCh:
+				log.Print("WARNING AsyncFindOrphans received an error, terminating all threads")
+				for i := 0; i < threads; i++ {
+					modifiedInputCh <- nil
+				}
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < threads; i++ {
+		go originalCheckerThread(s3Client, esClient, indexName, holdingPen, proxyBucket, knownSuffixes, timeout, modifiedInputCh, outputCh, internalErrCh, waitGroup)
+		waitGroup.Add(1)
+	}
+
+	return outputCh, errCh
+}
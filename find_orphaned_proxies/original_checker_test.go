@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	awstypes "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/olivere/elastic"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeListedObject struct {
+	Key  string
+	Size int64
+}
+
+type fakeListBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeListedObject
+}
+
+/**
+serves ListObjectsV2 for a bucket holding the given keys, at most two keys a page so that paging gets exercised
+*/
+func newFakeListingServer(keys []string) *httptest.Server {
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		prefix := query.Get("prefix")
+		maxKeys := 2
+		if requested, err := strconv.Atoi(query.Get("max-keys")); err == nil && requested < maxKeys {
+			maxKeys = requested
+		}
+		start, _ := strconv.Atoi(query.Get("continuation-token"))
+
+		matching := make([]string, 0)
+		for _, key := range sorted {
+			if strings.HasPrefix(key, prefix) {
+				matching = append(matching, key)
+			}
+		}
+		result := fakeListBucketResult{Name: "holding-pen", Prefix: prefix}
+		for i := start; i < len(matching) && i < start+maxKeys; i++ {
+			result.Contents = append(result.Contents, fakeListedObject{Key: matching[i], Size: 1})
+		}
+		result.KeyCount = len(result.Contents)
+		if start+maxKeys < len(matching) {
+			result.IsTruncated = true
+			result.NextContinuationToken = strconv.Itoa(start + maxKeys)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(&result)
+	}))
+}
+
+func newFakeS3Client(server *httptest.Server) *s3.Client {
+	return s3.New(s3.Options{
+		Region:           "eu-west-1",
+		EndpointResolver: s3.EndpointResolverFromURL(server.URL),
+		UsePathStyle:     true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+}
+
+func TestExistsInHoldingPen(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string
+		expected bool
+	}{
+		{"original after lookalikes", []string{"dir/stem (copy).mxf", "dir/stem - 2.mxf", "dir/stem_a.mxf", "dir/stem.a.mxf", "dir/stem.b.mxf", "dir/stem.c.mxf", "dir/stem.mxf"}, true},
+		{"original with no extension", []string{"dir/stem", "dir/stem (copy).mxf", "dir/stem - 2.mxf"}, true},
+		{"only lookalikes", []string{"dir/stem (copy).mxf", "dir/stem - 2.mxf", "dir/stem.a.mxf", "dir/stem.b.mxf", "dir/stem.c.mxf", "dir/stemmed.mxf"}, false},
+		{"nothing", []string{"dir/other.mxf"}, false},
+	}
+	for _, test := range tests {
+		server := newFakeListingServer(test.keys)
+		result, err := existsInHoldingPen(newFakeS3Client(server), "holding-pen", "dir/stem", 10*time.Second)
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if result != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, result, test.expected)
+		}
+	}
+}
+
+/**
+an archive index with nothing in it
+*/
+func newEmptyIndexServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"took":1,"timed_out":false,"hits":{"total":0,"max_score":null,"hits":[]}}`))
+	}))
+}
+
+func TestAsyncFindOrphans(t *testing.T) {
+	holdingPen := newFakeListingServer([]string{"dir/foo.mxf", "dir/bar (copy).mxf", "dir/bar.old.mxf", "dir/bar.older.mxf", "dir/barn.mxf"})
+	defer holdingPen.Close()
+	index := newEmptyIndexServer()
+	defer index.Close()
+	esClient, esErr := elastic.NewClient(elastic.SetURL(index.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if esErr != nil {
+		t.Fatal("could not set up index client: ", esErr)
+	}
+
+	inputCh := make(chan *awstypes.Object, 10)
+	for _, key := range []string{"dir/foo_lowres.mp4", "dir/foo.mp4", "dir/bar_thumb.jpg", "dir/baz-proxy.mp4"} {
+		inputCh <- &awstypes.Object{Key: aws.String(url.QueryEscape(key)), Size: 10}
+	}
+	inputCh <- nil
+
+	outputCh, errCh := AsyncFindOrphans(newFakeS3Client(holdingPen), esClient, "archivehunter", "holding-pen", "proxies", []string{"_thumb"}, 10*time.Second, 2, inputCh)
+	orphans := make([]string, 0)
+	func() {
+		for {
+			select {
+			case err := <-errCh:
+				t.Fatal("unexpected error: ", err)
+			case orphan := <-outputCh:
+				if orphan == nil {
+					return
+				}
+				orphans = append(orphans, orphan.Proxy.Path)
+			}
+		}
+	}()
+
+	sort.Strings(orphans)
+	if len(orphans) != 2 || orphans[0] != "dir/bar_thumb.jpg" || orphans[1] != "dir/baz-proxy.mp4" {
+		t.Errorf("got orphans %v, expected dir/bar_thumb.jpg and dir/baz-proxy.mp4", orphans)
+	}
+}
+
+/**
+an archive index holding the given paths, which behaves like Elasticsearch with a small index.max_result_window:
+every request gets up to "size" paths in order, starting after "search_after" if it is given, and a request that
+would go past the window using "from" is refused
+*/
+func newFakeIndexServer(t *testing.T, paths []string, maxResultWindow int) *httptest.Server {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			From        int           `json:"from"`
+			Size        int           `json:"size"`
+			SearchAfter []interface{} `json:"search_after"`
+		}
+		if decodeErr := json.NewDecoder(r.Body).Decode(&request); decodeErr != nil {
+			t.Errorf("could not decode search request: %s", decodeErr)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if request.From+request.Size > maxResultWindow {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"type":"illegal_argument_exception","reason":"Result window is too large"},"status":400}`))
+			return
+		}
+
+		start := request.From
+		if len(request.SearchAfter) > 0 {
+			after, _ := request.SearchAfter[0].(string)
+			start = sort.SearchStrings(sorted, after)
+			if start < len(sorted) && sorted[start] == after {
+				start++
+			}
+		}
+		hits := make([]map[string]interface{}, 0)
+		for i := start; i < len(sorted) && i < start+request.Size; i++ {
+			hits = append(hits, map[string]interface{}{
+				"_index":  "archivehunter",
+				"_type":   "entry",
+				"_id":     strconv.Itoa(i),
+				"_source": map[string]interface{}{"bucket": "archive", "path": sorted[i]},
+				"sort":    []interface{}{sorted[i]},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"took":      1,
+			"timed_out": false,
+			"hits":      map[string]interface{}{"total": len(sorted), "max_score": nil, "hits": hits},
+		})
+	}))
+}
+
+func TestExistsInArchivePastResultWindow(t *testing.T) {
+	lookalikes := make([]string, 0)
+	for i := 0; i < 3*archivePageSize; i++ {
+		lookalikes = append(lookalikes, fmt.Sprintf("dir/stem.a%04d.mxf", i))
+	}
+
+	tests := []struct {
+		name     string
+		paths    []string
+		expected bool
+	}{
+		{"original after lookalikes", append([]string{"dir/stem.mxf"}, lookalikes...), true},
+		{"only lookalikes", lookalikes, false},
+	}
+	for _, test := range tests {
+		index := newFakeIndexServer(t, test.paths, 2*archivePageSize)
+		esClient, esErr := elastic.NewClient(elastic.SetURL(index.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+		if esErr != nil {
+			t.Fatal("could not set up index client: ", esErr)
+		}
+		result, err := existsInArchive(esClient, "archivehunter", "proxies", "dir/stem")
+		index.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if result != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, result, test.expected)
+		}
+	}
+}
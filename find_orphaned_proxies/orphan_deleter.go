@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"log"
+	"time"
+)
+
+func requestDelete(s3Client *s3.Client, bucket string, key string, timeout time.Duration) (*s3.DeleteObjectOutput, error) {
+	req := &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
+	defer cancelFunc()
+
+	return s3Client.DeleteObject(ctx, req)
+}
+
+/**
+deletes each orphaned proxy that comes in, but only if reallyDelete is set.
+sends nil to the returned channel once all deletions have completed
+*/
+func AsyncOrphanDeleter(s3Client *s3.Client, inputCh chan *OrphanedProxy, reallyDelete bool) chan error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		for {
+			rec := <-inputCh
+			if rec == nil {
+				log.Print("INFO AsyncOrphanDeleter got end of stream, exiting")
+				errCh <- nil
+				return
+			}
+
+			log.Printf("INFO AsyncOrphanDeleter request to delete %s on %s", rec.Proxy.Path, rec.Proxy.Bucket)
+			if reallyDelete {
+				_, deleteErr := requestDelete(s3Client, rec.Proxy.Bucket, rec.Proxy.Path, 3*time.Second)
+				if deleteErr != nil {
+					log.Printf("ERROR AsyncOrphanDeleter could not delete %s:%s - %s", rec.Proxy.Bucket, rec.Proxy.Path, deleteErr)
+					errCh <- deleteErr
+					return
+				}
+			} else {
+				log.Print("INFO AsyncOrphanDeleter not performing deletions unless --really-delete option is set")
+			}
+		}
+	}()
+	return errCh
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+records every DeleteObject request, refusing the ones for keys in refuse
+*/
+type fakeDeleteServer struct {
+	mutex   sync.Mutex
+	deleted []string
+	refuse  map[string]bool
+}
+
+func (s *fakeDeleteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/proxies/")
+	if s.refuse[key] {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+		return
+	}
+	s.mutex.Lock()
+	s.deleted = append(s.deleted, key)
+	s.mutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *fakeDeleteServer) Deleted() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.deleted...)
+}
+
+func runOrphanDeleter(t *testing.T, fake *fakeDeleteServer, reallyDelete bool) error {
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	inputCh := make(chan *OrphanedProxy, 10)
+	for _, orphan := range makeTestOrphans() {
+		inputCh <- orphan
+	}
+	inputCh <- nil
+
+	select {
+	case err := <-AsyncOrphanDeleter(newFakeS3Client(server), inputCh, reallyDelete):
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the deleter")
+		return nil
+	}
+}
+
+func TestAsyncOrphanDeleterFinishesAfterDeletions(t *testing.T) {
+	fake := &fakeDeleteServer{}
+	err := runOrphanDeleter(t, fake, true)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	deleted := fake.Deleted()
+	if len(deleted) != 2 || deleted[0] != "dir/foo_thumb.jpg" || deleted[1] != "dir/bar.mp4" {
+		t.Errorf("deleter finished having deleted %v, expected both orphans", deleted)
+	}
+}
+
+func TestAsyncOrphanDeleterDryRun(t *testing.T) {
+	fake := &fakeDeleteServer{}
+	err := runOrphanDeleter(t, fake, false)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if len(fake.Deleted()) != 0 {
+		t.Errorf("deleted %v without -really-delete", fake.Deleted())
+	}
+}
+
+func TestAsyncOrphanDeleterStopsOnError(t *testing.T) {
+	fake := &fakeDeleteServer{refuse: map[string]bool{"dir/foo_thumb.jpg": true}}
+	err := runOrphanDeleter(t, fake, true)
+	if err == nil {
+		t.Fatal("expected the refused deletion to be reported")
+	}
+	if len(fake.Deleted()) != 0 {
+		t.Errorf("carried on deleting %v after an error", fake.Deleted())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"log"
+	"strings"
+)
+
+/**
+writes each orphaned proxy to a CSV report and passes it on to the next stage. The report is flushed and closed
+before the end of the stream is passed on, so that it is complete once the next stage has finished
+*/
+func AsyncOrphanReportWriter(s3Client *s3.Client, filename string, inputCh chan *OrphanedProxy) (chan *OrphanedProxy, chan error) {
+	outputCh := make(chan *OrphanedProxy, 100)
+	errCh := make(chan error, 1)
+
+	go func() {
+		dest, openErr := models.CreateReport(s3Client, filename)
+		if openErr != nil {
+			log.Printf("ERROR can't open %s to write: %s", filename, openErr)
+			errCh <- openErr
+			return
+		}
+
+		csvWriter := csv.NewWriter(dest)
+		headerErr := csvWriter.Write([]string{"Proxy", "Size", "Candidate originals"})
+		if headerErr != nil {
+			dest.Abort()
+			errCh <- headerErr
+			return
+		}
+
+		var orphanCount int64 = 0
+		var orphanSize int64 = 0
+		for {
+			rec := <-inputCh
+			if rec == nil {
+				log.Printf("INFO AsyncOrphanReportWriter reached end of stream, found %d orphaned proxies totalling %d bytes", orphanCount, orphanSize)
+				csvWriter.Flush()
+				flushErr := csvWriter.Error()
+				if flushErr != nil {
+					dest.Abort()
+					errCh <- flushErr
+					return
+				}
+				closeErr := dest.Close()
+				if closeErr != nil {
+					errCh <- closeErr
+					return
+				}
+				outputCh <- nil
+				return
+			}
+
+			err := csvWriter.Write([]string{
+				rec.Proxy.MustUri().String(),
+				fmt.Sprintf("%d", rec.Proxy.Size),
+				strings.Join(rec.Candidates, "|"),
+			})
+			if err != nil {
+				dest.Abort()
+				errCh <- err
+				return
+			}
+			orphanCount++
+			orphanSize += rec.Proxy.Size
+			outputCh <- rec
+		}
+	}()
+	return outputCh, errCh
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/guardian/multimedia-holding-pen-utils/models"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestOrphans() []*OrphanedProxy {
+	return []*OrphanedProxy{
+		{Proxy: models.FoundEntry{Bucket: "proxies", Path: "dir/foo_thumb.jpg", Size: 10, IsProxy: true}, Candidates: []string{"dir/foo_thumb", "dir/foo"}},
+		{Proxy: models.FoundEntry{Bucket: "proxies", Path: "dir/bar.mp4", Size: 20, IsProxy: true}, Candidates: []string{"dir/bar"}},
+	}
+}
+
+func TestAsyncOrphanReportWriterCompletesReportBeforeEndOfStream(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "orphan-writer")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "orphans.csv")
+
+	inputCh := make(chan *OrphanedProxy, 10)
+	for _, orphan := range makeTestOrphans() {
+		inputCh <- orphan
+	}
+	inputCh <- nil
+
+	outputCh, errCh := AsyncOrphanReportWriter(nil, filename, inputCh)
+	passedOn := 0
+	for {
+		select {
+		case err := <-errCh:
+			t.Fatal("unexpected error: ", err)
+		case rec := <-outputCh:
+			if rec != nil {
+				passedOn++
+				continue
+			}
+			if passedOn != 2 {
+				t.Errorf("got end of stream after %d orphans, expected 2", passedOn)
+			}
+			content, readErr := ioutil.ReadFile(filename)
+			if readErr != nil {
+				t.Fatal("report was not complete at end of stream: ", readErr)
+			}
+			expected := "Proxy,Size,Candidate originals\ns3://proxies/dir/foo_thumb.jpg,10,dir/foo_thumb|dir/foo\ns3://proxies/dir/bar.mp4,20,dir/bar\n"
+			if string(content) != expected {
+				t.Errorf("got report %q, expected %q", string(content), expected)
+			}
+			return
+		}
+	}
+}
+
+func TestAsyncOrphanReportWriterCloseError(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "orphan-writer")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dir)
+	//a directory that isn't empty can't be replaced by the finished report, so closing it fails
+	filename := path.Join(dir, "orphans.csv")
+	os.MkdirAll(path.Join(filename, "in-the-way"), 0755)
+
+	inputCh := make(chan *OrphanedProxy, 10)
+	for _, orphan := range makeTestOrphans() {
+		inputCh <- orphan
+	}
+	inputCh <- nil
+
+	outputCh, errCh := AsyncOrphanReportWriter(nil, filename, inputCh)
+	for {
+		select {
+		case err := <-errCh:
+			if err == nil {
+				t.Error("got nil on the error channel")
+			}
+			leftovers, _ := ioutil.ReadDir(dir)
+			for _, leftover := range leftovers {
+				if strings.Contains(leftover.Name(), ".partial-") {
+					t.Errorf("partial report %s was left behind", leftover.Name())
+				}
+			}
+			return
+		case rec := <-outputCh:
+			if rec == nil {
+				t.Fatal("end of stream was passed on even though the report could not be closed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the close error")
+		}
+	}
+}
@@ -5,9 +5,12 @@ go 1.15
 require (
 	github.com/aws/aws-sdk-go-v2 v1.2.1
 	github.com/aws/aws-sdk-go-v2/config v1.1.2
+	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.0.3
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.2.1
 	github.com/elastic/go-elasticsearch/v6 v6.8.10 // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/mailru/easyjson v0.7.7 // indirect
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/olivere/elastic v6.2.35+incompatible
 	github.com/pkg/errors v0.9.1 // indirect
 )
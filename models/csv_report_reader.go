@@ -2,53 +2,154 @@ package models
 
 import (
 	"encoding/csv"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"io"
 	"log"
-	"os"
 )
 
-func AsyncCsvReader(filename string) (chan *LookupResult, chan error) {
+/**
+reads a CSV report in the background, passing each LookupResult onto the output channel and nil at the end.
+Columns are found by name from the header row, so extra or reordered columns don't matter; a report with no header
+row at all is read positionally as a version 1 report. Rows that can't be read are handled as set out in options.
+If the report has a trailer then it is checked against what was read and ReportIncomplete is sent on the error
+channel if it does not match; reports from before trailers were added are read with a warning unless
+options.RequireTrailer is set.
+*/
+func AsyncCsvReader(s3Client *s3.Client, filename string, options ReportReaderOptions) (chan *LookupResult, chan error) {
 	outputCh := make(chan *LookupResult, 100)
 	errCh := make(chan error, 1)
 
 	go func() {
-		file, openErr := os.Open(filename)
-		if openErr != nil {
-			errCh <- openErr
+		rejects, rejectsErr := newRejectsRecorder(s3Client, "AsyncCsvReader", options)
+		if rejectsErr != nil {
+			errCh <- rejectsErr
 			return
 		}
-		defer file.Close()
-		reader := csv.NewReader(file)
-
-		lineCounter := 0
-		for {
-			row, readErr := reader.Read()
-			if readErr != nil {
-				if readErr == io.EOF {
-					log.Print("INFO AsyncCsvReader reached end of file, exiting")
-					outputCh <- nil
-					return
-				} else {
-					errCh <- readErr
-					return
-				}
-			}
+		err := readCsvReport(s3Client, filename, rejects, options.RequireTrailer, outputCh)
+		closeErr := rejects.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			errCh <- err
+			return
+		}
+		log.Print("INFO AsyncCsvReader reached end of file, exiting")
+		outputCh <- nil
+	}()
+
+	return outputCh, errCh
+}
+
+/**
+returns true if the given row is a header row rather than data
+*/
+func isCSVHeader(row []string) bool {
+	_, haveSource := NewCSVColumnMap(row)[CsvColSource]
+	return haveSource
+}
+
+func readCsvReport(s3Client *s3.Client, filename string, rejects *rejectsRecorder, requireTrailer bool, outputCh chan *LookupResult) error {
+	file, openErr := OpenReport(s3Client, filename)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1 //rows are read by column name, so short or long rows are dealt with below
+
+	lineCounter := 0
+	var columns CSVColumnMap //nil if the report has no header row
+	checksum := newReportChecksum()
+	processRow := func(lineNumber int, row []string) error {
+		checksum.addCSVRow(row)
+
+		var result *LookupResult
+		var marshalErr error
+		if columns == nil {
+			result, marshalErr = LookupResultFromCSVRow(&row)
+		} else {
+			result, marshalErr = LookupResultFromMappedCSVRow(columns, row)
+		}
+		if marshalErr != nil {
+			return rejects.Reject(lineNumber, marshalErr, row)
+		}
+		outputCh <- result
+		return nil
+	}
 
-			if lineCounter == 0 { //skip the header row
-				lineCounter++
+	//a row that looks like the trailer is only taken as the trailer if it turns out to be the last one, since an
+	//object in the bucket root could have the marker as its key
+	var trailerRow []string
+	trailerLine := 0
+	for {
+		row, readErr := reader.Read()
+		lineCounter++
+		if readErr == io.EOF {
+			var trailer *ReportTrailer
+			if trailerRow != nil {
+				parsedTrailer, _ := csvTrailerFromRow(trailerRow)
+				trailer = &parsedTrailer
+			}
+			return checkTrailer("AsyncCsvReader", filename, checksum, trailer, requireTrailer)
+		} else if readErr != nil {
+			var parseErr *csv.ParseError
+			if errors.As(readErr, &parseErr) {
+				rejectErr := rejects.Reject(lineCounter, readErr, row)
+				if rejectErr != nil {
+					return rejectErr
+				}
 				continue
 			}
-			lineCounter++
+			return readErr
+		}
 
-			result, marshalErr := LookupResultFromCSVRow(&row)
-			if marshalErr != nil {
-				log.Printf("ERROR AsyncCsvReader could not read line %d: %s", lineCounter, marshalErr)
-				continue
-			} else {
-				outputCh <- result
+		if lineCounter == 1 && isCSVHeader(row) { //the header row tells us which schema version we are reading
+			columns = NewCSVColumnMap(row)
+			log.Printf("INFO AsyncCsvReader %s is a version %d report", filename, CSVSchemaVersion(row))
+			continue
+		} else if lineCounter == 1 {
+			log.Printf("WARNING AsyncCsvReader %s has no header row, reading it as a version 1 report", filename)
+		}
+
+		if trailerRow != nil {
+			log.Printf("WARNING AsyncCsvReader line %d of %s looks like a trailer but is not the last row, reading it as data", trailerLine, filename)
+			rowErr := processRow(trailerLine, trailerRow)
+			if rowErr != nil {
+				return rowErr
 			}
+			trailerRow = nil
 		}
-	}()
+		if isCSVTrailer(row) {
+			trailerRow = row
+			trailerLine = lineCounter
+			continue
+		}
+		rowErr := processRow(lineCounter, row)
+		if rowErr != nil {
+			return rowErr
+		}
+	}
+}
 
-	return outputCh, errCh
+/**
+compares the trailer at the end of a report with what was actually read. A missing trailer is only an error if
+requireTrailer is set.
+*/
+func checkTrailer(readerName string, filename string, checksum *reportChecksum, trailer *ReportTrailer, requireTrailer bool) error {
+	if trailer == nil {
+		if requireTrailer {
+			log.Printf("ERROR %s %s has no end-of-report trailer", readerName, filename)
+			return ReportIncomplete
+		}
+		log.Printf("WARNING %s %s has no end-of-report trailer, so it can't be checked for completeness", readerName, filename)
+		return nil
+	}
+	verifyErr := checksum.Verify(*trailer)
+	if verifyErr != nil {
+		actual := checksum.Trailer()
+		log.Printf("ERROR %s %s trailer expects %d records with checksum %s but got %d with checksum %s", readerName, filename, trailer.Records, trailer.Sha256, actual.Records, actual.Sha256)
+	}
+	return verifyErr
 }
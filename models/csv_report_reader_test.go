@@ -0,0 +1,82 @@
+package models
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+/**
+reads everything from the given channels, returning the records and any error
+*/
+func drainReader(outputCh chan *LookupResult, errCh chan error) ([]*LookupResult, error) {
+	results := make([]*LookupResult, 0)
+	for {
+		select {
+		case rec := <-outputCh:
+			if rec == nil {
+				return results, nil
+			}
+			results = append(results, rec)
+		case err := <-errCh:
+			return results, err
+		}
+	}
+}
+
+func TestAsyncCsvReaderRejects(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "csv-reader-test")
+	defer os.RemoveAll(tempDir)
+	filename := path.Join(tempDir, "report.csv")
+	rejectsFile := path.Join(tempDir, "rejects.csv")
+
+	content := "Extra,Source size,Source,Duplicates count,Duplicates buckets\n" +
+		"x,100,news/one.mxf,1,archive\n" +
+		"x,not-a-number,news/two.mxf,1,archive\n" +
+		"x,300,,1,archive\n" +
+		"x,400,news/four.mxf,1,archive\n"
+	ioutil.WriteFile(filename, []byte(content), 0640)
+
+	results, err := drainReader(AsyncCsvReader(nil, filename, ReportReaderOptions{RejectsFile: rejectsFile, MaxRejects: 2}))
+	if err != nil {
+		t.Fatal("reader failed: ", err)
+	}
+	if len(results) != 2 || results[0].RequestedFile != "news/one.mxf" || results[1].RequestedFileSize != 400 {
+		t.Errorf("got incorrect results %v", results)
+	}
+
+	rejectsContent, openErr := os.Open(rejectsFile)
+	if openErr != nil {
+		t.Fatal("rejects file was not written: ", openErr)
+	}
+	defer rejectsContent.Close()
+	reader := csv.NewReader(rejectsContent)
+	reader.FieldsPerRecord = -1
+	rejectedRows, _ := reader.ReadAll()
+	if len(rejectedRows) != 3 || rejectedRows[1][0] != "3" || rejectedRows[2][0] != "4" || rejectedRows[1][4] != "news/two.mxf" {
+		t.Errorf("got incorrect rejects %v", rejectedRows)
+	}
+
+	_, limitErr := drainReader(AsyncCsvReader(nil, filename, ReportReaderOptions{MaxRejects: 1}))
+	if limitErr != TooManyRejects {
+		t.Errorf("expected TooManyRejects, got %v", limitErr)
+	}
+}
+
+func TestAsyncCsvReaderWithoutHeader(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "csv-reader-test")
+	defer os.RemoveAll(tempDir)
+	filename := path.Join(tempDir, "report.csv")
+
+	ioutil.WriteFile(filename, []byte("news/one.mxf,1,0,archive,\nnews/two.mxf,2,1,archive|other,s3://proxies/news/two.mp4\n"), 0640)
+
+	results, err := drainReader(AsyncCsvReader(nil, filename, ReportReaderOptions{}))
+	if err != nil {
+		t.Fatal("reader failed: ", err)
+	}
+	if len(results) != 2 || results[0].RequestedFile != "news/one.mxf" || len(results[1].Entries) != 2 || len(results[1].Proxies) != 1 {
+		t.Errorf("got incorrect results %v", results)
+	}
+}
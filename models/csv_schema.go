@@ -0,0 +1,368 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+column names used in the CSV reports. Version 2 reports are read by column name, so the order in
+LookupResultCSVHeader is only what we write and not what we require
+*/
+const (
+	CsvColSource                 = "Source"
+	CsvColSourceSize             = "Source size"
+	CsvColSourceStorageClass     = "Source storage class"
+	CsvColSourceLastModified     = "Source last modified"
+	CsvColDuplicatesCount        = "Duplicates count"
+	CsvColProxyCount             = "Proxy count"
+	CsvColDuplicatesBuckets      = "Duplicates buckets"
+	CsvColDuplicatesPaths        = "Duplicates paths"
+	CsvColDuplicatesSizes        = "Duplicates sizes"
+	CsvColDuplicatesStorageClass = "Duplicates storage classes"
+	CsvColDuplicatesLastModified = "Duplicates last modified"
+	CsvColProxyLocations         = "Proxy locations"
+	CsvColProxySizes             = "Proxy sizes"
+	CsvColInvalidProxies         = "Invalid proxies"
+	CsvColReportVersion          = "Report version"
+)
+
+/**
+version 3 added the report version column and escaping of the multi-valued columns
+*/
+const LookupResultCSVSchemaVersion = 3
+
+const lookupResultCSVMultiValueJoin = "|"
+
+func LookupResultCSVHeader() []string {
+	return []string{
+		CsvColSource,
+		CsvColSourceSize,
+		CsvColSourceStorageClass,
+		CsvColSourceLastModified,
+		CsvColDuplicatesCount,
+		CsvColProxyCount,
+		CsvColDuplicatesBuckets,
+		CsvColDuplicatesPaths,
+		CsvColDuplicatesSizes,
+		CsvColDuplicatesStorageClass,
+		CsvColDuplicatesLastModified,
+		CsvColProxyLocations,
+		CsvColProxySizes,
+		CsvColInvalidProxies,
+		CsvColReportVersion,
+	}
+}
+
+/**
+works out which version of the report schema a header row belongs to. Version 1 reports only had the five
+(or six) positional columns and no sizes; version 2 reports are identified by having a source size column and
+version 3 reports by having a report version column.
+*/
+func CSVSchemaVersion(header []string) int {
+	version := 1
+	for _, col := range header {
+		switch strings.TrimSpace(col) {
+		case CsvColReportVersion:
+			return LookupResultCSVSchemaVersion
+		case CsvColSourceSize:
+			version = 2
+		}
+	}
+	return version
+}
+
+/**
+maps column names onto their positions in a report
+*/
+type CSVColumnMap map[string]int
+
+func NewCSVColumnMap(header []string) CSVColumnMap {
+	columns := make(CSVColumnMap, len(header))
+	for i, col := range header {
+		columns[strings.TrimSpace(col)] = i
+	}
+	return columns
+}
+
+/**
+returns the value of the named column in the given row, or an empty string if it does not exist
+*/
+func (c CSVColumnMap) Get(row []string, name string) string {
+	idx, haveCol := c[name]
+	if !haveCol || idx >= len(row) {
+		return ""
+	}
+	return row[idx]
+}
+
+/**
+returns the values of a multi-valued column in the given row. Reports from before version 3 did not escape the
+values, so they are simply split on the delimiter
+*/
+func (c CSVColumnMap) GetList(row []string, name string) ([]string, error) {
+	if _, isEscaped := c[CsvColReportVersion]; isEscaped {
+		return splitMultiValue(c.Get(row, name))
+	}
+	return splitPlainMultiValue(c.Get(row, name)), nil
+}
+
+/**
+returns an error if any of the given columns are not present
+*/
+func (c CSVColumnMap) Require(names ...string) error {
+	for _, name := range names {
+		if _, haveCol := c[name]; !haveCol {
+			return fmt.Errorf("report has no '%s' column", name)
+		}
+	}
+	return nil
+}
+
+/**
+splits an unescaped multi-valued column, as written by version 1 and 2 reports. An empty column is an empty list
+*/
+func splitPlainMultiValue(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, lookupResultCSVMultiValueJoin)
+}
+
+/**
+a list holding just one empty value would otherwise be written the same way as an empty list
+*/
+const lookupResultCSVSingleEmptyValue = `\0`
+
+var multiValueEscaper = strings.NewReplacer(`\`, `\\`, lookupResultCSVMultiValueJoin, `\`+lookupResultCSVMultiValueJoin)
+
+/**
+joins a list of values into one column. Backslashes and delimiters inside values are escaped with a backslash, so
+that keys containing "|" survive the trip
+*/
+func joinMultiValue(values []string) string {
+	if len(values) == 1 && values[0] == "" {
+		return lookupResultCSVSingleEmptyValue
+	}
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = multiValueEscaper.Replace(value)
+	}
+	return strings.Join(escaped, lookupResultCSVMultiValueJoin)
+}
+
+/**
+the reverse of joinMultiValue
+*/
+func splitMultiValue(value string) ([]string, error) {
+	if value == "" {
+		return []string{}, nil
+	}
+	if value == lookupResultCSVSingleEmptyValue {
+		return []string{""}, nil
+	}
+
+	values := make([]string, 0)
+	current := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if i+1 >= len(value) || (value[i+1] != '\\' && value[i+1] != lookupResultCSVMultiValueJoin[0]) {
+				return nil, fmt.Errorf("invalid escape at position %d of multi-valued column", i)
+			}
+			i++
+			current.WriteByte(value[i])
+		case lookupResultCSVMultiValueJoin[0]:
+			values = append(values, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(value[i])
+		}
+	}
+	return append(values, current.String()), nil
+}
+
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func parseCSVTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func parseCSVInt(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+/**
+reads a row from a version 2 report, using the column map from its header row
+*/
+func LookupResultFromMappedCSVRow(columns CSVColumnMap, row []string) (*LookupResult, error) {
+	source := columns.Get(row, CsvColSource)
+	if source == "" {
+		return nil, errors.New("no source file on this row")
+	}
+
+	sourceSize, sizeErr := parseCSVInt(columns.Get(row, CsvColSourceSize))
+	if sizeErr != nil {
+		return nil, sizeErr
+	}
+	sourceLastModified, timeErr := parseCSVTime(columns.Get(row, CsvColSourceLastModified))
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	dupCount, dupCountErr := parseCSVInt(columns.Get(row, CsvColDuplicatesCount))
+	if dupCountErr != nil {
+		return nil, dupCountErr
+	}
+
+	buckets, bucketsErr := columns.GetList(row, CsvColDuplicatesBuckets)
+	if bucketsErr != nil {
+		return nil, bucketsErr
+	}
+	paths, pathsErr := columns.GetList(row, CsvColDuplicatesPaths)
+	if pathsErr != nil {
+		return nil, pathsErr
+	}
+	sizes, sizesErr := columns.GetList(row, CsvColDuplicatesSizes)
+	if sizesErr != nil {
+		return nil, sizesErr
+	}
+	storageClasses, storageClassesErr := columns.GetList(row, CsvColDuplicatesStorageClass)
+	if storageClassesErr != nil {
+		return nil, storageClassesErr
+	}
+	lastModifieds, lastModifiedsErr := columns.GetList(row, CsvColDuplicatesLastModified)
+	if lastModifiedsErr != nil {
+		return nil, lastModifiedsErr
+	}
+
+	entries := make([]FoundEntry, len(buckets))
+	for i, buck := range buckets {
+		entries[i].Bucket = buck
+		entries[i].Path = source
+		if i < len(paths) {
+			entries[i].Path = paths[i]
+		}
+		if i < len(sizes) {
+			size, err := parseCSVInt(sizes[i])
+			if err != nil {
+				return nil, err
+			}
+			entries[i].Size = size
+		}
+		if i < len(storageClasses) {
+			entries[i].StorageClass = storageClasses[i]
+		}
+		if i < len(lastModifieds) {
+			lastModified, err := parseCSVTime(lastModifieds[i])
+			if err != nil {
+				return nil, err
+			}
+			entries[i].LastModified = lastModified
+		}
+	}
+
+	proxyUris, proxyUrisErr := columns.GetList(row, CsvColProxyLocations)
+	if proxyUrisErr != nil {
+		return nil, proxyUrisErr
+	}
+	proxySizes, proxySizesErr := columns.GetList(row, CsvColProxySizes)
+	if proxySizesErr != nil {
+		return nil, proxySizesErr
+	}
+	invalidProxyUris, invalidProxyUrisErr := columns.GetList(row, CsvColInvalidProxies)
+	if invalidProxyUrisErr != nil {
+		return nil, invalidProxyUrisErr
+	}
+	invalidProxies := make(map[string]bool)
+	for _, invalidUri := range invalidProxyUris {
+		invalidProxies[invalidUri] = true
+	}
+
+	proxies := make([]FoundEntry, len(proxyUris))
+	for i, uri := range proxyUris {
+		foundEntryPtr, err := FoundEntryFromUriString(uri, true)
+		if err != nil {
+			return nil, fmt.Errorf("could not interpret proxy %d: %s", i, err)
+		}
+		proxies[i] = *foundEntryPtr
+		proxies[i].Invalid = invalidProxies[uri]
+		if i < len(proxySizes) {
+			size, err := parseCSVInt(proxySizes[i])
+			if err != nil {
+				return nil, err
+			}
+			proxies[i].Size = size
+		}
+	}
+
+	return &LookupResult{
+		RequestedFile:             source,
+		RequestedFileSize:         sourceSize,
+		RequestedFileStorageClass: columns.Get(row, CsvColSourceStorageClass),
+		RequestedFileLastModified: sourceLastModified,
+		Count:                     dupCount,
+		Entries:                   entries,
+		Proxies:                   proxies,
+	}, nil
+}
+
+/**
+renders the lookup result as a row matching LookupResultCSVHeader
+*/
+func (l *LookupResult) ToCSVRow() []string {
+	duplicateBuckets := make([]string, len(l.Entries))
+	duplicatePaths := make([]string, len(l.Entries))
+	duplicateSizes := make([]string, len(l.Entries))
+	duplicateStorageClasses := make([]string, len(l.Entries))
+	duplicateLastModifieds := make([]string, len(l.Entries))
+	for i, e := range l.Entries {
+		duplicateBuckets[i] = e.Bucket
+		duplicatePaths[i] = e.Path
+		duplicateSizes[i] = strconv.FormatInt(e.Size, 10)
+		duplicateStorageClasses[i] = e.StorageClass
+		duplicateLastModifieds[i] = formatCSVTime(e.LastModified)
+	}
+
+	proxyUris := make([]string, len(l.Proxies))
+	proxySizes := make([]string, len(l.Proxies))
+	invalidProxyUris := make([]string, 0)
+	for i, p := range l.Proxies {
+		proxyUris[i] = p.MustUri().String()
+		proxySizes[i] = strconv.FormatInt(p.Size, 10)
+		if p.Invalid {
+			invalidProxyUris = append(invalidProxyUris, proxyUris[i])
+		}
+	}
+
+	return []string{
+		l.RequestedFile,
+		strconv.FormatInt(l.RequestedFileSize, 10),
+		l.RequestedFileStorageClass,
+		formatCSVTime(l.RequestedFileLastModified),
+		strconv.FormatInt(l.Count, 10),
+		strconv.Itoa(len(l.Proxies)),
+		joinMultiValue(duplicateBuckets),
+		joinMultiValue(duplicatePaths),
+		joinMultiValue(duplicateSizes),
+		joinMultiValue(duplicateStorageClasses),
+		joinMultiValue(duplicateLastModifieds),
+		joinMultiValue(proxyUris),
+		joinMultiValue(proxySizes),
+		joinMultiValue(invalidProxyUris),
+		strconv.Itoa(LookupResultCSVSchemaVersion),
+	}
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLookupResultCSVRoundTrip(t *testing.T) {
+	original := &LookupResult{
+		RequestedFile:             "path/to/some_file.mxf",
+		RequestedFileSize:         123456,
+		RequestedFileStorageClass: "STANDARD",
+		RequestedFileLastModified: time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC),
+		Count:                     2,
+		Entries: []FoundEntry{
+			{Bucket: "archive-one", Path: "path/to/some_file.mxf", Size: 123456, StorageClass: "GLACIER", LastModified: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)},
+			{Bucket: "archive-two", Path: "other/path/some_file.mxf", Size: 123456, StorageClass: "STANDARD_IA"},
+		},
+		Proxies: []FoundEntry{
+			{Bucket: "proxies", Path: "path/to/some_file.mp4", Size: 789, IsProxy: true},
+			{Bucket: "proxies", Path: "path/to/some_file.jpg", Size: 0, IsProxy: true, Invalid: true},
+		},
+	}
+
+	columns := NewCSVColumnMap(LookupResultCSVHeader())
+	result, err := LookupResultFromMappedCSVRow(columns, original.ToCSVRow())
+	if err != nil {
+		t.Fatal("could not read back row: ", err)
+	}
+	if !reflect.DeepEqual(result, original) {
+		t.Errorf("round trip gave %v, expected %v", result, original)
+	}
+}
+
+func TestLookupResultFromReorderedCSVRow(t *testing.T) {
+	columns := NewCSVColumnMap([]string{"Duplicates count", "Source size", "Extra column", "Source", "Duplicates buckets"})
+	result, err := LookupResultFromMappedCSVRow(columns, []string{"1", "100", "ignored", "path/to/file.mxf", "archive"})
+	if err != nil {
+		t.Fatal("could not read row: ", err)
+	}
+	if result.RequestedFile != "path/to/file.mxf" || result.RequestedFileSize != 100 || result.Count != 1 {
+		t.Errorf("got incorrect result %v", result)
+	}
+	if len(result.Entries) != 1 || result.Entries[0].Bucket != "archive" || result.Entries[0].Path != "path/to/file.mxf" {
+		t.Errorf("got incorrect entries %v", result.Entries)
+	}
+	if len(result.Proxies) != 0 {
+		t.Errorf("expected no proxies, got %v", result.Proxies)
+	}
+}
+
+func TestCSVSchemaVersion(t *testing.T) {
+	if v := CSVSchemaVersion([]string{"Source", "Duplicates count", "Proxy count", "Duplicates buckets", "Proxy locations"}); v != 1 {
+		t.Errorf("expected version 1 for old header, got %d", v)
+	}
+	if v := CSVSchemaVersion([]string{"Source", "Source size", "Duplicates count", "Duplicates buckets"}); v != 2 {
+		t.Errorf("expected version 2 for header without a report version, got %d", v)
+	}
+	if v := CSVSchemaVersion(LookupResultCSVHeader()); v != LookupResultCSVSchemaVersion {
+		t.Errorf("expected version %d for current header, got %d", LookupResultCSVSchemaVersion, v)
+	}
+}
+
+func TestMultiValueRoundTrip(t *testing.T) {
+	lists := [][]string{
+		{},
+		{""},
+		{"", ""},
+		{"plain"},
+		{"with|pipe", `with\backslash`, `trailing\`, `\|`, "||"},
+		{`\0`},
+		{"a", "", "b"},
+	}
+	for _, list := range lists {
+		encoded := joinMultiValue(list)
+		decoded, err := splitMultiValue(encoded)
+		if err != nil {
+			t.Errorf("could not decode %q from %q: %s", encoded, list, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, list) {
+			t.Errorf("%q encoded as %q came back as %q", list, encoded, decoded)
+		}
+	}
+
+	if _, err := splitMultiValue(`bad\escape`); err == nil {
+		t.Error("expected an error for an invalid escape")
+	}
+}
+
+func TestLookupResultCSVRoundTripAwkwardKeys(t *testing.T) {
+	awkwardKeys := []string{
+		"news/pipe|in|the|name.mxf",
+		`news/back\slash\.mxf`,
+		"news/comma, \"quotes\" and spaces.mxf",
+		"news/plus+sign & ampersand.mxf",
+		"news/line\nbreak.mxf",
+		"news/ünïcödé 日本語.mxf",
+		"news/100% what?#.mxf",
+	}
+	for _, key := range awkwardKeys {
+		original := &LookupResult{
+			RequestedFile: key,
+			Count:         2,
+			Entries: []FoundEntry{
+				{Bucket: "archive-one", Path: key},
+				{Bucket: "archive-two", Path: "copy of " + key, StorageClass: "GLACIER"},
+			},
+			Proxies: []FoundEntry{
+				{Bucket: "proxies", Path: key + ".mp4", IsProxy: true, Invalid: true},
+			},
+		}
+
+		buffer := &bytes.Buffer{}
+		writer := csv.NewWriter(buffer)
+		writer.Write(LookupResultCSVHeader())
+		writer.Write(original.ToCSVRow())
+		writer.Flush()
+
+		rows, readErr := csv.NewReader(buffer).ReadAll()
+		if readErr != nil {
+			t.Fatalf("could not read back csv for %q: %s", key, readErr)
+		}
+		result, err := LookupResultFromMappedCSVRow(NewCSVColumnMap(rows[0]), rows[1])
+		if err != nil {
+			t.Errorf("could not read back row for %q: %s", key, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, original) {
+			t.Errorf("round trip of %q gave %v, expected %v", key, result, original)
+		}
+	}
+}
+
+func TestLookupResultFromVersion1RowWithEmptyLists(t *testing.T) {
+	result, err := LookupResultFromCSVRow(&[]string{"path/to/file.mxf", "0", "0", "", ""})
+	if err != nil {
+		t.Fatal("could not read row: ", err)
+	}
+	if len(result.Entries) != 0 || len(result.Proxies) != 0 {
+		t.Errorf("expected no entries or proxies, got %v and %v", result.Entries, result.Proxies)
+	}
+
+	result, err = LookupResultFromCSVRow(&[]string{"path/to/file.mxf", "2", "1", "archive-one|archive-two", "s3://proxies/path/to/file.mp4", "s3://proxies/path/to/file.mp4"})
+	if err != nil {
+		t.Fatal("could not read row: ", err)
+	}
+	if len(result.Entries) != 2 || len(result.Proxies) != 1 || !result.Proxies[0].Invalid {
+		t.Errorf("got incorrect result %v", result)
+	}
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"log"
+)
+
+/**
+reads a JSON-lines report in the background, passing each LookupResult onto the output channel and nil at the end.
+Lines that can't be read and the trailer are dealt with in the same way as AsyncCsvReader does.
+*/
+func AsyncJsonlReader(s3Client *s3.Client, filename string, options ReportReaderOptions) (chan *LookupResult, chan error) {
+	outputCh := make(chan *LookupResult, 100)
+	errCh := make(chan error, 1)
+
+	go func() {
+		rejects, rejectsErr := newRejectsRecorder(s3Client, "AsyncJsonlReader", options)
+		if rejectsErr != nil {
+			errCh <- rejectsErr
+			return
+		}
+		err := readJsonlReport(s3Client, filename, rejects, options.RequireTrailer, outputCh)
+		closeErr := rejects.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			errCh <- err
+			return
+		}
+		log.Print("INFO AsyncJsonlReader reached end of file, exiting")
+		outputCh <- nil
+	}()
+
+	return outputCh, errCh
+}
+
+func readJsonlReport(s3Client *s3.Client, filename string, rejects *rejectsRecorder, requireTrailer bool, outputCh chan *LookupResult) error {
+	file, openErr := OpenReport(s3Client, filename)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	lineCounter := 0
+	checksum := newReportChecksum()
+	var trailer *ReportTrailer
+	for scanner.Scan() {
+		lineCounter++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		if bytes.HasPrefix(scanner.Bytes(), []byte(jsonlTrailerPrefix)) {
+			var trailerLine jsonlTrailerLine
+			unmarshalErr := json.Unmarshal(scanner.Bytes(), &trailerLine)
+			if unmarshalErr != nil {
+				log.Printf("ERROR AsyncJsonlReader could not read the trailer at line %d: %s", lineCounter, unmarshalErr)
+				return ReportIncomplete
+			}
+			trailer = &trailerLine.EndOfReport
+			continue
+		}
+		if trailer != nil {
+			log.Printf("WARNING AsyncJsonlReader found data after the trailer at line %d of %s", lineCounter, filename)
+			trailer = nil
+		}
+		checksum.addLine(scanner.Bytes())
+
+		var result LookupResult
+		unmarshalErr := json.Unmarshal(scanner.Bytes(), &result)
+		if unmarshalErr == nil && result.RequestedFile == "" {
+			unmarshalErr = errors.New("no requested file on this line")
+		}
+		if unmarshalErr != nil {
+			rejectErr := rejects.Reject(lineCounter, unmarshalErr, []string{scanner.Text()})
+			if rejectErr != nil {
+				return rejectErr
+			}
+			continue
+		}
+		outputCh <- &result
+	}
+
+	if scanErr := scanner.Err(); scanErr != nil {
+		return scanErr
+	}
+	return checkTrailer("AsyncJsonlReader", filename, checksum, trailer, requireTrailer)
+}
+
+/**
+reads a report in the given format, which must be ReportFormatCSV or ReportFormatJSONL, from a local file or an
+s3:// URI
+*/
+func AsyncReportReader(s3Client *s3.Client, filename string, format string, options ReportReaderOptions) (chan *LookupResult, chan error) {
+	if format == ReportFormatJSONL {
+		return AsyncJsonlReader(s3Client, filename, options)
+	}
+	return AsyncCsvReader(s3Client, filename, options)
+}
+
+/**
+reads the whole of a report to make sure that it has a trailer and that the trailer matches its content, returning
+ReportIncomplete if not, or TooManyRejects if it has more unreadable rows than options allows. This is done before
+acting on a report, so that a truncated or edited report is caught before anything has been deleted. No rejects
+file is written; that is left to the real read.
+*/
+func VerifyReport(s3Client *s3.Client, filename string, format string, options ReportReaderOptions) error {
+	verifyOptions := ReportReaderOptions{MaxRejects: options.MaxRejects, RequireTrailer: true}
+	outputCh, errCh := AsyncReportReader(s3Client, filename, format, verifyOptions)
+
+	for {
+		select {
+		case rec := <-outputCh:
+			if rec == nil {
+				return nil
+			}
+		case err := <-errCh:
+			return err
+		}
+	}
+}
@@ -2,31 +2,56 @@ package models
 
 import (
 	"errors"
-	"fmt"
 	"log"
 	"net/url"
 	"strconv"
-	"strings"
+	"time"
 )
 
 type FoundEntry struct {
-	Bucket  string
-	Path    string
-	Size    int64
-	IsProxy bool
+	Bucket        string    `json:"bucket"`
+	Path          string    `json:"path"`
+	Region        *string   `json:"region"`
+	Size          int64     `json:"size"`
+	IsProxy       bool      `json:"isProxy"`
+	Invalid       bool      `json:"invalid"`
+	InvalidReason string    `json:"invalidReason"`
+	StorageClass  string    `json:"storageClass"`
+	LastModified  time.Time `json:"lastModified"`
+	ArchiveId     string    `json:"archiveId"`
+	Proxied       bool      `json:"proxied"`
+	Verification  string    `json:"verification,omitempty"`
+	//entries that must only be fetched and deleted once this one has been, i.e. the proxies of an original
+	Dependents []*FoundEntry `json:"-"`
+}
+
+/**
+values for FoundEntry.Verification, set once a local copy of the entry has been checked against S3. Only entries
+whose copy has been verified are safe to delete
+*/
+const (
+	VerificationNone         = ""
+	VerifiedEtag             = "etag-md5"
+	VerifiedMultipartEtag    = "etag-multipart"
+	VerificationFailed       = "failed"
+	VerificationUnverifiable = "unverifiable"
+)
+
+/**
+returns true if a local copy of this entry has been checked and matches what is in S3
+*/
+func (e FoundEntry) IsVerified() bool {
+	return e.Verification == VerifiedEtag || e.Verification == VerifiedMultipartEtag
 }
 
 func FoundEntryFromUri(from *url.URL, isProxy bool) (*FoundEntry, error) {
-	if from == nil {
-		return nil, errors.New("no data provided")
-	}
-	decodedPath, decodeErr := url.QueryUnescape(from.Path)
-	if decodeErr != nil {
-		return nil, decodeErr
+	bucket, key, uriErr := KeyFromUri(from)
+	if uriErr != nil {
+		return nil, uriErr
 	}
 	return &FoundEntry{
-		Bucket:  from.Host,
-		Path:    decodedPath,
+		Bucket:  bucket,
+		Path:    key,
 		Size:    0,
 		IsProxy: isProxy,
 	}, nil
@@ -41,7 +66,7 @@ func FoundEntryFromUriString(from string, isProxy bool) (*FoundEntry, error) {
 }
 
 func (e FoundEntry) ToUri() (*url.URL, error) {
-	return url.Parse(fmt.Sprintf("s3://%s/%s", e.Bucket, e.Path))
+	return KeyUri(e.Bucket, e.Path), nil
 }
 
 func (e FoundEntry) MustUri() *url.URL {
@@ -53,23 +78,20 @@ func (e FoundEntry) MustUri() *url.URL {
 }
 
 type LookupResult struct {
-	RequestedFile     string
-	RequestedFileSize int64
-	Count             int64
-	Entries           []FoundEntry
-	Proxies           []FoundEntry
-}
-
-func LookupResultCSVHeader() []string {
-	return []string{
-		"Source",
-		"Duplicates count",
-		"Proxy count",
-		"Duplicates buckets",
-		"Proxy locations",
-	}
+	RequestedFile             string       `json:"requestedFile"`
+	RequestedFileSize         int64        `json:"requestedFileSize"`
+	RequestedFileStorageClass string       `json:"requestedFileStorageClass"`
+	RequestedFileLastModified time.Time    `json:"requestedFileLastModified"`
+	Count                     int64        `json:"count"`
+	Entries                   []FoundEntry `json:"entries"`
+	Proxies                   []FoundEntry `json:"proxies"`
 }
 
+/**
+reads a row from a version 1 report, i.e. one that has the original positional columns
+"Source", "Duplicates count", "Proxy count", "Duplicates buckets", "Proxy locations" and optionally "Invalid proxies".
+These reports never recorded any sizes, so RequestedFileSize is always 0.
+*/
 func LookupResultFromCSVRow(row *[]string) (*LookupResult, error) {
 	if row == nil {
 		return nil, errors.New("no data was provided")
@@ -89,7 +111,7 @@ func LookupResultFromCSVRow(row *[]string) (*LookupResult, error) {
 	//	return nil, proxCountErr
 	//}
 
-	proxyUrlStrings := strings.Split((*row)[4], "|")
+	proxyUrlStrings := splitPlainMultiValue((*row)[4])
 	proxies := make([]FoundEntry, len(proxyUrlStrings))
 	for i, urlString := range proxyUrlStrings {
 		foundEntryPtr, err := FoundEntryFromUriString(urlString, true)
@@ -100,7 +122,18 @@ func LookupResultFromCSVRow(row *[]string) (*LookupResult, error) {
 		proxies[i] = *foundEntryPtr
 	}
 
-	entryBuckets := strings.Split((*row)[3], "|")
+	//older reports don't have the invalid proxies column
+	if len(*row) > 5 && (*row)[5] != "" {
+		for _, invalidUri := range splitPlainMultiValue((*row)[5]) {
+			for i := range proxies {
+				if proxies[i].MustUri().String() == invalidUri {
+					proxies[i].Invalid = true
+				}
+			}
+		}
+	}
+
+	entryBuckets := splitPlainMultiValue((*row)[3])
 	entries := make([]FoundEntry, len(entryBuckets))
 	for i, buck := range entryBuckets {
 		entries[i].Path = (*row)[0]
@@ -117,22 +150,3 @@ func LookupResultFromCSVRow(row *[]string) (*LookupResult, error) {
 	}
 	return rec, nil
 }
-
-func (l *LookupResult) ToCSVRow() []string {
-	duplicateBuckets := make([]string, len(l.Entries))
-	for i, e := range l.Entries {
-		duplicateBuckets[i] = e.Bucket
-	}
-	proxyUris := make([]string, len(l.Proxies))
-	for i, p := range l.Proxies {
-		proxyUris[i] = p.MustUri().String()
-	}
-
-	return []string{
-		l.RequestedFile,
-		fmt.Sprintf("%d", l.Count),
-		fmt.Sprintf("%d", len(l.Proxies)),
-		strings.Join(duplicateBuckets, "|"),
-		strings.Join(proxyUris, "|"),
-	}
-}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+)
+
+/**
+strip any file extension to get the prefix to search on for proxies
+*/
+func PrefixFromFilename(filename string) (string, bool) {
+	xtractor := regexp.MustCompile("^(.*)\\.([^.]+)$")
+	matches := xtractor.FindAllStringSubmatch(filename, -1)
+	if matches == nil {
+		return filename, false
+	} else {
+		return matches[0][1], true
+	}
+}
+
+/**
+reverses the proxy naming rule. A proxy is named by taking the original's path without its extension and adding
+anything after it, so the candidate originals are the proxy's path without its extension, then every shorter
+prefix of its file name that ends just before a '_', '-' or '.' (so "foo_lowres.mp4" gives "foo_lowres" and
+"foo"), then the stem with any of the given known proxy suffixes (e.g. "thumb") removed from the end, for suffixes
+that are not separated from the original's name.
+Over-matching only means that a proxy is kept when it could have been deleted, so every plausible cut is tried.
+Returns a list of stems, longest first and without duplicates; an original matches if it is equal to a stem or is
+a stem plus an extension
+*/
+func CandidateOriginalStems(proxyPath string, knownSuffixes []string) []string {
+	stem, _ := PrefixFromFilename(proxyPath)
+	candidates := []string{stem}
+	seen := map[string]bool{stem: true}
+	addCandidate := func(candidate string) {
+		if !seen[candidate] {
+			seen[candidate] = true
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	nameStart := strings.LastIndex(stem, "/") + 1
+	for i := len(stem) - 1; i > nameStart; i-- {
+		if strings.IndexByte("_-.", stem[i]) >= 0 {
+			addCandidate(stem[:i])
+		}
+	}
+	for _, suffix := range knownSuffixes {
+		if suffix != "" && strings.HasSuffix(stem, suffix) && len(stem)-len(suffix) > nameStart {
+			addCandidate(strings.TrimSuffix(stem, suffix))
+		}
+	}
+	return candidates
+}
+
+/**
+returns true if the given path could be the original for a proxy with the given stem
+*/
+func MatchesOriginalStem(originalPath string, stem string) bool {
+	if originalPath == stem {
+		return true
+	}
+	originalStem, hasExtension := PrefixFromFilename(originalPath)
+	return hasExtension && originalStem == stem
+}
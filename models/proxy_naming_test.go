@@ -0,0 +1,78 @@
+package models
+
+import "testing"
+
+func TestPrefixFromFilename(t *testing.T) {
+	firstResult, firstFound := PrefixFromFilename("path/to/some_file.mxf")
+	if !firstFound {
+		t.Error("nothing found for path/to/some_file.mxf")
+	}
+	if firstResult != "path/to/some_file" {
+		t.Errorf("got incorrect prefix '%s' on first test", firstResult)
+	}
+
+	secondResult, secondFound := PrefixFromFilename("path/to/some.file.with.dots.mc2")
+	if !secondFound {
+		t.Error("nothing found for second test")
+	}
+	if secondResult != "path/to/some.file.with.dots" {
+		t.Errorf("got incorrect prefix '%s' on second test", secondResult)
+	}
+
+	thirdResult, thirdFound := PrefixFromFilename("path/to/some_file")
+	if thirdFound {
+		t.Error("something found for third test")
+	}
+	if thirdResult != "path/to/some_file" {
+		t.Errorf("got incorrect prefix '%s' on third test", thirdResult)
+	}
+}
+
+func TestCandidateOriginalStems(t *testing.T) {
+	tests := []struct {
+		proxyPath string
+		suffixes  []string
+		expected  []string
+	}{
+		{"path/to/some_file_thumb.jpg", []string{"_thumb", "_poster"}, []string{"path/to/some_file_thumb", "path/to/some_file", "path/to/some"}},
+		{"path/to/somefile.mp4", []string{"_thumb"}, []string{"path/to/somefile"}},
+		//suffixes that aren't in the list are still cut off at a separator
+		{"path/to/foo_lowres.mp4", []string{"_thumb"}, []string{"path/to/foo_lowres", "path/to/foo"}},
+		{"path/to/foo-proxy-v2.mp4", []string{}, []string{"path/to/foo-proxy-v2", "path/to/foo-proxy", "path/to/foo"}},
+		{"path/to/foo.v2_lowres.mp4", []string{}, []string{"path/to/foo.v2_lowres", "path/to/foo.v2", "path/to/foo"}},
+		//known suffixes with no separator
+		{"path/to/clipthumb.jpg", []string{"thumb"}, []string{"path/to/clipthumb", "path/to/clip"}},
+		//never cut into the directory or down to an empty name
+		{"path_to/some-dir/_lowres.mp4", []string{"_lowres"}, []string{"path_to/some-dir/_lowres"}},
+		{"path/to/clipthumb.jpg", []string{"clipthumb"}, []string{"path/to/clipthumb"}},
+	}
+
+	for _, test := range tests {
+		result := CandidateOriginalStems(test.proxyPath, test.suffixes)
+		if len(result) != len(test.expected) {
+			t.Errorf("%s gave candidates %v, expected %v", test.proxyPath, result, test.expected)
+			continue
+		}
+		for i := range result {
+			if result[i] != test.expected[i] {
+				t.Errorf("%s gave candidates %v, expected %v", test.proxyPath, result, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestMatchesOriginalStem(t *testing.T) {
+	if !MatchesOriginalStem("path/to/some_file.mxf", "path/to/some_file") {
+		t.Error("original with extension did not match")
+	}
+	if !MatchesOriginalStem("path/to/some_file", "path/to/some_file") {
+		t.Error("original without extension did not match")
+	}
+	if MatchesOriginalStem("path/to/some_file2.mxf", "path/to/some_file") {
+		t.Error("different original matched")
+	}
+	if MatchesOriginalStem("path/to/some_file.old.mxf", "path/to/some_file") {
+		t.Error("original with extra dotted section matched")
+	}
+}
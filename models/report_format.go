@@ -0,0 +1,126 @@
+package models
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	ReportFormatAuto   = "auto"
+	ReportFormatCSV    = "csv"
+	ReportFormatJSONL  = "jsonl"
+	ReportFormatSQLite = "sqlite"
+)
+
+/**
+works out which report format to use. If `requested` is "auto" then the format is picked from the file extension
+(ignoring any compression extension), otherwise it must be one of the known formats
+*/
+func ReportFormatForFilename(filename string, requested string) (string, error) {
+	switch requested {
+	case ReportFormatCSV, ReportFormatJSONL, ReportFormatSQLite:
+		return requested, nil
+	case ReportFormatAuto, "":
+		switch strings.ToLower(path.Ext(StripCompressionExtension(filename))) {
+		case ".jsonl", ".ndjson":
+			return ReportFormatJSONL, nil
+		case ".sqlite", ".sqlite3", ".db":
+			return ReportFormatSQLite, nil
+		default:
+			return ReportFormatCSV, nil
+		}
+	default:
+		return "", fmt.Errorf("'%s' is not a recognised report format, expected %s, %s, %s or %s", requested, ReportFormatAuto, ReportFormatCSV, ReportFormatJSONL, ReportFormatSQLite)
+	}
+}
+
+/**
+writes LookupResults out in one of the report formats. Finish writes the trailer that marks the report as complete
+and flushes it; nothing should be written after that.
+*/
+type ReportWriter interface {
+	Write(rec *LookupResult) error
+	Flush() error
+	Finish() error
+}
+
+type csvReportWriter struct {
+	writer   *csv.Writer
+	checksum *reportChecksum
+}
+
+func (w *csvReportWriter) Write(rec *LookupResult) error {
+	row := rec.ToCSVRow()
+	w.checksum.addCSVRow(row)
+	return w.writer.Write(row)
+}
+
+func (w *csvReportWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func (w *csvReportWriter) Finish() error {
+	trailerErr := w.writer.Write(csvTrailerRow(w.checksum.Trailer(), len(LookupResultCSVHeader())))
+	if trailerErr != nil {
+		return trailerErr
+	}
+	return w.Flush()
+}
+
+/**
+writes each LookupResult as a single line of JSON, so that nothing is lost
+*/
+type jsonlReportWriter struct {
+	to       io.Writer
+	checksum *reportChecksum
+}
+
+func (w *jsonlReportWriter) writeLine(line []byte) error {
+	_, writeErr := w.to.Write(append(line, '\n'))
+	return writeErr
+}
+
+func (w *jsonlReportWriter) Write(rec *LookupResult) error {
+	line, marshalErr := json.Marshal(rec)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	w.checksum.addLine(line)
+	return w.writeLine(line)
+}
+
+func (w *jsonlReportWriter) Flush() error {
+	return nil
+}
+
+func (w *jsonlReportWriter) Finish() error {
+	line, marshalErr := json.Marshal(jsonlTrailerLine{EndOfReport: w.checksum.Trailer()})
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return w.writeLine(line)
+}
+
+/**
+returns a ReportWriter for the given format, writing any header that it needs straight away
+*/
+func NewReportWriter(format string, to io.Writer) (ReportWriter, error) {
+	switch format {
+	case ReportFormatCSV:
+		csvWriter := csv.NewWriter(to)
+		headerErr := csvWriter.Write(LookupResultCSVHeader())
+		if headerErr != nil {
+			return nil, headerErr
+		}
+		return &csvReportWriter{writer: csvWriter, checksum: newReportChecksum()}, nil
+	case ReportFormatJSONL:
+		return &jsonlReportWriter{to: to, checksum: newReportChecksum()}, nil
+	default:
+		return nil, fmt.Errorf("can't write reports in format '%s'", format)
+	}
+}
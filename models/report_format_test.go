@@ -0,0 +1,78 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestReportFormatForFilename(t *testing.T) {
+	tests := map[string]string{
+		"report.csv":    ReportFormatCSV,
+		"report.jsonl":  ReportFormatJSONL,
+		"report.NDJSON": ReportFormatJSONL,
+		"report":        ReportFormatCSV,
+	}
+	for filename, expected := range tests {
+		result, err := ReportFormatForFilename(filename, ReportFormatAuto)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %s", filename, err)
+		}
+		if result != expected {
+			t.Errorf("expected %s for %s, got %s", expected, filename, result)
+		}
+	}
+
+	forced, _ := ReportFormatForFilename("report.csv", ReportFormatJSONL)
+	if forced != ReportFormatJSONL {
+		t.Errorf("requested format was not respected, got %s", forced)
+	}
+
+	_, err := ReportFormatForFilename("report.csv", "xml")
+	if err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestJsonlRoundTrip(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "jsonl-test")
+	defer os.RemoveAll(tempDir)
+	filename := path.Join(tempDir, "report.jsonl")
+
+	region := "eu-west-1"
+	original := &LookupResult{
+		RequestedFile:     "path/to/some file+with|awkward,chars.mxf",
+		RequestedFileSize: 1234,
+		Count:             1,
+		Entries: []FoundEntry{
+			{Bucket: "archive", Path: "path/to/some file+with|awkward,chars.mxf", Region: &region, Size: 1234, ArchiveId: "abcd", Proxied: true},
+		},
+		Proxies: []FoundEntry{
+			{Bucket: "proxies", Path: "path/to/some file+with|awkward,chars.mp4", Size: 56, IsProxy: true, Invalid: true, InvalidReason: "too small"},
+		},
+	}
+
+	file, _ := os.Create(filename)
+	writer, writerErr := NewReportWriter(ReportFormatJSONL, file)
+	if writerErr != nil {
+		t.Fatal("could not create writer: ", writerErr)
+	}
+	writer.Write(original)
+	writer.Flush()
+	file.Close()
+
+	outputCh, errCh := AsyncReportReader(nil, filename, ReportFormatJSONL, ReportReaderOptions{})
+	select {
+	case result := <-outputCh:
+		if !reflect.DeepEqual(result, original) {
+			t.Errorf("round trip gave %v, expected %v", result, original)
+		}
+	case err := <-errCh:
+		t.Fatal("reader failed: ", err)
+	}
+	if endMarker := <-outputCh; endMarker != nil {
+		t.Error("expected end of stream after one record")
+	}
+}
@@ -0,0 +1,376 @@
+package models
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/**
+somewhere that a report is being written to. Close completes the report; Abort abandons it, so that nobody can
+mistake a partial report for a complete one.
+*/
+type ReportDestination interface {
+	io.Writer
+	Close() error
+	Abort() error
+}
+
+/**
+the report location that means stdout when writing and stdin when reading, so that the commands can be piped
+together
+*/
+const StdioLocation = "-"
+
+/**
+returns true if the given report location is stdin or stdout rather than a file
+*/
+func IsStdioLocation(location string) bool {
+	return location == StdioLocation
+}
+
+/**
+returns true if the given report location is an s3:// URI rather than a local file
+*/
+func IsS3Location(location string) bool {
+	return strings.HasPrefix(location, "s3://")
+}
+
+/**
+splits an s3:// URI into bucket and key
+*/
+func ParseS3Location(location string) (string, string, error) {
+	parsed, parseErr := url.Parse(location)
+	if parseErr != nil {
+		return "", "", parseErr
+	}
+	if parsed.Scheme != "s3" || parsed.Host == "" {
+		return "", "", fmt.Errorf("'%s' is not an s3:// URI", location)
+	}
+	key := strings.TrimPrefix(parsed.Path, "/")
+	if key == "" {
+		return "", "", fmt.Errorf("'%s' has no object key", location)
+	}
+	return parsed.Host, key, nil
+}
+
+/**
+writes to a temporary file alongside the real one, which is only renamed into place when the report is closed.
+That way a crashed run never leaves behind something that looks like a finished report.
+*/
+type localReportDestination struct {
+	file      *os.File
+	finalPath string
+}
+
+func newLocalReportDestination(location string) (*localReportDestination, error) {
+	dir, base := filepath.Split(location)
+	if dir == "" {
+		dir = "."
+	}
+	file, tempErr := ioutil.TempFile(dir, "."+base+".partial-*")
+	if tempErr != nil {
+		return nil, tempErr
+	}
+	chmodErr := file.Chmod(0640)
+	if chmodErr != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, chmodErr
+	}
+	return &localReportDestination{file: file, finalPath: location}, nil
+}
+
+func (d *localReportDestination) Write(p []byte) (int, error) {
+	return d.file.Write(p)
+}
+
+func (d *localReportDestination) Close() error {
+	syncErr := d.file.Sync()
+	if syncErr != nil {
+		d.Abort()
+		return syncErr
+	}
+	closeErr := d.file.Close()
+	if closeErr != nil {
+		os.Remove(d.file.Name())
+		return closeErr
+	}
+	renameErr := os.Rename(d.file.Name(), d.finalPath)
+	if renameErr != nil {
+		os.Remove(d.file.Name())
+		return renameErr
+	}
+	return nil
+}
+
+func (d *localReportDestination) Abort() error {
+	d.file.Close()
+	return os.Remove(d.file.Name())
+}
+
+/**
+writes the report straight to stdout. There is no way to take back what has already been written, so Abort can
+only log; a reader on the other end of the pipe will see that the trailer is missing.
+*/
+type stdoutReportDestination struct{}
+
+func (d stdoutReportDestination) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (d stdoutReportDestination) Close() error {
+	return nil
+}
+
+func (d stdoutReportDestination) Abort() error {
+	log.Print("WARNING report written to stdout was aborted, it will have no end-of-report trailer")
+	return nil
+}
+
+/**
+streams the report into a multipart upload as it is written. The object only appears in the bucket once Close
+has been called; if the upload is aborted then any parts uploaded so far are removed.
+*/
+type s3ReportDestination struct {
+	pipeWriter *io.PipeWriter
+	doneCh     chan error
+}
+
+var reportAborted = errors.New("report was aborted")
+
+func newS3ReportDestination(s3Client *s3.Client, bucket string, key string) *s3ReportDestination {
+	pipeReader, pipeWriter := io.Pipe()
+	dest := &s3ReportDestination{
+		pipeWriter: pipeWriter,
+		doneCh:     make(chan error, 1),
+	}
+
+	uploader := manager.NewUploader(s3Client, func(u *manager.Uploader) {
+		u.PartSize = 16 * 1024 * 1024
+		u.Concurrency = 2
+	})
+
+	go func() {
+		_, uploadErr := uploader.Upload(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   pipeReader,
+		})
+		if uploadErr != nil {
+			log.Printf("ERROR s3ReportDestination upload to s3://%s/%s failed: %s", bucket, key, uploadErr)
+		}
+		//make sure that the writing side gets unblocked if the upload failed part way through
+		pipeReader.CloseWithError(uploadErr)
+		dest.doneCh <- uploadErr
+	}()
+	return dest
+}
+
+func (d *s3ReportDestination) Write(p []byte) (int, error) {
+	return d.pipeWriter.Write(p)
+}
+
+func (d *s3ReportDestination) Close() error {
+	d.pipeWriter.Close()
+	return <-d.doneCh
+}
+
+func (d *s3ReportDestination) Abort() error {
+	d.pipeWriter.CloseWithError(reportAborted)
+	uploadErr := <-d.doneCh
+	if uploadErr != nil && !errors.Is(uploadErr, reportAborted) {
+		log.Printf("WARNING s3ReportDestination upload ended with %s while aborting", uploadErr)
+	}
+	return nil
+}
+
+/**
+compresses everything written to it before passing it on to the underlying destination
+*/
+type compressedReportDestination struct {
+	compressor io.WriteCloser
+	dest       ReportDestination
+}
+
+func (d *compressedReportDestination) Write(p []byte) (int, error) {
+	return d.compressor.Write(p)
+}
+
+func (d *compressedReportDestination) Close() error {
+	compressErr := d.compressor.Close()
+	if compressErr != nil {
+		d.dest.Abort()
+		return compressErr
+	}
+	return d.dest.Close()
+}
+
+func (d *compressedReportDestination) Abort() error {
+	return d.dest.Abort()
+}
+
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+/**
+works out which compression to use from the file extension
+*/
+func compressionFor(location string) string {
+	switch strings.ToLower(path.Ext(location)) {
+	case ".gz":
+		return compressionGzip
+	case ".zst", ".zstd":
+		return compressionZstd
+	default:
+		return compressionNone
+	}
+}
+
+/**
+removes any compression extension, so that e.g. "report.csv.gz" becomes "report.csv"
+*/
+func StripCompressionExtension(location string) string {
+	if compressionFor(location) == compressionNone {
+		return location
+	}
+	return strings.TrimSuffix(location, path.Ext(location))
+}
+
+/**
+opens a report for writing, either to a local file, streamed to an s3:// URI or to stdout for "-", compressing it
+if the location ends in .gz or .zst. Nothing appears at a file or s3 location until Close is called.
+*/
+func CreateReport(s3Client *s3.Client, location string) (ReportDestination, error) {
+	var dest ReportDestination
+	if IsStdioLocation(location) {
+		return stdoutReportDestination{}, nil
+	} else if IsS3Location(location) {
+		bucket, key, parseErr := ParseS3Location(location)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		dest = newS3ReportDestination(s3Client, bucket, key)
+	} else {
+		localDest, openErr := newLocalReportDestination(location)
+		if openErr != nil {
+			return nil, openErr
+		}
+		dest = localDest
+	}
+
+	switch compressionFor(location) {
+	case compressionGzip:
+		return &compressedReportDestination{compressor: gzip.NewWriter(dest), dest: dest}, nil
+	case compressionZstd:
+		encoder, encoderErr := zstd.NewWriter(dest)
+		if encoderErr != nil {
+			dest.Abort()
+			return nil, encoderErr
+		}
+		return &compressedReportDestination{compressor: encoder, dest: dest}, nil
+	default:
+		return dest, nil
+	}
+}
+
+/**
+deletes a report that has already been closed, either a local file or an s3:// URI. Used to take back a report
+that turned out to be part of a set that could not be completed.
+*/
+func RemoveReport(s3Client *s3.Client, location string) error {
+	if IsStdioLocation(location) {
+		return errors.New("can't remove a report that was written to stdout")
+	} else if IsS3Location(location) {
+		bucket, key, parseErr := ParseS3Location(location)
+		if parseErr != nil {
+			return parseErr
+		}
+		_, deleteErr := s3Client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return deleteErr
+	} else {
+		return os.Remove(location)
+	}
+}
+
+/**
+closes both the decompressor and the underlying source
+*/
+type decompressingReadCloser struct {
+	io.Reader
+	closeDecompressor func()
+	source            io.ReadCloser
+}
+
+func (r *decompressingReadCloser) Close() error {
+	r.closeDecompressor()
+	return r.source.Close()
+}
+
+/**
+opens a report for reading, either from a local file, streamed from an s3:// URI or from stdin for "-",
+decompressing it if the location ends in .gz or .zst
+*/
+func OpenReport(s3Client *s3.Client, location string) (io.ReadCloser, error) {
+	var source io.ReadCloser
+	if IsStdioLocation(location) {
+		return ioutil.NopCloser(os.Stdin), nil
+	} else if IsS3Location(location) {
+		bucket, key, parseErr := ParseS3Location(location)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		response, getErr := s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if getErr != nil {
+			return nil, getErr
+		}
+		source = response.Body
+	} else {
+		file, openErr := os.Open(location)
+		if openErr != nil {
+			return nil, openErr
+		}
+		source = file
+	}
+
+	switch compressionFor(location) {
+	case compressionGzip:
+		decompressor, gzErr := gzip.NewReader(source)
+		if gzErr != nil {
+			source.Close()
+			return nil, gzErr
+		}
+		return &decompressingReadCloser{Reader: decompressor, closeDecompressor: func() { decompressor.Close() }, source: source}, nil
+	case compressionZstd:
+		decompressor, zstdErr := zstd.NewReader(source)
+		if zstdErr != nil {
+			source.Close()
+			return nil, zstdErr
+		}
+		return &decompressingReadCloser{Reader: decompressor, closeDecompressor: decompressor.Close, source: source}, nil
+	default:
+		return source, nil
+	}
+}
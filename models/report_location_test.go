@@ -0,0 +1,84 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseS3Location(t *testing.T) {
+	bucket, key, err := ParseS3Location("s3://reports-bucket/scans/holding-pen.csv")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if bucket != "reports-bucket" || key != "scans/holding-pen.csv" {
+		t.Errorf("got incorrect bucket '%s' and key '%s'", bucket, key)
+	}
+
+	_, _, noKeyErr := ParseS3Location("s3://reports-bucket/")
+	if noKeyErr == nil {
+		t.Error("expected an error for a location with no key")
+	}
+
+	_, _, wrongSchemeErr := ParseS3Location("https://reports-bucket/holding-pen.csv")
+	if wrongSchemeErr == nil {
+		t.Error("expected an error for a non-s3 location")
+	}
+
+	if IsS3Location("holding-pen.csv") {
+		t.Error("local file was treated as an s3 location")
+	}
+}
+
+func TestStdioReportLocation(t *testing.T) {
+	pipeReader, pipeWriter, _ := os.Pipe()
+	realStdout, realStdin := os.Stdout, os.Stdin
+	defer func() {
+		os.Stdout, os.Stdin = realStdout, realStdin
+	}()
+
+	os.Stdout = pipeWriter
+	dest, createErr := CreateReport(nil, StdioLocation)
+	if createErr != nil {
+		t.Fatal("could not create stdout report: ", createErr)
+	}
+	writer, _ := NewReportWriter(ReportFormatJSONL, dest)
+	writer.Write(&LookupResult{RequestedFile: "news/one.mxf"})
+	writer.Finish()
+	dest.Close()
+	pipeWriter.Close()
+
+	os.Stdin = pipeReader
+	results, err := drainReader(AsyncReportReader(nil, StdioLocation, ReportFormatJSONL, ReportReaderOptions{RequireTrailer: true}))
+	if err != nil {
+		t.Fatal("could not read report from stdin: ", err)
+	}
+	if len(results) != 1 || results[0].RequestedFile != "news/one.mxf" {
+		t.Errorf("got incorrect results %v", results)
+	}
+}
+
+func TestLocalReportRenameFailure(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "report-location")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dir)
+	//a directory that isn't empty can't be replaced by the finished report
+	location := path.Join(dir, "holding-pen.csv")
+	os.MkdirAll(path.Join(location, "in-the-way"), 0755)
+
+	dest, createErr := CreateReport(nil, location)
+	if createErr != nil {
+		t.Fatal("could not create report: ", createErr)
+	}
+	dest.Write([]byte("some content\n"))
+	if dest.Close() == nil {
+		t.Fatal("expected an error closing a report that can't be renamed into place")
+	}
+	leftovers, _ := ioutil.ReadDir(dir)
+	if len(leftovers) != 1 {
+		t.Errorf("expected only the directory in the way to be left, got %d entries", len(leftovers))
+	}
+}
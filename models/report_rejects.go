@@ -0,0 +1,102 @@
+package models
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"log"
+	"strconv"
+)
+
+/**
+returned by the report readers once more rows have been rejected than ReportReaderOptions.MaxRejects allows
+*/
+var TooManyRejects = errors.New("too many rows in the report could not be read")
+
+/**
+controls how the report readers deal with rows that they can't read, and with reports that have no trailer
+*/
+type ReportReaderOptions struct {
+	//if set, every rejected row is written to this local file or s3:// URI along with its line number and the reason
+	RejectsFile string
+	//the reader fails with TooManyRejects once more than this many rows have been rejected. Negative means no limit
+	MaxRejects int
+	//if set, a report with no end-of-report trailer is treated as incomplete rather than being read with a warning
+	RequireTrailer bool
+}
+
+/**
+keeps track of rejected rows, and writes them out if a rejects file was requested
+*/
+type rejectsRecorder struct {
+	readerName string
+	options    ReportReaderOptions
+	dest       ReportDestination
+	writer     *csv.Writer
+	count      int
+}
+
+func newRejectsRecorder(s3Client *s3.Client, readerName string, options ReportReaderOptions) (*rejectsRecorder, error) {
+	recorder := &rejectsRecorder{readerName: readerName, options: options}
+	if options.RejectsFile == "" {
+		return recorder, nil
+	}
+
+	dest, createErr := CreateReport(s3Client, options.RejectsFile)
+	if createErr != nil {
+		return nil, createErr
+	}
+	recorder.dest = dest
+	recorder.writer = csv.NewWriter(dest)
+	headerErr := recorder.writer.Write([]string{"Line", "Reason", "Content"})
+	if headerErr != nil {
+		dest.Abort()
+		return nil, headerErr
+	}
+	return recorder, nil
+}
+
+/**
+records that the given line could not be read. Returns TooManyRejects if that takes us over the limit, or an error
+if the rejects file could not be written.
+*/
+func (r *rejectsRecorder) Reject(line int, reason error, content []string) error {
+	r.count++
+	log.Printf("WARNING %s rejected line %d: %s", r.readerName, line, reason)
+
+	if r.writer != nil {
+		writeErr := r.writer.Write(append([]string{strconv.Itoa(line), reason.Error()}, content...))
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+
+	if r.options.MaxRejects >= 0 && r.count > r.options.MaxRejects {
+		log.Printf("ERROR %s has rejected %d rows, more than the limit of %d", r.readerName, r.count, r.options.MaxRejects)
+		return TooManyRejects
+	}
+	return nil
+}
+
+/**
+finishes the rejects file, if there is one. It is kept even if the read failed, since that is when it is most useful
+*/
+func (r *rejectsRecorder) Close() error {
+	if r.count > 0 {
+		log.Printf("WARNING %s rejected %d rows in total", r.readerName, r.count)
+	}
+	if r.writer == nil {
+		return nil
+	}
+	r.writer.Flush()
+	if flushErr := r.writer.Error(); flushErr != nil {
+		r.dest.Abort()
+		return flushErr
+	}
+	closeErr := r.dest.Close()
+	if closeErr != nil {
+		return fmt.Errorf("could not write rejects file %s: %s", r.options.RejectsFile, closeErr)
+	}
+	return nil
+}
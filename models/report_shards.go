@@ -0,0 +1,329 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	ShardByCount  = "count"
+	ShardByBytes  = "bytes"
+	ShardByPrefix = "prefix"
+)
+
+/**
+how a report should be split up. A Count of 0 or 1 means that the report is not sharded
+*/
+type ShardOptions struct {
+	Count    int
+	Strategy string
+}
+
+func (o ShardOptions) Enabled() bool {
+	return o.Count > 1
+}
+
+func (o ShardOptions) Validate() error {
+	if o.Count < 0 {
+		return fmt.Errorf("shard count can't be negative")
+	}
+	switch o.Strategy {
+	case ShardByCount, ShardByBytes, ShardByPrefix:
+		return nil
+	default:
+		return fmt.Errorf("'%s' is not a recognised shard strategy, expected %s, %s or %s", o.Strategy, ShardByCount, ShardByBytes, ShardByPrefix)
+	}
+}
+
+/**
+one entry in the shard manifest. Location is relative to the manifest, so that the whole set can be moved around
+together
+*/
+type ShardInfo struct {
+	Index    int      `json:"index"`
+	Location string   `json:"location"`
+	Records  int64    `json:"records"`
+	Bytes    int64    `json:"bytes"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+/**
+written next to a sharded report, listing the shards that it was split into
+*/
+type ShardManifest struct {
+	Strategy  string      `json:"strategy"`
+	Format    string      `json:"format"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Shards    []ShardInfo `json:"shards"`
+}
+
+/**
+returns the location of the given shard (counting from 1) of a report, e.g. "report.csv.gz" becomes
+"report.shard-002-of-004.csv.gz"
+*/
+func ShardLocation(location string, index int, count int) string {
+	uncompressed := StripCompressionExtension(location)
+	compressionExt := strings.TrimPrefix(location, uncompressed)
+	ext := path.Ext(uncompressed)
+	return fmt.Sprintf("%s.shard-%03d-of-%03d%s%s", strings.TrimSuffix(uncompressed, ext), index, count, ext, compressionExt)
+}
+
+/**
+returns the location of the shard manifest for a report, e.g. "report.csv.gz" becomes "report.shards.json"
+*/
+func ShardManifestLocation(location string) string {
+	uncompressed := StripCompressionExtension(location)
+	return strings.TrimSuffix(uncompressed, path.Ext(uncompressed)) + ".shards.json"
+}
+
+/**
+resolves a location relative to the directory (or s3 prefix) that `alongside` is in
+*/
+func siblingLocation(alongside string, name string) string {
+	lastSlash := strings.LastIndex(alongside, "/")
+	if lastSlash == -1 || (IsS3Location(alongside) && lastSlash < len("s3://")) {
+		return name
+	}
+	return alongside[:lastSlash+1] + name
+}
+
+func baseLocation(location string) string {
+	return location[strings.LastIndex(location, "/")+1:]
+}
+
+/**
+returns the full location of the given shard (counting from 1) in a manifest that was read from manifestLocation
+*/
+func (m *ShardManifest) ShardLocation(manifestLocation string, index int) (string, error) {
+	for _, shard := range m.Shards {
+		if shard.Index == index {
+			return siblingLocation(manifestLocation, shard.Location), nil
+		}
+	}
+	return "", fmt.Errorf("manifest has no shard %d, it has %d shards", index, len(m.Shards))
+}
+
+/**
+reads a shard manifest from a local file or s3:// URI
+*/
+func ReadShardManifest(s3Client *s3.Client, location string) (*ShardManifest, error) {
+	file, openErr := OpenReport(s3Client, location)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer file.Close()
+
+	content, readErr := ioutil.ReadAll(file)
+	if readErr != nil {
+		return nil, readErr
+	}
+	var manifest ShardManifest
+	unmarshalErr := json.Unmarshal(content, &manifest)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return &manifest, nil
+}
+
+type reportShard struct {
+	location string
+	dest     ReportDestination
+	writer   ReportWriter
+	info     ShardInfo
+}
+
+/**
+splits a report across several shard files as it is written, so that separate deletion runs can work on disjoint
+parts of the holding pen. Every record goes to exactly one shard, and each shard is a complete report in its own
+right with its own trailer. When the report is finished a manifest listing the shards is written alongside it.
+*/
+type ShardedReport struct {
+	s3Client      *s3.Client
+	location      string
+	format        string
+	strategy      string
+	shards        []*reportShard
+	nextShard     int
+	prefixToShard map[string]int
+}
+
+func CreateShardedReport(s3Client *s3.Client, location string, format string, options ShardOptions) (*ShardedReport, error) {
+	validateErr := options.Validate()
+	if validateErr != nil {
+		return nil, validateErr
+	}
+
+	report := &ShardedReport{
+		s3Client:      s3Client,
+		location:      location,
+		format:        format,
+		strategy:      options.Strategy,
+		shards:        make([]*reportShard, 0, options.Count),
+		prefixToShard: make(map[string]int),
+	}
+
+	for i := 1; i <= options.Count; i++ {
+		shardLocation := ShardLocation(location, i, options.Count)
+		dest, createErr := CreateReport(s3Client, shardLocation)
+		if createErr != nil {
+			report.Abort()
+			return nil, createErr
+		}
+		writer, writerErr := NewReportWriter(format, dest)
+		if writerErr != nil {
+			dest.Abort()
+			report.Abort()
+			return nil, writerErr
+		}
+		report.shards = append(report.shards, &reportShard{
+			location: shardLocation,
+			dest:     dest,
+			writer:   writer,
+			info:     ShardInfo{Index: i, Location: baseLocation(shardLocation)},
+		})
+	}
+	return report, nil
+}
+
+/**
+returns the index of the shard with the fewest bytes in it so far
+*/
+func (r *ShardedReport) smallestShard() int {
+	smallest := 0
+	for i, shard := range r.shards {
+		if shard.info.Bytes < r.shards[smallest].info.Bytes {
+			smallest = i
+		}
+	}
+	return smallest
+}
+
+/**
+the top-level folder of a path, or "" for files at the root of the bucket
+*/
+func topLevelPrefix(filePath string) string {
+	parts := strings.SplitN(filePath, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[0]
+}
+
+/**
+works out which shard a record belongs in. Counting is round-robin; bytes puts each record in the shard that is
+currently smallest; prefix keeps each top-level folder together, putting a new folder in the shard that is
+currently smallest. Since the bucket is listed in key order, folders arrive one after another.
+*/
+func (r *ShardedReport) pickShard(rec *LookupResult) int {
+	switch r.strategy {
+	case ShardByBytes:
+		return r.smallestShard()
+	case ShardByPrefix:
+		prefix := topLevelPrefix(rec.RequestedFile)
+		if shardIdx, haveShard := r.prefixToShard[prefix]; haveShard {
+			return shardIdx
+		}
+		shardIdx := r.smallestShard()
+		r.prefixToShard[prefix] = shardIdx
+		r.shards[shardIdx].info.Prefixes = append(r.shards[shardIdx].info.Prefixes, prefix)
+		return shardIdx
+	default:
+		shardIdx := r.nextShard
+		r.nextShard = (r.nextShard + 1) % len(r.shards)
+		return shardIdx
+	}
+}
+
+func (r *ShardedReport) Write(rec *LookupResult) error {
+	shard := r.shards[r.pickShard(rec)]
+	shard.info.Records++
+	shard.info.Bytes += rec.RequestedFileSize
+	return shard.writer.Write(rec)
+}
+
+/**
+finishes every shard and only then closes them, so that no shard is committed unless all of them could be written
+out. If a shard still fails to close, or the manifest can't be written, then the shards that were already closed
+are removed again. A shard that has no manifest alongside it must not be used, since the rest of its report may be
+missing.
+*/
+func (r *ShardedReport) Finish() error {
+	manifest := ShardManifest{
+		Strategy:  r.strategy,
+		Format:    r.format,
+		CreatedAt: time.Now(),
+		Shards:    make([]ShardInfo, 0, len(r.shards)),
+	}
+
+	for _, shard := range r.shards {
+		finishErr := shard.writer.Finish()
+		if finishErr != nil {
+			r.Abort()
+			return finishErr
+		}
+	}
+
+	for i, shard := range r.shards {
+		closeErr := shard.dest.Close()
+		if closeErr != nil {
+			//Close has already cleaned up the shard that failed
+			for _, remaining := range r.shards[i+1:] {
+				remaining.dest.Abort()
+			}
+			r.removeShards(r.shards[:i])
+			return closeErr
+		}
+		manifest.Shards = append(manifest.Shards, shard.info)
+	}
+
+	manifestErr := r.writeManifest(&manifest)
+	if manifestErr != nil {
+		r.removeShards(r.shards)
+		return manifestErr
+	}
+	return nil
+}
+
+func (r *ShardedReport) writeManifest(manifest *ShardManifest) error {
+	content, marshalErr := json.MarshalIndent(manifest, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	dest, createErr := CreateReport(r.s3Client, ShardManifestLocation(r.location))
+	if createErr != nil {
+		return createErr
+	}
+	_, writeErr := dest.Write(content)
+	if writeErr != nil {
+		dest.Abort()
+		return writeErr
+	}
+	return dest.Close()
+}
+
+/**
+takes back shards that have already been closed, when the sharded report as a whole could not be completed
+*/
+func (r *ShardedReport) removeShards(closed []*reportShard) {
+	for _, shard := range closed {
+		removeErr := RemoveReport(r.s3Client, shard.location)
+		if removeErr != nil {
+			log.Printf("ERROR could not remove incomplete shard %s, it must not be used: %s", shard.location, removeErr)
+		}
+	}
+}
+
+/**
+abandons every shard before any of them has been closed, so that none of them are left looking complete
+*/
+func (r *ShardedReport) Abort() {
+	for _, shard := range r.shards {
+		shard.dest.Abort()
+	}
+}
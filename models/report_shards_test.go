@@ -0,0 +1,148 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestShardLocation(t *testing.T) {
+	if got := ShardLocation("s3://reports/holding-pen.csv.gz", 2, 4); got != "s3://reports/holding-pen.shard-002-of-004.csv.gz" {
+		t.Errorf("got incorrect shard location %s", got)
+	}
+	if got := ShardManifestLocation("holding-pen.jsonl.zst"); got != "holding-pen.shards.json" {
+		t.Errorf("got incorrect manifest location %s", got)
+	}
+	if got := siblingLocation("s3://reports/scans/holding-pen.shards.json", "holding-pen.shard-001-of-002.csv"); got != "s3://reports/scans/holding-pen.shard-001-of-002.csv" {
+		t.Errorf("got incorrect sibling location %s", got)
+	}
+	if got := siblingLocation("holding-pen.shards.json", "holding-pen.shard-001-of-002.csv"); got != "holding-pen.shard-001-of-002.csv" {
+		t.Errorf("got incorrect sibling location %s", got)
+	}
+}
+
+func readAllRecords(t *testing.T, filename string, format string) []*LookupResult {
+	results, err := drainReader(AsyncReportReader(nil, filename, format, ReportReaderOptions{}))
+	if err != nil {
+		t.Fatalf("could not read %s: %s", filename, err)
+	}
+	return results
+}
+
+func TestShardedReport(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "shard-test")
+	defer os.RemoveAll(tempDir)
+
+	records := []*LookupResult{
+		{RequestedFile: "news/one.mxf", RequestedFileSize: 500},
+		{RequestedFile: "news/two.mxf", RequestedFileSize: 500},
+		{RequestedFile: "sport/three.mxf", RequestedFileSize: 100},
+		{RequestedFile: "sport/four.mxf", RequestedFileSize: 100},
+		{RequestedFile: "weather/five.mxf", RequestedFileSize: 100},
+		{RequestedFile: "six.mxf", RequestedFileSize: 10},
+	}
+
+	for _, strategy := range []string{ShardByCount, ShardByBytes, ShardByPrefix} {
+		location := path.Join(tempDir, strategy+".csv")
+		report, createErr := CreateShardedReport(nil, location, ReportFormatCSV, ShardOptions{Count: 2, Strategy: strategy})
+		if createErr != nil {
+			t.Fatal("could not create sharded report: ", createErr)
+		}
+		for _, rec := range records {
+			report.Write(rec)
+		}
+		finishErr := report.Finish()
+		if finishErr != nil {
+			t.Fatal("could not finish sharded report: ", finishErr)
+		}
+
+		manifestLocation := ShardManifestLocation(location)
+		manifest, manifestErr := ReadShardManifest(nil, manifestLocation)
+		if manifestErr != nil {
+			t.Fatal("could not read manifest: ", manifestErr)
+		}
+		if len(manifest.Shards) != 2 || manifest.Strategy != strategy {
+			t.Fatalf("got incorrect manifest %v", manifest)
+		}
+
+		seen := make(map[string]int)
+		for _, shard := range manifest.Shards {
+			shardLocation, _ := manifest.ShardLocation(manifestLocation, shard.Index)
+			if verifyErr := VerifyReport(nil, shardLocation, ReportFormatCSV, ReportReaderOptions{}); verifyErr != nil {
+				t.Errorf("shard %s failed verification: %s", shardLocation, verifyErr)
+			}
+			shardRecords := readAllRecords(t, shardLocation, ReportFormatCSV)
+			if int64(len(shardRecords)) != shard.Records {
+				t.Errorf("manifest says shard %d has %d records but it has %d", shard.Index, shard.Records, len(shardRecords))
+			}
+			for _, rec := range shardRecords {
+				seen[rec.RequestedFile] = shard.Index
+			}
+		}
+		if len(seen) != len(records) {
+			t.Errorf("%s sharding lost or duplicated records: %v", strategy, seen)
+		}
+
+		switch strategy {
+		case ShardByCount:
+			if manifest.Shards[0].Records != 3 || manifest.Shards[1].Records != 3 {
+				t.Errorf("count sharding is unbalanced: %v", manifest.Shards)
+			}
+		case ShardByPrefix:
+			if seen["news/one.mxf"] != seen["news/two.mxf"] || seen["sport/three.mxf"] != seen["sport/four.mxf"] {
+				t.Errorf("prefix sharding split a folder: %v", seen)
+			}
+		}
+	}
+}
+
+/**
+blocks a report from being renamed into place by putting a non-empty directory where it should go
+*/
+func blockLocation(t *testing.T, location string) {
+	if mkErr := os.MkdirAll(path.Join(location, "blocker"), 0755); mkErr != nil {
+		t.Fatal("could not block location: ", mkErr)
+	}
+}
+
+func TestShardedReportFailureLeavesNoShards(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "shard-test")
+	defer os.RemoveAll(tempDir)
+
+	for _, blocked := range []string{"last shard", "manifest"} {
+		location := path.Join(tempDir, strings.Replace(blocked, " ", "-", -1)+".csv")
+		report, createErr := CreateShardedReport(nil, location, ReportFormatCSV, ShardOptions{Count: 3, Strategy: ShardByCount})
+		if createErr != nil {
+			t.Fatal("could not create sharded report: ", createErr)
+		}
+		for _, name := range []string{"one.mxf", "two.mxf", "three.mxf"} {
+			report.Write(&LookupResult{RequestedFile: name, Count: 1})
+		}
+		if blocked == "manifest" {
+			blockLocation(t, ShardManifestLocation(location))
+		} else {
+			blockLocation(t, ShardLocation(location, 3, 3))
+		}
+
+		if finishErr := report.Finish(); finishErr == nil {
+			t.Fatalf("finishing with the %s blocked should have failed", blocked)
+		}
+		for i := 1; i <= 3; i++ {
+			shardLocation := ShardLocation(location, i, 3)
+			if info, statErr := os.Stat(shardLocation); statErr == nil && !info.IsDir() {
+				t.Errorf("with the %s blocked, shard %s was left behind", blocked, shardLocation)
+			}
+		}
+		if info, statErr := os.Stat(ShardManifestLocation(location)); statErr == nil && !info.IsDir() {
+			t.Errorf("with the %s blocked, a manifest was written", blocked)
+		}
+	}
+	leftovers, _ := ioutil.ReadDir(tempDir)
+	for _, entry := range leftovers {
+		if strings.Contains(entry.Name(), ".partial-") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+}
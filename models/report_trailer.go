@@ -0,0 +1,117 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+/**
+the first cell of the trailer row in CSV reports, and the key of the trailer object in JSONL reports
+*/
+const (
+	csvTrailerMarker   = "#END-OF-REPORT"
+	jsonlTrailerPrefix = `{"endOfReport":`
+)
+
+/**
+returned by the report readers if a report has no trailer, or its trailer does not match its content
+*/
+var ReportIncomplete = errors.New("report is incomplete or has been modified since it was written")
+
+/**
+written as the last line of every report, so that a reader can tell that it got the whole thing
+*/
+type ReportTrailer struct {
+	Records int64  `json:"records"`
+	Sha256  string `json:"sha256"`
+}
+
+/**
+the JSONL form of the trailer
+*/
+type jsonlTrailerLine struct {
+	EndOfReport ReportTrailer `json:"endOfReport"`
+}
+
+/**
+keeps a running count and SHA-256 of the records in a report. For CSV the hash covers the cell values, not the
+bytes on disk, so that it does not depend on how the CSV was quoted
+*/
+type reportChecksum struct {
+	hash    hash.Hash
+	records int64
+}
+
+func newReportChecksum() *reportChecksum {
+	return &reportChecksum{hash: sha256.New()}
+}
+
+func (c *reportChecksum) addCSVRow(row []string) {
+	c.hash.Write([]byte(strings.Join(row, "\x1f")))
+	c.hash.Write([]byte("\n"))
+	c.records++
+}
+
+func (c *reportChecksum) addLine(line []byte) {
+	c.hash.Write(line)
+	c.hash.Write([]byte("\n"))
+	c.records++
+}
+
+func (c *reportChecksum) Trailer() ReportTrailer {
+	return ReportTrailer{
+		Records: c.records,
+		Sha256:  hex.EncodeToString(c.hash.Sum(nil)),
+	}
+}
+
+/**
+returns nil if the trailer matches what was read, or ReportIncomplete if not
+*/
+func (c *reportChecksum) Verify(trailer ReportTrailer) error {
+	if c.Trailer() != trailer {
+		return ReportIncomplete
+	}
+	return nil
+}
+
+/**
+returns true if the row could be a trailer, i.e. it has the marker followed by a record count and a SHA-256. Data
+can still look like this, so only the last row of a report is ever taken as the trailer
+*/
+func isCSVTrailer(row []string) bool {
+	if len(row) < 3 || row[0] != csvTrailerMarker {
+		return false
+	}
+	_, trailerErr := csvTrailerFromRow(row)
+	return trailerErr == nil
+}
+
+/**
+renders the trailer as a CSV row, padded out to the width of the header so that other tools can still read it
+*/
+func csvTrailerRow(trailer ReportTrailer, width int) []string {
+	row := []string{csvTrailerMarker, strconv.FormatInt(trailer.Records, 10), trailer.Sha256}
+	for len(row) < width {
+		row = append(row, "")
+	}
+	return row
+}
+
+func csvTrailerFromRow(row []string) (ReportTrailer, error) {
+	if len(row) < 3 {
+		return ReportTrailer{}, ReportIncomplete
+	}
+	records, parseErr := parseCSVInt(row[1])
+	if parseErr != nil {
+		return ReportTrailer{}, ReportIncomplete
+	}
+	if _, hexErr := hex.DecodeString(row[2]); hexErr != nil || len(row[2]) != sha256.Size*2 {
+		return ReportTrailer{}, ReportIncomplete
+	}
+	return ReportTrailer{Records: records, Sha256: row[2]}, nil
+}
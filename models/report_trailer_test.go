@@ -0,0 +1,128 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeTestReport(t *testing.T, filename string, format string, finish bool) {
+	dest, createErr := CreateReport(nil, filename)
+	if createErr != nil {
+		t.Fatal("could not create report: ", createErr)
+	}
+	writer, writerErr := NewReportWriter(format, dest)
+	if writerErr != nil {
+		t.Fatal("could not create writer: ", writerErr)
+	}
+	for _, name := range []string{"news/one.mxf", "news/two, with a comma.mxf", "sport/three.mp4"} {
+		writer.Write(&LookupResult{RequestedFile: name, RequestedFileSize: 100})
+	}
+	if finish {
+		writer.Finish()
+	} else {
+		writer.Flush()
+	}
+	closeErr := dest.Close()
+	if closeErr != nil {
+		t.Fatal("could not close report: ", closeErr)
+	}
+}
+
+func TestVerifyReport(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "trailer-test")
+	defer os.RemoveAll(tempDir)
+
+	for _, name := range []string{"report.csv", "report.csv.gz", "report.jsonl.zst"} {
+		filename := path.Join(tempDir, name)
+		format, _ := ReportFormatForFilename(filename, ReportFormatAuto)
+		writeTestReport(t, filename, format, true)
+		if err := VerifyReport(nil, filename, format, ReportReaderOptions{}); err != nil {
+			t.Errorf("complete report %s failed verification: %s", name, err)
+		}
+
+		outputCh, errCh := AsyncReportReader(nil, filename, format, ReportReaderOptions{})
+		count := 0
+		for done := false; !done; {
+			select {
+			case rec := <-outputCh:
+				if rec == nil {
+					done = true
+				} else {
+					count++
+				}
+			case err := <-errCh:
+				t.Fatalf("reading %s failed: %s", name, err)
+			}
+		}
+		if count != 3 {
+			t.Errorf("read %d records from %s, expected 3", count, name)
+		}
+	}
+
+	noTrailer := path.Join(tempDir, "unfinished.csv")
+	writeTestReport(t, noTrailer, ReportFormatCSV, false)
+	if err := VerifyReport(nil, noTrailer, ReportFormatCSV, ReportReaderOptions{}); err != ReportIncomplete {
+		t.Errorf("report without a trailer gave %v, expected ReportIncomplete", err)
+	}
+}
+
+func TestVerifyReportDetectsChanges(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "trailer-test")
+	defer os.RemoveAll(tempDir)
+
+	for _, format := range []string{ReportFormatCSV, ReportFormatJSONL} {
+		filename := path.Join(tempDir, "report."+format)
+		writeTestReport(t, filename, format, true)
+		content, _ := ioutil.ReadFile(filename)
+
+		edited := strings.Replace(string(content), "sport/three.mp4", "sport/four.mp4", 1)
+		ioutil.WriteFile(filename, []byte(edited), 0640)
+		if err := VerifyReport(nil, filename, format, ReportReaderOptions{}); err != ReportIncomplete {
+			t.Errorf("edited %s report gave %v, expected ReportIncomplete", format, err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		dropped := strings.Join(append(lines[:1], lines[2:]...), "\n") + "\n"
+		ioutil.WriteFile(filename, []byte(dropped), 0640)
+		if err := VerifyReport(nil, filename, format, ReportReaderOptions{}); err != ReportIncomplete {
+			t.Errorf("%s report with a missing line gave %v, expected ReportIncomplete", format, err)
+		}
+	}
+}
+
+func TestCSVTrailerMarkerAsKey(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "trailer-test")
+	defer os.RemoveAll(tempDir)
+
+	for _, finish := range []bool{true, false} {
+		filename := path.Join(tempDir, "report.csv")
+		dest, _ := CreateReport(nil, filename)
+		writer, _ := NewReportWriter(ReportFormatCSV, dest)
+		//an object in the bucket root whose key is the trailer marker, both in the middle and as the last record
+		for _, name := range []string{csvTrailerMarker, "news/one.mxf", csvTrailerMarker} {
+			writer.Write(&LookupResult{RequestedFile: name, RequestedFileSize: 100, RequestedFileStorageClass: "STANDARD", Count: 1})
+		}
+		if finish {
+			writer.Finish()
+		} else {
+			writer.Flush()
+		}
+		dest.Close()
+
+		results, err := drainReader(AsyncCsvReader(nil, filename, ReportReaderOptions{RequireTrailer: finish}))
+		if err != nil {
+			t.Errorf("finished %v: unexpected error %s", finish, err)
+		}
+		if len(results) != 3 || results[0].RequestedFile != csvTrailerMarker || results[2].RequestedFile != csvTrailerMarker {
+			t.Errorf("finished %v: got incorrect results %v", finish, results)
+		}
+		if finish {
+			if verifyErr := VerifyReport(nil, filename, ReportFormatCSV, ReportReaderOptions{}); verifyErr != nil {
+				t.Errorf("report with the marker as a key failed verification: %s", verifyErr)
+			}
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"strings"
+	"time"
+)
+
+/**
+normalised schema for storing scan results. Each scan gets a row in scan_runs, and every file that was looked up
+gets a row in requested_files, with its archive copies and proxies in their own tables.
+*/
+const resultsDatabaseSchema = `
+CREATE TABLE IF NOT EXISTS scan_runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	started_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP,
+	target_bucket TEXT NOT NULL,
+	index_name TEXT NOT NULL,
+	proxy_bucket TEXT NOT NULL,
+	excluded_buckets TEXT NOT NULL,
+	requested_file_count INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS requested_files (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id INTEGER NOT NULL REFERENCES scan_runs(id),
+	path TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	storage_class TEXT NOT NULL,
+	last_modified TIMESTAMP,
+	duplicates_count INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS requested_files_run ON requested_files(run_id);
+CREATE INDEX IF NOT EXISTS requested_files_path ON requested_files(path);
+CREATE TABLE IF NOT EXISTS archive_copies (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	requested_file_id INTEGER NOT NULL REFERENCES requested_files(id),
+	bucket TEXT NOT NULL,
+	path TEXT NOT NULL,
+	region TEXT,
+	size INTEGER NOT NULL,
+	storage_class TEXT NOT NULL,
+	last_modified TIMESTAMP,
+	archive_id TEXT NOT NULL,
+	proxied BOOLEAN NOT NULL
+);
+CREATE INDEX IF NOT EXISTS archive_copies_requested_file ON archive_copies(requested_file_id);
+CREATE TABLE IF NOT EXISTS proxies (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	requested_file_id INTEGER NOT NULL REFERENCES requested_files(id),
+	bucket TEXT NOT NULL,
+	path TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	invalid BOOLEAN NOT NULL,
+	invalid_reason TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS proxies_requested_file ON proxies(requested_file_id);
+`
+
+/**
+details of the scan that are recorded in the scan_runs table
+*/
+type ScanRunInfo struct {
+	TargetBucket    string
+	IndexName       string
+	ProxyBucket     string
+	ExcludedBuckets []string
+}
+
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func nullableString(s *string) interface{} {
+	if s == nil {
+		return nil
+	}
+	return *s
+}
+
+/**
+opens (and creates, if necessary) a results database at the given path
+*/
+func OpenResultsDatabase(filename string) (*sql.DB, error) {
+	db, openErr := sql.Open("sqlite3", filename+"?_journal_mode=WAL&_busy_timeout=5000")
+	if openErr != nil {
+		return nil, openErr
+	}
+	_, schemaErr := db.Exec(resultsDatabaseSchema)
+	if schemaErr != nil {
+		db.Close()
+		return nil, schemaErr
+	}
+	return db, nil
+}
+
+/**
+writes LookupResults into a results database, batching them up into transactions
+*/
+type ResultsDatabaseWriter struct {
+	db           *sql.DB
+	runId        int64
+	tx           *sql.Tx
+	pendingCount int
+	totalCount   int64
+	batchSize    int
+}
+
+func NewResultsDatabaseWriter(db *sql.DB, info ScanRunInfo) (*ResultsDatabaseWriter, error) {
+	result, err := db.Exec("INSERT INTO scan_runs (started_at, target_bucket, index_name, proxy_bucket, excluded_buckets) VALUES (?, ?, ?, ?, ?)",
+		time.Now().UTC(), info.TargetBucket, info.IndexName, info.ProxyBucket, strings.Join(info.ExcludedBuckets, ","))
+	if err != nil {
+		return nil, err
+	}
+	runId, idErr := result.LastInsertId()
+	if idErr != nil {
+		return nil, idErr
+	}
+	log.Printf("INFO ResultsDatabaseWriter recording results as scan run %d", runId)
+	return &ResultsDatabaseWriter{
+		db:        db,
+		runId:     runId,
+		batchSize: 1000,
+	}, nil
+}
+
+func (w *ResultsDatabaseWriter) Write(rec *LookupResult) error {
+	if w.tx == nil {
+		tx, beginErr := w.db.Begin()
+		if beginErr != nil {
+			return beginErr
+		}
+		w.tx = tx
+	}
+
+	result, err := w.tx.Exec("INSERT INTO requested_files (run_id, path, size, storage_class, last_modified, duplicates_count) VALUES (?, ?, ?, ?, ?, ?)",
+		w.runId, rec.RequestedFile, rec.RequestedFileSize, rec.RequestedFileStorageClass, nullableTime(rec.RequestedFileLastModified), rec.Count)
+	if err != nil {
+		return err
+	}
+	requestedFileId, idErr := result.LastInsertId()
+	if idErr != nil {
+		return idErr
+	}
+
+	for _, e := range rec.Entries {
+		_, err = w.tx.Exec("INSERT INTO archive_copies (requested_file_id, bucket, path, region, size, storage_class, last_modified, archive_id, proxied) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			requestedFileId, e.Bucket, e.Path, nullableString(e.Region), e.Size, e.StorageClass, nullableTime(e.LastModified), e.ArchiveId, e.Proxied)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range rec.Proxies {
+		_, err = w.tx.Exec("INSERT INTO proxies (requested_file_id, bucket, path, size, invalid, invalid_reason) VALUES (?, ?, ?, ?, ?, ?)",
+			requestedFileId, p.Bucket, p.Path, p.Size, p.Invalid, p.InvalidReason)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.totalCount++
+	w.pendingCount++
+	if w.pendingCount >= w.batchSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+/**
+commits any outstanding results
+*/
+func (w *ResultsDatabaseWriter) Flush() error {
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit()
+	w.tx = nil
+	w.pendingCount = 0
+	return err
+}
+
+/**
+commits any outstanding results and marks the scan run as finished
+*/
+func (w *ResultsDatabaseWriter) Finish() error {
+	flushErr := w.Flush()
+	if flushErr != nil {
+		return flushErr
+	}
+	_, err := w.db.Exec("UPDATE scan_runs SET finished_at=?, requested_file_count=? WHERE id=?", time.Now().UTC(), w.totalCount, w.runId)
+	return err
+}
+
+/**
+returns the most recent scan run that finished. Runs that crashed or are still going only have some of their results
+*/
+func latestRunId(db *sql.DB) (int64, error) {
+	var runId int64
+	err := db.QueryRow("SELECT id FROM scan_runs WHERE finished_at IS NOT NULL ORDER BY id DESC LIMIT 1").Scan(&runId)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("there are no finished scan runs in the database")
+	}
+	return runId, err
+}
+
+/**
+returns whether the given scan run has finished, or an error if it does not exist
+*/
+func isRunFinished(db *sql.DB, runId int64) (bool, error) {
+	var finishedAt sql.NullTime
+	err := db.QueryRow("SELECT finished_at FROM scan_runs WHERE id=?", runId).Scan(&finishedAt)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("there is no scan run %d in the database", runId)
+	}
+	return finishedAt.Valid, err
+}
+
+func readArchiveCopies(stmt *sql.Stmt, requestedFileId int64) ([]FoundEntry, error) {
+	rows, err := stmt.Query(requestedFileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]FoundEntry, 0)
+	for rows.Next() {
+		var e FoundEntry
+		var region sql.NullString
+		var lastModified sql.NullTime
+		scanErr := rows.Scan(&e.Bucket, &e.Path, &region, &e.Size, &e.StorageClass, &lastModified, &e.ArchiveId, &e.Proxied)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		if region.Valid {
+			e.Region = &region.String
+		}
+		if lastModified.Valid {
+			e.LastModified = lastModified.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func readProxies(stmt *sql.Stmt, requestedFileId int64) ([]FoundEntry, error) {
+	rows, err := stmt.Query(requestedFileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	proxies := make([]FoundEntry, 0)
+	for rows.Next() {
+		p := FoundEntry{IsProxy: true}
+		scanErr := rows.Scan(&p.Bucket, &p.Path, &p.Size, &p.Invalid, &p.InvalidReason)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		proxies = append(proxies, p)
+	}
+	return proxies, rows.Err()
+}
+
+/**
+reads LookupResults from a results database in the background, passing each onto the output channel and nil at the end.
+if runId is 0 then the most recent scan run is used. filter is an optional SQL condition on the requested_files
+table, e.g. "size > 1000000000". a runId for a scan that has not finished is refused unless allowIncomplete is set.
+the database holds every requested file, including those with no archive copy, but only the ones that were found in
+the archive are ever read back whatever the filter says, since everything that is read may be deleted.
+*/
+func AsyncSqliteReader(filename string, runId int64, filter string, allowIncomplete bool) (chan *LookupResult, chan error) {
+	outputCh := make(chan *LookupResult, 100)
+	errCh := make(chan error, 1)
+
+	go func() {
+		if IsS3Location(filename) {
+			errCh <- fmt.Errorf("results databases can only be read from local files, not %s", filename)
+			return
+		}
+		db, openErr := OpenResultsDatabase(filename)
+		if openErr != nil {
+			errCh <- openErr
+			return
+		}
+		defer db.Close()
+
+		if runId == 0 {
+			var runErr error
+			runId, runErr = latestRunId(db)
+			if runErr != nil {
+				errCh <- runErr
+				return
+			}
+		} else {
+			finished, runErr := isRunFinished(db, runId)
+			if runErr != nil {
+				errCh <- runErr
+				return
+			}
+			if !finished && !allowIncomplete {
+				errCh <- fmt.Errorf("scan run %d has not finished, so it only has some of its results", runId)
+				return
+			} else if !finished {
+				log.Printf("WARNING AsyncSqliteReader scan run %d has not finished, reading the results that it has", runId)
+			}
+		}
+
+		query := "SELECT id, path, size, storage_class, last_modified, duplicates_count FROM requested_files WHERE run_id=? AND duplicates_count > 0"
+		if filter != "" {
+			query += " AND (" + filter + ")"
+		}
+		query += " ORDER BY id"
+		log.Printf("INFO AsyncSqliteReader reading run %d from %s with query %s", runId, filename, query)
+
+		copiesStmt, copiesErr := db.Prepare("SELECT bucket, path, region, size, storage_class, last_modified, archive_id, proxied FROM archive_copies WHERE requested_file_id=? ORDER BY id")
+		if copiesErr != nil {
+			errCh <- copiesErr
+			return
+		}
+		defer copiesStmt.Close()
+		proxiesStmt, proxiesErr := db.Prepare("SELECT bucket, path, size, invalid, invalid_reason FROM proxies WHERE requested_file_id=? ORDER BY id")
+		if proxiesErr != nil {
+			errCh <- proxiesErr
+			return
+		}
+		defer proxiesStmt.Close()
+
+		rows, queryErr := db.Query(query, runId)
+		if queryErr != nil {
+			errCh <- queryErr
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var requestedFileId int64
+			var lastModified sql.NullTime
+			rec := &LookupResult{}
+			scanErr := rows.Scan(&requestedFileId, &rec.RequestedFile, &rec.RequestedFileSize, &rec.RequestedFileStorageClass, &lastModified, &rec.Count)
+			if scanErr != nil {
+				errCh <- scanErr
+				return
+			}
+			if lastModified.Valid {
+				rec.RequestedFileLastModified = lastModified.Time
+			}
+
+			var readErr error
+			rec.Entries, readErr = readArchiveCopies(copiesStmt, requestedFileId)
+			if readErr != nil {
+				errCh <- readErr
+				return
+			}
+			rec.Proxies, readErr = readProxies(proxiesStmt, requestedFileId)
+			if readErr != nil {
+				errCh <- readErr
+				return
+			}
+			outputCh <- rec
+		}
+		if rowsErr := rows.Err(); rowsErr != nil {
+			errCh <- rowsErr
+			return
+		}
+
+		log.Print("INFO AsyncSqliteReader reached end of results, exiting")
+		outputCh <- nil
+	}()
+
+	return outputCh, errCh
+}
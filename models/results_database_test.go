@@ -0,0 +1,164 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResultsDatabaseRoundTrip(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "results-db-test")
+	defer os.RemoveAll(tempDir)
+	filename := path.Join(tempDir, "results.sqlite")
+
+	region := "eu-west-1"
+	matched := &LookupResult{
+		RequestedFile:             "path/to/matched.mxf",
+		RequestedFileSize:         1000,
+		RequestedFileStorageClass: "STANDARD",
+		RequestedFileLastModified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Count:                     1,
+		Entries: []FoundEntry{
+			{Bucket: "archive", Path: "path/to/matched.mxf", Region: &region, Size: 1000, StorageClass: "GLACIER", ArchiveId: "abcd", Proxied: true},
+		},
+		Proxies: []FoundEntry{
+			{Bucket: "proxies", Path: "path/to/matched.mp4", Size: 10, IsProxy: true, Invalid: true, InvalidReason: "too small"},
+		},
+	}
+	unmatched := &LookupResult{
+		RequestedFile:     "path/to/unmatched.mxf",
+		RequestedFileSize: 2000,
+		Count:             0,
+		Entries:           []FoundEntry{},
+		Proxies:           []FoundEntry{},
+	}
+
+	db, openErr := OpenResultsDatabase(filename)
+	if openErr != nil {
+		t.Fatal("could not open database: ", openErr)
+	}
+	writer, writerErr := NewResultsDatabaseWriter(db, ScanRunInfo{TargetBucket: "holding-pen", IndexName: "archivehunter", ProxyBucket: "proxies"})
+	if writerErr != nil {
+		t.Fatal("could not start scan run: ", writerErr)
+	}
+	writer.Write(matched)
+	writer.Write(unmatched)
+	if finishErr := writer.Finish(); finishErr != nil {
+		t.Fatal("could not finish scan run: ", finishErr)
+	}
+	db.Close()
+
+	outputCh, errCh := AsyncSqliteReader(filename, 0, "duplicates_count > 0", false)
+	select {
+	case result := <-outputCh:
+		if !reflect.DeepEqual(result, matched) {
+			t.Errorf("round trip gave %v, expected %v", result, matched)
+		}
+	case err := <-errCh:
+		t.Fatal("reader failed: ", err)
+	}
+	if endMarker := <-outputCh; endMarker != nil {
+		t.Errorf("filter was not applied, got %v", endMarker)
+	}
+}
+
+func TestResultsDatabaseSkipsUnarchived(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "results-db-test")
+	defer os.RemoveAll(tempDir)
+	filename := path.Join(tempDir, "results.sqlite")
+
+	db, openErr := OpenResultsDatabase(filename)
+	if openErr != nil {
+		t.Fatal("could not open database: ", openErr)
+	}
+	writer, writerErr := NewResultsDatabaseWriter(db, ScanRunInfo{TargetBucket: "holding-pen", IndexName: "archivehunter", ProxyBucket: "proxies"})
+	if writerErr != nil {
+		t.Fatal("could not start scan run: ", writerErr)
+	}
+	writer.Write(&LookupResult{RequestedFile: "path/to/unarchived.mxf", RequestedFileSize: 2000, Count: 0, Entries: []FoundEntry{}, Proxies: []FoundEntry{}})
+	writer.Write(&LookupResult{RequestedFile: "path/to/archived.mxf", RequestedFileSize: 1000, Count: 1,
+		Entries: []FoundEntry{{Bucket: "archive", Path: "path/to/archived.mxf", Size: 1000}}, Proxies: []FoundEntry{}})
+	if finishErr := writer.Finish(); finishErr != nil {
+		t.Fatal("could not finish scan run: ", finishErr)
+	}
+	db.Close()
+
+	//neither no filter nor one that would match everything should bring back the file with no archive copy
+	for _, filter := range []string{"", "1=1 OR duplicates_count = 0"} {
+		outputCh, errCh := AsyncSqliteReader(filename, 0, filter, false)
+		paths := make([]string, 0)
+		for done := false; !done; {
+			select {
+			case result := <-outputCh:
+				if result == nil {
+					done = true
+				} else {
+					paths = append(paths, result.RequestedFile)
+				}
+			case err := <-errCh:
+				t.Fatal("reader failed: ", err)
+			}
+		}
+		if !reflect.DeepEqual(paths, []string{"path/to/archived.mxf"}) {
+			t.Errorf("filter '%s' read back %v, expected only the archived file", filter, paths)
+		}
+	}
+}
+
+func TestResultsDatabaseUnfinishedRuns(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "results-db-test")
+	defer os.RemoveAll(tempDir)
+	filename := path.Join(tempDir, "results.sqlite")
+
+	db, openErr := OpenResultsDatabase(filename)
+	if openErr != nil {
+		t.Fatal("could not open database: ", openErr)
+	}
+	archived := func(name string) *LookupResult {
+		return &LookupResult{RequestedFile: name, Count: 1, Entries: []FoundEntry{{Bucket: "archive", Path: name}}, Proxies: []FoundEntry{}}
+	}
+	finished, _ := NewResultsDatabaseWriter(db, ScanRunInfo{TargetBucket: "holding-pen"})
+	finished.Write(archived("finished.mxf"))
+	finished.Finish()
+	//a later run that crashed part way through
+	crashed, _ := NewResultsDatabaseWriter(db, ScanRunInfo{TargetBucket: "holding-pen"})
+	crashed.Write(archived("crashed.mxf"))
+	crashed.Flush()
+	db.Close()
+
+	readAll := func(runId int64, allowIncomplete bool) ([]string, error) {
+		outputCh, errCh := AsyncSqliteReader(filename, runId, "", allowIncomplete)
+		paths := make([]string, 0)
+		for {
+			select {
+			case result := <-outputCh:
+				if result == nil {
+					return paths, nil
+				}
+				paths = append(paths, result.RequestedFile)
+			case err := <-errCh:
+				return paths, err
+			}
+		}
+	}
+
+	paths, err := readAll(0, false)
+	if err != nil || !reflect.DeepEqual(paths, []string{"finished.mxf"}) {
+		t.Errorf("default run gave %v %v, expected the finished run", paths, err)
+	}
+	_, err = readAll(crashed.runId, false)
+	if err == nil {
+		t.Error("expected an unfinished run to be refused")
+	}
+	paths, err = readAll(crashed.runId, true)
+	if err != nil || !reflect.DeepEqual(paths, []string{"crashed.mxf"}) {
+		t.Errorf("unfinished run with allowIncomplete gave %v %v", paths, err)
+	}
+	_, err = readAll(99, true)
+	if err == nil {
+		t.Error("expected a run that does not exist to be refused")
+	}
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+/**
+S3 object keys are kept in their raw form, exactly as they are stored in the bucket, everywhere inside the tools;
+LookupResult.RequestedFile and FoundEntry.Path always hold raw keys and are passed to the S3 API as they are.
+Encoded forms only exist at the edges: bucket listings that are requested with EncodingTypeUrl, and the s3:// URIs
+written into reports. These functions convert between them.
+*/
+
+/**
+decodes a key from a bucket listing that was requested with EncodingTypeUrl
+*/
+func DecodeListedKey(encoded string) (string, error) {
+	return url.QueryUnescape(encoded)
+}
+
+/**
+encodes a raw key in the same way as a url-encoded bucket listing, the reverse of DecodeListedKey
+*/
+func ListingEncodedKey(key string) string {
+	return url.QueryEscape(key)
+}
+
+/**
+returns an s3:// URI for the raw key in the given bucket, with the key percent-encoded as a URL path. Unlike
+encoding for a listing, spaces become %20 and plus signs are left alone.
+*/
+func KeyUri(bucket string, key string) *url.URL {
+	return &url.URL{
+		Scheme: "s3",
+		Host:   bucket,
+		Path:   "/" + key,
+	}
+}
+
+/**
+splits an s3:// URI into its bucket and raw key, the reverse of KeyUri
+*/
+func KeyFromUri(from *url.URL) (string, string, error) {
+	if from == nil {
+		return "", "", errors.New("no data provided")
+	}
+	if from.Scheme != "s3" {
+		return "", "", fmt.Errorf("'%s' is not an s3:// URI", from)
+	}
+	//url.Parse has already decoded the path, so it must not be unescaped again
+	return from.Host, strings.TrimPrefix(from.Path, "/"), nil
+}
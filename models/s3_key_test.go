@@ -0,0 +1,50 @@
+package models
+
+import (
+	"net/url"
+	"testing"
+	"testing/quick"
+)
+
+func TestKeyListingRoundTrip(t *testing.T) {
+	roundTrip := func(raw string) bool {
+		decoded, err := DecodeListedKey(ListingEncodedKey(raw))
+		return err == nil && decoded == raw
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyUriRoundTrip(t *testing.T) {
+	roundTrip := func(raw string) bool {
+		parsed, parseErr := url.Parse(KeyUri("some-bucket", raw).String())
+		if parseErr != nil {
+			return false
+		}
+		bucket, key, err := KeyFromUri(parsed)
+		return err == nil && bucket == "some-bucket" && key == raw
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyAwkwardCharacters(t *testing.T) {
+	for _, raw := range []string{"a b.mxf", "a+b.mxf", "100%.mxf", "what?#.mxf", "/leading/slash", "a%2Fb", "日本語/ファイル.mxf", ""} {
+		decoded, err := DecodeListedKey(ListingEncodedKey(raw))
+		if err != nil || decoded != raw {
+			t.Errorf("listing round trip of %q gave %q (%v)", raw, decoded, err)
+		}
+
+		entry, err := FoundEntryFromUriString(FoundEntry{Bucket: "bucket", Path: raw}.MustUri().String(), false)
+		if err != nil || entry.Path != raw || entry.Bucket != "bucket" {
+			t.Errorf("uri round trip of %q gave %v (%v)", raw, entry, err)
+		}
+	}
+
+	//a listing encodes spaces as "+", so a literal plus must not come back as a space
+	if decoded, _ := DecodeListedKey("a%2Bb+c"); decoded != "a+b c" {
+		t.Errorf("got incorrect decoding %q", decoded)
+	}
+}